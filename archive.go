@@ -0,0 +1,570 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+// archiveScanTimeout bounds how long listing a torrent's archives waits for
+// the pieces holding their headers.
+const archiveScanTimeout = time.Minute
+
+var (
+	rarPartPattern   = regexp.MustCompile(`(?i)^(.*)\.part(\d+)\.rar$`)
+	rarVolumeHeader4 = []byte("Rar!\x1a\x07\x00")
+	rarVolumeHeader5 = []byte("Rar!\x1a\x07\x01\x00")
+)
+
+// Archive is a RAR (possibly split into volumes) or ZIP archive inside a
+// torrent. Only entries stored without compression or encryption are listed,
+// as those can be streamed straight from the torrent's pieces.
+type Archive struct {
+	Path    string // display path of the first volume
+	Entries []ArchiveEntry
+}
+
+// ArchiveEntry is a file inside an archive, served under its archive's path
+// as if the archive were a folder.
+type ArchiveEntry struct {
+	Path     string
+	Size     int64
+	segments []fileSegment // the entry's data in each volume
+}
+
+// BytesCompleted counts the entry's bytes in verified pieces.
+func (e ArchiveEntry) BytesCompleted() int64 {
+	var done int64
+	for _, s := range e.segments {
+		t := s.file.Torrent()
+		pieceLength := t.Info().PieceLength
+		start := s.file.Offset() + s.offset
+		end := start + s.length
+		for i := start / pieceLength; i*pieceLength < end; i++ {
+			if t.PieceState(int(i)).Complete {
+				done += min(end, (i+1)*pieceLength) - max(start, i*pieceLength)
+			}
+		}
+	}
+	return done
+}
+
+// ArchiveIndex remembers the archives found in each torrent, as finding them
+// means downloading the pieces holding their headers.
+type ArchiveIndex struct {
+	mu    sync.Mutex
+	scans map[string]*archiveScan
+}
+
+type archiveScan struct {
+	done     chan struct{}
+	archives []Archive
+}
+
+func NewArchiveIndex() *ArchiveIndex {
+	return &ArchiveIndex{scans: make(map[string]*archiveScan)}
+}
+
+// Get returns the torrent's archives, scanning them on first use. A scan that
+// times out is retried on the next call.
+func (idx *ArchiveIndex) Get(t *torrent.Torrent) []Archive {
+	<-t.GotInfo()
+	volumes := archiveVolumes(t)
+	if len(volumes) == 0 {
+		return nil
+	}
+
+	ih := t.InfoHash().String()
+	idx.mu.Lock()
+	scan, ok := idx.scans[ih]
+	if ok {
+		idx.mu.Unlock()
+		<-scan.done
+		return scan.archives
+	}
+	scan = &archiveScan{done: make(chan struct{})}
+	idx.scans[ih] = scan
+	idx.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), archiveScanTimeout)
+	defer cancel()
+	complete := true
+	for _, files := range volumes {
+		archive, err := scanArchive(ctx, files)
+		if err != nil {
+			log.Printf("error reading archive %s: %v", files[0].DisplayPath(), err)
+			complete = complete && ctx.Err() == nil
+			continue
+		}
+		if len(archive.Entries) > 0 {
+			scan.archives = append(scan.archives, archive)
+		}
+	}
+
+	if !complete {
+		idx.mu.Lock()
+		delete(idx.scans, ih)
+		idx.mu.Unlock()
+	}
+	close(scan.done)
+	return scan.archives
+}
+
+// Cached returns the torrent's archives if they were already scanned, without
+// waiting for pieces.
+func (idx *ArchiveIndex) Cached(t *torrent.Torrent) []Archive {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	scan, ok := idx.scans[t.InfoHash().String()]
+	if !ok {
+		return nil
+	}
+	select {
+	case <-scan.done:
+		return scan.archives
+	default:
+		return nil
+	}
+}
+
+// Entry finds an archive entry by its path.
+func (idx *ArchiveIndex) Entry(t *torrent.Torrent, entryPath string) (ArchiveEntry, bool) {
+	for _, a := range idx.Get(t) {
+		for _, e := range a.Entries {
+			if e.Path == entryPath {
+				return e, true
+			}
+		}
+	}
+	return ArchiveEntry{}, false
+}
+
+// archiveVolumes finds the torrent's archives, each as its volumes in order.
+// RAR volumes are named either name.part1.rar, name.part2.rar, ... or name.rar,
+// name.r00, name.r01, ... name.s00, ...
+func archiveVolumes(t *torrent.Torrent) [][]*torrent.File {
+	byPath := make(map[string]*torrent.File, len(t.Files()))
+	for _, f := range t.Files() {
+		byPath[strings.ToLower(f.DisplayPath())] = f
+	}
+
+	var archives [][]*torrent.File
+	for _, f := range t.Files() {
+		name := f.DisplayPath()
+		ext := strings.ToLower(path.Ext(name))
+		if ext == ".zip" {
+			archives = append(archives, []*torrent.File{f})
+			continue
+		}
+		if ext != ".rar" {
+			continue
+		}
+
+		var volumes []*torrent.File
+		if m := rarPartPattern.FindStringSubmatch(name); m != nil {
+			if n, _ := strconv.Atoi(m[2]); n != 1 {
+				continue
+			}
+			for i := 1; ; i++ {
+				v, ok := byPath[strings.ToLower(fmt.Sprintf("%s.part%0*d.rar", m[1], len(m[2]), i))]
+				if !ok {
+					break
+				}
+				volumes = append(volumes, v)
+			}
+		} else {
+			volumes = append(volumes, f)
+			base := strings.TrimSuffix(name, path.Ext(name))
+			for i := 0; i < ('z'-'r'+1)*100; i++ {
+				v, ok := byPath[strings.ToLower(fmt.Sprintf("%s.%c%02d", base, 'r'+i/100, i%100))]
+				if !ok {
+					break
+				}
+				volumes = append(volumes, v)
+			}
+		}
+		archives = append(archives, volumes)
+	}
+	return archives
+}
+
+func scanArchive(ctx context.Context, volumes []*torrent.File) (Archive, error) {
+	archive := Archive{Path: volumes[0].DisplayPath()}
+	if strings.EqualFold(path.Ext(archive.Path), ".zip") {
+		entries, err := scanZip(ctx, archive.Path, volumes[0])
+		archive.Entries = entries
+		return archive, err
+	}
+
+	// Entries split over volumes continue in the next volume's first header.
+	cur := -1
+	for _, f := range volumes {
+		headers, err := readRARVolume(ctx, f)
+		if err != nil {
+			return archive, err
+		}
+		for _, h := range headers {
+			entryPath := archive.Path + "/" + h.name
+			switch {
+			case h.splitBefore && cur >= 0 && archive.Entries[cur].Path == entryPath:
+			case !h.splitBefore && h.stored:
+				archive.Entries = append(archive.Entries, ArchiveEntry{Path: entryPath, Size: h.unpacked})
+				cur = len(archive.Entries) - 1
+			default:
+				cur = -1
+				continue
+			}
+			archive.Entries[cur].segments = append(archive.Entries[cur].segments,
+				fileSegment{file: f, offset: h.dataOffset, length: h.dataSize, name: entryPath})
+			if !h.splitAfter {
+				cur = -1
+			}
+		}
+	}
+
+	// Drop entries with missing volumes.
+	complete := archive.Entries[:0]
+	for _, e := range archive.Entries {
+		var size int64
+		for _, s := range e.segments {
+			size += s.length
+		}
+		if size == e.Size {
+			complete = append(complete, e)
+		}
+	}
+	archive.Entries = complete
+	return archive, nil
+}
+
+func scanZip(ctx context.Context, archivePath string, f *torrent.File) ([]ArchiveEntry, error) {
+	r := newFileReaderAt(ctx, f)
+	defer r.Close()
+
+	zr, err := zip.NewReader(r, f.Length())
+	if err != nil {
+		return nil, fmt.Errorf("error reading zip directory: %w", err)
+	}
+	var entries []ArchiveEntry
+	for _, zf := range zr.File {
+		// Bit 0 of the flags marks encrypted entries.
+		if zf.Method != zip.Store || zf.Flags&1 != 0 || zf.FileInfo().IsDir() {
+			continue
+		}
+		offset, err := zf.DataOffset()
+		if err != nil {
+			return nil, fmt.Errorf("error reading zip entry %s: %w", zf.Name, err)
+		}
+		entryPath := archivePath + "/" + zf.Name
+		size := int64(zf.UncompressedSize64)
+		entries = append(entries, ArchiveEntry{
+			Path:     entryPath,
+			Size:     size,
+			segments: []fileSegment{{file: f, offset: offset, length: size, name: entryPath}},
+		})
+	}
+	return entries, nil
+}
+
+// rarFileHeader is a file header of one RAR volume.
+type rarFileHeader struct {
+	name                    string
+	unpacked                int64
+	dataOffset, dataSize    int64
+	splitBefore, splitAfter bool
+	stored                  bool // uncompressed, unencrypted and not a directory
+}
+
+// readRARVolume lists a volume's file headers. Reading stops at a file
+// continuing in the next volume, as nothing but its data and the end of
+// archive header follow, which saves downloading every volume's last piece.
+func readRARVolume(ctx context.Context, f *torrent.File) ([]rarFileHeader, error) {
+	r := newFileReaderAt(ctx, f)
+	defer r.Close()
+
+	sig := make([]byte, len(rarVolumeHeader5))
+	n, err := r.ReadAt(sig, 0)
+	switch {
+	case bytes.Equal(sig[:n], rarVolumeHeader5):
+		return readRAR5Headers(r, f.Length())
+	case n >= len(rarVolumeHeader4) && bytes.Equal(sig[:len(rarVolumeHeader4)], rarVolumeHeader4):
+		return readRAR4Headers(r, f.Length())
+	case err != nil && !errors.Is(err, io.EOF):
+		return nil, fmt.Errorf("error reading %s: %w", f.DisplayPath(), err)
+	default:
+		return nil, fmt.Errorf("%s is not a RAR volume", f.DisplayPath())
+	}
+}
+
+const (
+	rar4MainHeader = 0x73
+	rar4FileHeader = 0x74
+	rar4Service    = 0x7a
+	rar4End        = 0x7b
+
+	rar4LongBlock   = 0x8000
+	rar4SplitBefore = 0x01
+	rar4SplitAfter  = 0x02
+	rar4Password    = 0x04
+	rar4Directory   = 0xe0
+	rar4Large       = 0x100
+	rar4Unicode     = 0x200
+	rar4Encrypted   = 0x80 // in the main header: headers are encrypted
+	rar4Store       = 0x30
+)
+
+func readRAR4Headers(r io.ReaderAt, size int64) ([]rarFileHeader, error) {
+	var headers []rarFileHeader
+	offset := int64(len(rarVolumeHeader4))
+	for offset+7 <= size {
+		block := make([]byte, 7)
+		if _, err := r.ReadAt(block, offset); err != nil {
+			return nil, fmt.Errorf("error reading RAR header: %w", err)
+		}
+		kind, flags := block[2], binary.LittleEndian.Uint16(block[3:])
+		headSize := int64(binary.LittleEndian.Uint16(block[5:]))
+		if headSize < 7 {
+			return nil, errors.New("corrupt RAR header")
+		}
+		block = make([]byte, headSize)
+		if _, err := r.ReadAt(block, offset); err != nil {
+			return nil, fmt.Errorf("error reading RAR header: %w", err)
+		}
+
+		var dataSize int64
+		if flags&rar4LongBlock != 0 || kind == rar4FileHeader || kind == rar4Service {
+			if headSize < 11 {
+				return nil, errors.New("corrupt RAR header")
+			}
+			dataSize = int64(binary.LittleEndian.Uint32(block[7:]))
+		}
+
+		switch kind {
+		case rar4MainHeader:
+			if flags&rar4Encrypted != 0 {
+				return nil, errors.New("RAR headers are encrypted")
+			}
+		case rar4FileHeader:
+			if headSize < 32 {
+				return nil, errors.New("corrupt RAR file header")
+			}
+			h := rarFileHeader{
+				unpacked:    int64(binary.LittleEndian.Uint32(block[11:])),
+				splitBefore: flags&rar4SplitBefore != 0,
+				splitAfter:  flags&rar4SplitAfter != 0,
+				stored:      block[25] == rar4Store && flags&rar4Password == 0 && flags&rar4Directory != rar4Directory,
+			}
+			nameSize := int64(binary.LittleEndian.Uint16(block[26:]))
+			nameStart := int64(32)
+			if flags&rar4Large != 0 {
+				if headSize < 40 {
+					return nil, errors.New("corrupt RAR file header")
+				}
+				dataSize |= int64(binary.LittleEndian.Uint32(block[32:])) << 32
+				h.unpacked |= int64(binary.LittleEndian.Uint32(block[36:])) << 32
+				nameStart = 40
+			}
+			if nameStart+nameSize > headSize {
+				return nil, errors.New("corrupt RAR file header")
+			}
+			name := block[nameStart : nameStart+nameSize]
+			if flags&rar4Unicode != 0 {
+				// The ASCII name is followed by a zero and the encoded
+				// Unicode one.
+				name, _, _ = bytes.Cut(name, []byte{0})
+			}
+			h.name = strings.ReplaceAll(string(name), `\`, "/")
+			h.dataOffset, h.dataSize = offset+headSize, dataSize
+			headers = append(headers, h)
+			if h.splitAfter {
+				return headers, nil
+			}
+		case rar4End:
+			return headers, nil
+		}
+		offset += headSize + dataSize
+	}
+	return headers, nil
+}
+
+const (
+	rar5FileHeader       = 2
+	rar5EncryptionHeader = 4
+	rar5End              = 5
+
+	rar5ExtraArea   = 0x01
+	rar5DataArea    = 0x02
+	rar5SplitBefore = 0x08
+	rar5SplitAfter  = 0x10
+
+	rar5Directory   = 0x01
+	rar5HasTime     = 0x02
+	rar5HasCRC      = 0x04
+	rar5Encryption  = 0x01 // extra record type
+	rar5MaxHeadSize = 2 << 20
+)
+
+func readRAR5Headers(r io.ReaderAt, size int64) ([]rarFileHeader, error) {
+	var headers []rarFileHeader
+	offset := int64(len(rarVolumeHeader5))
+	for offset < size {
+		// CRC32 followed by the header size as a vint of up to 3 bytes.
+		prefix := make([]byte, 7)
+		n, err := r.ReadAt(prefix, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("error reading RAR header: %w", err)
+		}
+		headSize, vintLen := binary.Uvarint(prefix[min(4, n):n])
+		if vintLen <= 0 || headSize == 0 || headSize > rar5MaxHeadSize {
+			return nil, errors.New("corrupt RAR header")
+		}
+		start := offset + 4 + int64(vintLen)
+		block := make([]byte, headSize)
+		if _, err := r.ReadAt(block, start); err != nil {
+			return nil, fmt.Errorf("error reading RAR header: %w", err)
+		}
+
+		fields := rar5Fields{b: block}
+		kind, flags := fields.vint(), fields.vint()
+		var extraSize, dataSize uint64
+		if flags&rar5ExtraArea != 0 {
+			extraSize = fields.vint()
+		}
+		if flags&rar5DataArea != 0 {
+			dataSize = fields.vint()
+		}
+		if fields.err != nil || extraSize > headSize {
+			return nil, errors.New("corrupt RAR header")
+		}
+
+		switch kind {
+		case rar5EncryptionHeader:
+			return nil, errors.New("RAR headers are encrypted")
+		case rar5FileHeader:
+			fileFlags, unpacked := fields.vint(), fields.vint()
+			fields.vint() // attributes
+			if fileFlags&rar5HasTime != 0 {
+				fields.skip(4)
+			}
+			if fileFlags&rar5HasCRC != 0 {
+				fields.skip(4)
+			}
+			compression := fields.vint()
+			fields.vint() // host OS
+			name := fields.bytes(fields.vint())
+			if fields.err != nil {
+				return nil, errors.New("corrupt RAR file header")
+			}
+			// Bits 7 to 9 of the compression info hold the method, 0 is store.
+			h := rarFileHeader{
+				name:        string(name),
+				unpacked:    int64(unpacked),
+				dataOffset:  start + int64(headSize),
+				dataSize:    int64(dataSize),
+				splitBefore: flags&rar5SplitBefore != 0,
+				splitAfter:  flags&rar5SplitAfter != 0,
+				stored: (compression>>7)&7 == 0 && fileFlags&rar5Directory == 0 &&
+					!rar5Encrypted(block[headSize-extraSize:]),
+			}
+			headers = append(headers, h)
+			if h.splitAfter {
+				return headers, nil
+			}
+		case rar5End:
+			return headers, nil
+		}
+		offset = start + int64(headSize) + int64(dataSize)
+	}
+	return headers, nil
+}
+
+// rar5Encrypted reports whether a file header's extra area has an encryption
+// record.
+func rar5Encrypted(extra []byte) bool {
+	fields := rar5Fields{b: extra}
+	for len(fields.b) > 0 && fields.err == nil {
+		record := rar5Fields{b: fields.bytes(fields.vint())}
+		if record.vint() == rar5Encryption && record.err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// rar5Fields reads the variable length integers RAR5 headers are made of,
+// remembering the first error.
+type rar5Fields struct {
+	b   []byte
+	err error
+}
+
+func (f *rar5Fields) vint() uint64 {
+	v, n := binary.Uvarint(f.b)
+	if n <= 0 {
+		f.err = errors.New("invalid vint")
+		f.b = nil
+		return 0
+	}
+	f.b = f.b[n:]
+	return v
+}
+
+func (f *rar5Fields) bytes(n uint64) []byte {
+	if n > uint64(len(f.b)) {
+		f.err = io.ErrUnexpectedEOF
+		f.b = nil
+		return nil
+	}
+	b := f.b[:n]
+	f.b = f.b[n:]
+	return b
+}
+
+func (f *rar5Fields) skip(n uint64) {
+	f.bytes(n)
+}
+
+// fileReaderAt reads a torrent file at arbitrary offsets, downloading only the
+// pieces asked for.
+type fileReaderAt struct {
+	ctx    context.Context
+	reader torrent.Reader
+	size   int64
+}
+
+func newFileReaderAt(ctx context.Context, f *torrent.File) *fileReaderAt {
+	reader := f.NewReader()
+	reader.SetReadahead(0)
+	return &fileReaderAt{ctx: ctx, reader: reader, size: f.Length()}
+}
+
+func (r *fileReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if _, err := r.reader.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(ContextReader{r.reader, r.ctx}, b)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *fileReaderAt) Close() error {
+	return r.reader.Close()
+}
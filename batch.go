@@ -0,0 +1,246 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	g "github.com/anacrolix/generics"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// BatchedStorage buffers chunk writes in memory and hands them to the
+// underlying storage a whole piece (or a contiguous run of chunks) at a time.
+// Every WriteAt on the sqlite storage is its own transaction, so writing 16 KiB
+// chunks one by one spends most of the time syncing rather than writing.
+//
+// Buffered data is written out when its piece is fully buffered, before the
+// piece is read or marked complete, once it has waited longer than
+// interval, or when more than maxBuffered bytes are pending. Write errors
+// surface late, as a failed hash check that gets the piece downloaded again.
+type BatchedStorage struct {
+	inner       storage.ClientImplCloser
+	maxBuffered int64
+	interval    time.Duration
+
+	mu       sync.Mutex
+	pending  map[batchKey]*pendingPiece
+	buffered int64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type batchKey struct {
+	infoHash metainfo.Hash
+	index    int
+}
+
+type pendingPiece struct {
+	impl   storage.PieceImpl
+	length int64
+	chunks []pendingChunk
+	size   int64
+	since  time.Time
+}
+
+type pendingChunk struct {
+	off  int64
+	data []byte
+}
+
+func (p *pendingPiece) overlaps(off, n int64) bool {
+	for _, c := range p.chunks {
+		if off < c.off+int64(len(c.data)) && c.off < off+n {
+			return true
+		}
+	}
+	return false
+}
+
+func NewBatchedStorage(inner storage.ClientImplCloser, maxBuffered int64, interval time.Duration) *BatchedStorage {
+	s := &BatchedStorage{
+		inner:       inner,
+		maxBuffered: maxBuffered,
+		interval:    interval,
+		pending:     make(map[batchKey]*pendingPiece),
+		closed:      make(chan struct{}),
+	}
+	if interval > 0 {
+		go s.run()
+	}
+	return s
+}
+
+func (s *BatchedStorage) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			for key, p := range s.pending {
+				if time.Since(p.since) >= s.interval {
+					s.flushLocked(key)
+				}
+			}
+			s.mu.Unlock()
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *BatchedStorage) OpenTorrent(ctx context.Context, info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	t, err := s.inner.OpenTorrent(ctx, info, infoHash)
+	if err != nil {
+		return t, err
+	}
+
+	innerPiece := t.PieceWithHash
+	if innerPiece == nil {
+		piece := t.Piece
+		innerPiece = func(p metainfo.Piece, _ g.Option[[]byte]) storage.PieceImpl {
+			return piece(p)
+		}
+	}
+	t.Piece = nil
+	t.PieceWithHash = func(p metainfo.Piece, pieceHash g.Option[[]byte]) storage.PieceImpl {
+		return batchedPiece{
+			s:      s,
+			key:    batchKey{infoHash, p.Index()},
+			length: p.Length(),
+			inner:  innerPiece(p, pieceHash),
+		}
+	}
+
+	innerFlush, innerClose := t.Flush, t.Close
+	t.Flush = func() error {
+		s.flushTorrent(infoHash)
+		if innerFlush != nil {
+			return innerFlush()
+		}
+		return nil
+	}
+	t.Close = func() error {
+		s.flushTorrent(infoHash)
+		if innerClose != nil {
+			return innerClose()
+		}
+		return nil
+	}
+	return t, nil
+}
+
+func (s *BatchedStorage) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	s.mu.Lock()
+	for key := range s.pending {
+		s.flushLocked(key)
+	}
+	s.mu.Unlock()
+	return s.inner.Close()
+}
+
+func (s *BatchedStorage) write(key batchKey, length int64, impl storage.PieceImpl, b []byte, off int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pending[key]
+	if ok && p.overlaps(off, int64(len(b))) {
+		// Rewrites must land after the data they replace.
+		s.flushLocked(key)
+		ok = false
+	}
+	if !ok {
+		p = &pendingPiece{impl: impl, length: length, since: time.Now()}
+		s.pending[key] = p
+	}
+	p.chunks = append(p.chunks, pendingChunk{off, slices.Clone(b)})
+	p.size += int64(len(b))
+	s.buffered += int64(len(b))
+
+	if p.size >= p.length {
+		s.flushLocked(key)
+	}
+	if s.buffered > s.maxBuffered {
+		for key := range s.pending {
+			s.flushLocked(key)
+		}
+	}
+}
+
+func (s *BatchedStorage) flush(key batchKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked(key)
+}
+
+func (s *BatchedStorage) flushTorrent(infoHash metainfo.Hash) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.pending {
+		if key.infoHash == infoHash {
+			s.flushLocked(key)
+		}
+	}
+}
+
+// flushLocked writes a piece's buffered chunks, merging adjacent ones so each
+// contiguous run takes a single write.
+func (s *BatchedStorage) flushLocked(key batchKey) {
+	p, ok := s.pending[key]
+	if !ok {
+		return
+	}
+	delete(s.pending, key)
+	s.buffered -= p.size
+
+	slices.SortStableFunc(p.chunks, func(a, b pendingChunk) int {
+		return cmp.Compare(a.off, b.off)
+	})
+	for i := 0; i < len(p.chunks); {
+		run := p.chunks[i]
+		for i++; i < len(p.chunks) && p.chunks[i].off == run.off+int64(len(run.data)); i++ {
+			run.data = append(run.data, p.chunks[i].data...)
+		}
+		if _, err := p.impl.WriteAt(run.data, run.off); err != nil {
+			log.Printf("error writing piece %d of %s: %v", key.index, key.infoHash, err)
+		}
+	}
+}
+
+type batchedPiece struct {
+	s      *BatchedStorage
+	key    batchKey
+	length int64
+	inner  storage.PieceImpl
+}
+
+func (p batchedPiece) WriteAt(b []byte, off int64) (int, error) {
+	p.s.write(p.key, p.length, p.inner, b, off)
+	return len(b), nil
+}
+
+func (p batchedPiece) ReadAt(b []byte, off int64) (int, error) {
+	p.s.flush(p.key)
+	return p.inner.ReadAt(b, off)
+}
+
+func (p batchedPiece) MarkComplete() error {
+	p.s.flush(p.key)
+	return p.inner.MarkComplete()
+}
+
+func (p batchedPiece) MarkNotComplete() error {
+	return p.inner.MarkNotComplete()
+}
+
+func (p batchedPiece) Completion() storage.Completion {
+	return p.inner.Completion()
+}
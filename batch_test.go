@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	g "github.com/anacrolix/generics"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// recordingStorage is a memoryStorage that records the writes reaching it.
+type recordingStorage struct {
+	memoryStorage
+
+	mu     sync.Mutex
+	opened []metainfo.Hash
+	writes []recordedWrite
+}
+
+type recordedWrite struct {
+	piece int
+	off   int64
+	n     int
+}
+
+func (s *recordingStorage) OpenTorrent(ctx context.Context, info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	s.mu.Lock()
+	s.opened = append(s.opened, infoHash)
+	s.mu.Unlock()
+
+	t, err := s.memoryStorage.OpenTorrent(ctx, info, infoHash)
+	if err != nil {
+		return t, err
+	}
+	innerPiece := t.Piece
+	t.Piece = func(p metainfo.Piece) storage.PieceImpl {
+		return recordingPiece{innerPiece(p), s, p.Index()}
+	}
+	return t, nil
+}
+
+func (s *recordingStorage) takeWrites() []recordedWrite {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writes := s.writes
+	s.writes = nil
+	return writes
+}
+
+type recordingPiece struct {
+	storage.PieceImpl
+	s     *recordingStorage
+	index int
+}
+
+func (p recordingPiece) WriteAt(b []byte, off int64) (int, error) {
+	p.s.mu.Lock()
+	p.s.writes = append(p.s.writes, recordedWrite{p.index, off, len(b)})
+	p.s.mu.Unlock()
+	return p.PieceImpl.WriteAt(b, off)
+}
+
+// testInfo has two pieces of four 16 byte chunks.
+func testInfo() *metainfo.Info {
+	return &metainfo.Info{Name: "test", PieceLength: 64, Length: 128, Pieces: make([]byte, 2*20)}
+}
+
+func openBatched(t *testing.T, maxBuffered int64) (*BatchedStorage, *recordingStorage, storage.TorrentImpl) {
+	t.Helper()
+	inner := &recordingStorage{}
+	s := NewBatchedStorage(inner, maxBuffered, 0)
+	t.Cleanup(func() { s.Close() })
+	impl, err := s.OpenTorrent(context.Background(), testInfo(), metainfo.Hash{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, inner, impl
+}
+
+func piece(impl storage.TorrentImpl, i int) storage.PieceImpl {
+	return impl.PieceWithHash(testInfo().Piece(i), g.None[[]byte]())
+}
+
+func chunk(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 16)
+}
+
+func TestBatchedStorageWritesWholePieces(t *testing.T) {
+	_, inner, impl := openBatched(t, 1<<20)
+	p := piece(impl, 0)
+
+	// Out of order, as chunks arrive from different peers.
+	for _, off := range []int64{32, 0, 48} {
+		if n, err := p.WriteAt(chunk(byte(off)), off); n != 16 || err != nil {
+			t.Fatalf("WriteAt = %d, %v", n, err)
+		}
+	}
+	if writes := inner.takeWrites(); len(writes) != 0 {
+		t.Fatalf("partial piece was written: %v", writes)
+	}
+
+	p.WriteAt(chunk(16), 16)
+	want := []recordedWrite{{0, 0, 64}}
+	if writes := inner.takeWrites(); !reflect.DeepEqual(writes, want) {
+		t.Errorf("complete piece written as %v, want %v", writes, want)
+	}
+
+	got := make([]byte, 64)
+	if _, err := p.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if wantData := bytes.Join([][]byte{chunk(0), chunk(16), chunk(32), chunk(48)}, nil); !bytes.Equal(got, wantData) {
+		t.Errorf("read %v, want %v", got, wantData)
+	}
+}
+
+func TestBatchedStorageFlushes(t *testing.T) {
+	s, inner, impl := openBatched(t, 1<<20)
+	p := piece(impl, 0)
+
+	// Reads see buffered data.
+	p.WriteAt(chunk(1), 0)
+	p.WriteAt(chunk(2), 32)
+	got := make([]byte, 16)
+	if _, err := p.ReadAt(got, 32); err != nil || !bytes.Equal(got, chunk(2)) {
+		t.Errorf("ReadAt = %v, %v, want the buffered chunk", got, err)
+	}
+	// Runs that aren't contiguous take a write each.
+	want := []recordedWrite{{0, 0, 16}, {0, 32, 16}}
+	if writes := inner.takeWrites(); !reflect.DeepEqual(writes, want) {
+		t.Errorf("ReadAt flushed %v, want %v", writes, want)
+	}
+
+	p.WriteAt(chunk(3), 16)
+	if err := p.MarkComplete(); err != nil {
+		t.Fatal(err)
+	}
+	if writes := inner.takeWrites(); len(writes) != 1 {
+		t.Errorf("MarkComplete flushed %v, want one write", writes)
+	}
+
+	piece(impl, 1).WriteAt(chunk(4), 0)
+	if err := impl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if writes := inner.takeWrites(); !reflect.DeepEqual(writes, []recordedWrite{{1, 0, 16}}) {
+		t.Errorf("Flush wrote %v", writes)
+	}
+
+	piece(impl, 1).WriteAt(chunk(5), 16)
+	s.Close()
+	if writes := inner.takeWrites(); !reflect.DeepEqual(writes, []recordedWrite{{1, 16, 16}}) {
+		t.Errorf("Close wrote %v", writes)
+	}
+}
+
+func TestBatchedStorageRewrite(t *testing.T) {
+	_, inner, impl := openBatched(t, 1<<20)
+	p := piece(impl, 0)
+
+	// A rewrite lands after the data it replaces.
+	p.WriteAt(chunk(1), 0)
+	p.WriteAt(chunk(2), 0)
+	if writes := inner.takeWrites(); !reflect.DeepEqual(writes, []recordedWrite{{0, 0, 16}}) {
+		t.Errorf("rewrite flushed %v, want the first chunk", writes)
+	}
+	got := make([]byte, 16)
+	p.ReadAt(got, 0)
+	if !bytes.Equal(got, chunk(2)) {
+		t.Errorf("read %v after a rewrite, want the new data", got)
+	}
+}
+
+func TestBatchedStorageMaxBuffered(t *testing.T) {
+	_, inner, impl := openBatched(t, 24)
+
+	piece(impl, 0).WriteAt(chunk(1), 0)
+	if writes := inner.takeWrites(); len(writes) != 0 {
+		t.Fatalf("wrote %v under the limit", writes)
+	}
+	piece(impl, 1).WriteAt(chunk(2), 0)
+	if writes := inner.takeWrites(); len(writes) != 2 {
+		t.Errorf("wrote %v over the limit, want every pending piece", writes)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/anacrolix/torrent"
+)
+
+const (
+	// Batch bodies larger than this are rejected.
+	maxBatchSize = 1 << 20
+	// How many items of a batch are resolved and added at the same time.
+	batchWorkers = 8
+)
+
+type BatchResult struct {
+	ID       string
+	InfoHash string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+// HandlePostBatch adds every magnet link, URL or infohash in a JSON array
+// without waiting for their metadata, reporting the outcome per item in the
+// same order. The add-time options in the query apply to all of them.
+func HandlePostBatch(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ids []string
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchSize)).Decode(&ids); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		opts, err := parseAddOptions(config, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		u := UserFromContext(r.Context())
+		if !checkCanAdd(c, svc, w, u) {
+			return
+		}
+
+		results := make([]BatchResult, len(ids))
+		sem := make(chan struct{}, batchWorkers)
+		var wg sync.WaitGroup
+		for i, id := range ids {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				results[i] = BatchResult{ID: id}
+				t, err := addBatchItem(c, config, svc, id, opts)
+				if err != nil {
+					log.Printf("error adding torrent: %v", err)
+					results[i].Error = err.Error()
+					return
+				}
+				finishAddAsync(t, config, svc, u, opts.settings)
+				results[i].InfoHash = t.InfoHash().String()
+			}()
+		}
+		wg.Wait()
+
+		parsed, err := json.Marshal(results)
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		w.Write(parsed)
+	})
+}
+
+func addBatchItem(c *torrent.Client, config *ClientConfig, svc *Services, id string, opts addOptions) (*torrent.Torrent, error) {
+	spec, err := ParseTorrentSpec(id)
+	if err != nil {
+		return nil, err
+	}
+	t, _, err := addSpec(c, config, svc, id, spec, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error adding torrent: %w", err)
+	}
+	return t, nil
+}
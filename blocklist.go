@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/iplist"
+)
+
+// Blocklist is an iplist.Ranger whose contents can be replaced while the
+// client is running. It is downloaded from config.BlocklistURL and refreshed
+// every config.BlocklistInterval, using the ETag to skip unchanged lists.
+type Blocklist struct {
+	mu     sync.RWMutex
+	list   *iplist.IPList
+	etag   string
+	status BlocklistStatus
+
+	config *ClientConfig
+	meta   *MetadataStore
+}
+
+type BlocklistStatus struct {
+	URL        string
+	Ranges     int
+	LastCheck  time.Time
+	LastUpdate time.Time
+	LastError  string
+}
+
+type savedBlocklist struct {
+	ETag       string
+	LastUpdate time.Time
+}
+
+const blocklistKey = "blocklist"
+
+// LoadBlocklist returns nil when no blocklist is configured. Otherwise the
+// copy saved by the last successful update is loaded so peers are filtered
+// before the first download finishes.
+func LoadBlocklist(config *ClientConfig, meta *MetadataStore) *Blocklist {
+	if config.BlocklistURL == "" {
+		return nil
+	}
+
+	b := &Blocklist{config: config, meta: meta}
+	b.status.URL = config.BlocklistURL
+
+	var saved savedBlocklist
+	if _, err := meta.Get(blocklistKey, &saved); err != nil {
+		log.Printf("error loading blocklist state: %v", err)
+		return b
+	}
+	data, err := os.ReadFile(b.path())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("error reading saved blocklist: %v", err)
+		}
+		return b
+	}
+	list, err := parseBlocklist(data)
+	if err != nil {
+		log.Printf("error parsing saved blocklist: %v", err)
+		return b
+	}
+
+	b.list = list
+	b.etag = saved.ETag
+	b.status.Ranges = list.NumRanges()
+	b.status.LastUpdate = saved.LastUpdate
+	return b
+}
+
+func (b *Blocklist) path() string {
+	return filepath.Join(b.config.DownloadDir, "blocklist")
+}
+
+func (b *Blocklist) Lookup(ip net.IP) (iplist.Range, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.list.Lookup(ip)
+}
+
+func (b *Blocklist) NumRanges() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.list.NumRanges()
+}
+
+func (b *Blocklist) Status() *BlocklistStatus {
+	if b == nil {
+		return nil
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	status := b.status
+	return &status
+}
+
+// Run updates the blocklist now and then every BlocklistInterval until ctx is
+// done.
+func (b *Blocklist) Run(ctx context.Context) {
+	for {
+		if err := b.Update(ctx); err != nil {
+			log.Print(err)
+		}
+		if b.config.BlocklistInterval <= 0 {
+			return
+		}
+
+		select {
+		case <-time.After(b.config.BlocklistInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *Blocklist) Update(ctx context.Context) error {
+	list, etag, err := b.fetch(ctx)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status.LastCheck = time.Now()
+	b.status.LastError = ""
+	if err != nil {
+		b.status.LastError = err.Error()
+		return err
+	}
+	if list == nil {
+		return nil
+	}
+
+	b.list = list
+	b.etag = etag
+	b.status.Ranges = list.NumRanges()
+	b.status.LastUpdate = b.status.LastCheck
+	log.Printf("Loaded blocklist with %d ranges", b.status.Ranges)
+	return b.meta.Put(blocklistKey, savedBlocklist{ETag: etag, LastUpdate: b.status.LastUpdate})
+}
+
+// fetch downloads and parses the blocklist, returning a nil list if it hasn't
+// changed since the last update.
+func (b *Blocklist) fetch(ctx context.Context) (*iplist.IPList, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.config.BlocklistURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating blocklist request: %w", err)
+	}
+	b.mu.RLock()
+	if b.etag != "" {
+		req.Header.Set("If-None-Match", b.etag)
+	}
+	b.mu.RUnlock()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("error downloading blocklist: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, "", nil
+	default:
+		return nil, "", fmt.Errorf("error downloading blocklist: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("error downloading blocklist: %w", err)
+	}
+	list, err := parseBlocklist(data)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := os.WriteFile(b.path(), data, 0o666); err != nil {
+		return nil, "", fmt.Errorf("error saving blocklist: %w", err)
+	}
+	return list, resp.Header.Get("ETag"), nil
+}
+
+// parseBlocklist reads a P2P plaintext blocklist, optionally gzipped. Unlike
+// iplist.NewFromReader the ranges are sorted, as published lists often
+// aren't.
+func parseBlocklist(data []byte) (*iplist.IPList, error) {
+	var r io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing blocklist: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var ranges []iplist.Range
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		rng, ok, err := iplist.ParseBlocklistP2PLine(scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("error parsing blocklist line %d: %w", line, err)
+		}
+		if ok {
+			ranges = append(ranges, rng)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading blocklist: %w", err)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].First, ranges[j].First) < 0
+	})
+	return iplist.New(ranges), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+)
+
+// Directory index pages in the plain style of web server listings, which is
+// what Kodi's "add network source" HTTP browsing understands.
+var browseTemplate = template.Must(template.New("browse").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<ul>
+{{- if ne .Path "/browse/"}}
+<li><a href="../{{.Query}}">../</a></li>
+{{- end}}
+{{- range .Entries}}
+<li><a href="{{.Href}}">{{.Name}}</a></li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+type BrowseEntry struct {
+	Name   string
+	Href   string
+	Length int64 `json:",omitempty"`
+}
+
+type browsePage struct {
+	Path    string
+	Query   string
+	Entries []BrowseEntry
+}
+
+// tokenQuery carries the caller's token into links so clients that can't set
+// headers keep working while browsing.
+func tokenQuery(u *User) string {
+	if u == nil {
+		return ""
+	}
+	return "?token=" + url.QueryEscape(u.Token)
+}
+
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+func writeBrowsePage(w http.ResponseWriter, r *http.Request, page browsePage) {
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page.Entries)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := browseTemplate.Execute(w, page); err != nil {
+		log.Printf("error rendering directory index: %v", err)
+	}
+}
+
+func HandleBrowseTorrents(c *torrent.Client, users *UserStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := UserFromContext(r.Context())
+		query := tokenQuery(u)
+
+		entries := make([]BrowseEntry, 0, len(c.Torrents()))
+		for _, t := range c.Torrents() {
+			ih := t.InfoHash().String()
+			if t.Info() == nil || !users.CanAccess(u, ih) {
+				continue
+			}
+			entries = append(entries, BrowseEntry{
+				Name:   t.Name() + "/",
+				Href:   ih + "/" + query,
+				Length: t.Length(),
+			})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name < entries[j].Name
+		})
+
+		writeBrowsePage(w, r, browsePage{Path: "/browse/", Query: query, Entries: entries})
+	})
+}
+
+func HandleBrowseTorrent(c *torrent.Client, users *UserStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ih, ok := ParseInfoHashParam(w, r)
+		if !ok {
+			return
+		}
+
+		u := UserFromContext(r.Context())
+		t, ok := c.Torrent(ih)
+		if !ok || t.Info() == nil || !users.CanAccess(u, ih.String()) {
+			http.Error(w, "Torrent not found", http.StatusNotFound)
+			return
+		}
+
+		query := tokenQuery(u)
+		entries := make([]BrowseEntry, 0, len(t.Files()))
+		for _, f := range t.Files() {
+			entries = append(entries, BrowseEntry{
+				Name:   f.DisplayPath(),
+				Href:   "/torrents/" + ih.String() + "/" + escapePath(f.DisplayPath()) + query,
+				Length: f.Length(),
+			})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name < entries[j].Name
+		})
+
+		writeBrowsePage(w, r, browsePage{Path: "/browse/" + ih.String() + "/", Query: query, Entries: entries})
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/storage"
+)
+
+const cacheTouchInterval = 30 * time.Second
+
+// RunCacheProtector keeps the pieces inside every stream's priority window
+// recently used in the piece cache. The cache evicts the least recently used
+// pieces once MaxCacheSize is reached, so this makes it drop pieces far from
+// any reader first, rather than ones downloaded long ago that are about to be
+// played.
+func RunCacheProtector(ctx context.Context, db storage.ClientImpl, priorities *PriorityManager) {
+	ticker := time.NewTicker(cacheTouchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for t, ranges := range priorities.Windows() {
+				if err := touchPieces(ctx, db, t, ranges); err != nil {
+					log.Printf("error protecting cached pieces of %s: %v", t.Name(), err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// touchPieces reads a byte of each complete piece in ranges, which counts as
+// a use of the piece for the cache.
+func touchPieces(ctx context.Context, db storage.ClientImpl, t *torrent.Torrent, ranges []pieceRange) error {
+	info := t.Info()
+	if info == nil {
+		return nil
+	}
+	impl, err := db.OpenTorrent(ctx, info, t.InfoHash())
+	if err != nil {
+		return err
+	}
+	if impl.Close != nil {
+		defer impl.Close()
+	}
+	st := storage.Torrent{TorrentImpl: impl}
+
+	var b [1]byte
+	done := make(map[int]bool)
+	for _, pr := range ranges {
+		for i := pr.first; i < pr.end && i < t.NumPieces(); i++ {
+			if done[i] || !t.Piece(i).State().Complete {
+				continue
+			}
+			done[i] = true
+			if _, err := st.Piece(info.Piece(i)).ReadAt(b[:], 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// databaseSize returns the bytes the piece cache database takes on disk,
+// including its write-ahead log.
+func databaseSize(config *ClientConfig) int64 {
+	var size int64
+	path := createDBOptions(config).Path
+	for _, name := range []string{path, path + "-wal"} {
+		if fi, err := os.Stat(name); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+type StorageUsage struct {
+	MaxCacheSize  int64 // 0 is unlimited
+	DatabaseBytes int64
+	CachedBytes   int64 // completed bytes of the loaded torrents in the cache
+	Disk          DiskUsage
+	Torrents      []TorrentStorage
+}
+
+// DiskUsage describes the DownloadDir volume.
+type DiskUsage struct {
+	Free         uint64
+	Used         uint64
+	Total        uint64
+	MinFreeSpace int64 // 0 is unchecked
+	Low          bool  // downloads are paused for lack of space
+}
+
+type TorrentStorage struct {
+	InfoHash       string
+	Name           string
+	Storage        string
+	BytesCompleted int64
+}
+
+// HandleGetStorage reports how much of the piece cache is in use, and by
+// which torrents.
+func HandleGetStorage(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := UserFromContext(r.Context())
+		usage := StorageUsage{
+			MaxCacheSize:  config.MaxCacheSize,
+			DatabaseBytes: databaseSize(config),
+			Torrents:      []TorrentStorage{},
+		}
+		free, total, err := diskSpace(config.DownloadDir)
+		if err != nil {
+			log.Printf("error checking disk space: %v", err)
+		}
+		usage.Disk = DiskUsage{
+			Free:         free,
+			Used:         total - min(free, total),
+			Total:        total,
+			MinFreeSpace: config.MinFreeSpace,
+			Low:          svc.Disk.Low(),
+		}
+		for _, t := range c.Torrents() {
+			ih := t.InfoHash().String()
+			backend := svc.Settings.Get(ih).Storage
+			if backend == "" {
+				backend = config.StorageBackend
+			}
+			if backend == storageSqlite {
+				usage.CachedBytes += t.BytesCompleted()
+			}
+			if !svc.Users.CanAccess(u, ih) {
+				continue
+			}
+			usage.Torrents = append(usage.Torrents, TorrentStorage{
+				InfoHash:       ih,
+				Name:           t.Name(),
+				Storage:        backend,
+				BytesCompleted: t.BytesCompleted(),
+			})
+		}
+
+		parsed, err := json.Marshal(usage)
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(parsed)
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+const (
+	defaultCheckTimeout = 20 * time.Second
+	maxCheckTimeout     = 2 * time.Minute
+
+	// How long to keep collecting peers once the metadata arrived.
+	checkSettleTime = 5 * time.Second
+)
+
+// CheckResult estimates whether a torrent can be streamed. The counts are a
+// snapshot taken at the end of the probe.
+type CheckResult struct {
+	InfoHash       string
+	Name           string
+	HasMetadata    bool
+	Peers          int
+	ActivePeers    int
+	Seeders        int
+	LikelyPlayable bool
+}
+
+// HandlePostCheck probes the swarm for the torrent in the request body the
+// same way POST /torrents would add it, but nothing is downloaded and the
+// torrent is dropped again afterwards unless it was already in the client.
+// ?timeout= bounds how long to wait for metadata.
+func HandlePostCheck(c *torrent.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("error reading request body: %v", err)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		timeout := defaultCheckTimeout
+		if v := r.URL.Query().Get("timeout"); v != "" {
+			if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+				http.Error(w, "Invalid timeout parameter", http.StatusBadRequest)
+				return
+			}
+			timeout = min(timeout, maxCheckTimeout)
+		}
+
+		spec, err := ParseTorrentSpec(string(body))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error checking torrent: %v", err), http.StatusBadRequest)
+			return
+		}
+		t, isNew, err := c.AddTorrentSpec(spec)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error checking torrent: %v", err), http.StatusBadRequest)
+			return
+		}
+		if isNew {
+			t.DisallowDataDownload()
+			defer t.Drop()
+		}
+
+		deadline := time.NewTimer(timeout)
+		defer deadline.Stop()
+		select {
+		case <-t.GotInfo():
+			select {
+			case <-time.After(checkSettleTime):
+			case <-deadline.C:
+			case <-r.Context().Done():
+				return
+			}
+		case <-deadline.C:
+		case <-r.Context().Done():
+			return
+		}
+
+		stats := t.Stats()
+		result := CheckResult{
+			InfoHash:    t.InfoHash().String(),
+			Name:        t.Name(),
+			HasMetadata: t.Info() != nil,
+			Peers:       stats.TotalPeers,
+			ActivePeers: stats.ActivePeers,
+			Seeders:     stats.ConnectedSeeders,
+		}
+		result.LikelyPlayable = result.HasMetadata && (result.Seeders > 0 || t.Complete().Bool())
+
+		parsed, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		w.Write(parsed)
+	})
+}
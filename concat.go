@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+// ConcatReader presents several torrent files, or byte ranges of them, as one
+// continuous stream. Only the reader for the segment under the current
+// position is kept open, so seeking doesn't prioritize the start of every
+// segment.
+type ConcatReader struct {
+	ctx      context.Context
+	config   *ClientConfig
+	settings TorrentSettings
+	segments []fileSegment
+	offsets  []int64
+	size     int64
+	pos      int64
+
+	mu     sync.Mutex // guards cur and reader against Reconfigure
+	cur    int
+	reader torrent.Reader
+}
+
+// fileSegment is length bytes of file starting at offset. Readers for it are
+// configured as if streaming name.
+type fileSegment struct {
+	file   *torrent.File
+	offset int64
+	length int64
+	name   string
+}
+
+func NewConcatReader(ctx context.Context, config *ClientConfig, settings TorrentSettings, files []*torrent.File) *ConcatReader {
+	segments := make([]fileSegment, 0, len(files))
+	for _, f := range files {
+		segments = append(segments, fileSegment{file: f, length: f.Length(), name: f.DisplayPath()})
+	}
+	return newSegmentReader(ctx, config, settings, segments)
+}
+
+func newSegmentReader(ctx context.Context, config *ClientConfig, settings TorrentSettings, segments []fileSegment) *ConcatReader {
+	cr := &ConcatReader{ctx: ctx, config: config, settings: settings, segments: segments, cur: -1}
+	for _, s := range segments {
+		cr.offsets = append(cr.offsets, cr.size)
+		cr.size += s.length
+	}
+	return cr
+}
+
+func (cr *ConcatReader) Read(b []byte) (int, error) {
+	if cr.pos >= cr.size {
+		return 0, io.EOF
+	}
+
+	// Last segment starting at or before pos, skipping empty segments.
+	i := sort.Search(len(cr.segments), func(i int) bool {
+		return cr.offsets[i]+cr.segments[i].length > cr.pos
+	})
+	seg := cr.segments[i]
+	if i != cr.cur {
+		cr.mu.Lock()
+		cr.closeReader()
+		cr.reader = seg.file.NewReader()
+		ConfigureReader(cr.reader, cr.config, cr.settings, seg.name)
+		cr.cur = i
+		cr.mu.Unlock()
+		if _, err := cr.reader.Seek(seg.offset+cr.pos-cr.offsets[i], io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+
+	remaining := cr.offsets[i] + seg.length - cr.pos
+	if int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+	n, err := cr.reader.ReadContext(cr.ctx, b)
+	cr.pos += int64(n)
+	if errors.Is(err, io.EOF) && cr.pos < cr.size {
+		err = nil
+	}
+	return n, err
+}
+
+func (cr *ConcatReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cr.pos
+	case io.SeekEnd:
+		offset += cr.size
+	default:
+		return cr.pos, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return cr.pos, errors.New("negative position")
+	}
+
+	cr.pos = offset
+	if cr.cur >= 0 {
+		seg, start := cr.segments[cr.cur], cr.offsets[cr.cur]
+		if offset >= start && offset < start+seg.length {
+			if _, err := cr.reader.Seek(seg.offset+offset-start, io.SeekStart); err != nil {
+				return cr.pos, err
+			}
+		} else {
+			cr.mu.Lock()
+			cr.closeReader()
+			cr.mu.Unlock()
+		}
+	}
+	return cr.pos, nil
+}
+
+func (cr *ConcatReader) closeReader() {
+	if cr.reader != nil {
+		cr.reader.Close()
+		cr.reader = nil
+	}
+	cr.cur = -1
+}
+
+// Reconfigure reapplies the streaming options to the current segment's reader.
+func (cr *ConcatReader) Reconfigure() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.reader != nil {
+		ConfigureReader(cr.reader, cr.config, cr.settings, cr.segments[cr.cur].name)
+	}
+}
+
+func (cr *ConcatReader) Close() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.closeReader()
+	return nil
+}
+
+// HandleGetConcat serves the files given by repeated ?file= parameters (all
+// files in torrent order when none are given) as a single byte stream with
+// normal Range support.
+func HandleGetConcat(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ih, ok := ParseInfoHashParam(w, r)
+		if !ok {
+			return
+		}
+
+		t, ok := c.Torrent(ih)
+		u := UserFromContext(r.Context())
+		if !ok || !svc.Users.CanAccess(u, ih.String()) {
+			http.Error(w, "Torrent not found", http.StatusNotFound)
+			return
+		}
+		if !awaitInfo(w, r, t, config) {
+			return
+		}
+
+		byPath := make(map[string]*torrent.File, len(t.Files()))
+		for _, f := range t.Files() {
+			byPath[f.DisplayPath()] = f
+		}
+
+		files := t.Files()
+		if names := r.URL.Query()["file"]; len(names) > 0 {
+			files = make([]*torrent.File, 0, len(names))
+			for _, name := range names {
+				f, ok := byPath[name]
+				if !ok {
+					http.Error(w, "File not found: "+name, http.StatusNotFound)
+					return
+				}
+				files = append(files, f)
+			}
+		}
+		if len(files) == 0 {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		if err := svc.Users.CheckStorageQuota(c, u); err != nil && t.BytesMissing() > 0 {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		tw, err := svc.Users.ThrottleWriter(r.Context(), w, u)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+
+		reader := NewConcatReader(r.Context(), config, svc.Settings.Get(ih.String()), files)
+		defer reader.Close()
+		defer svc.Streams.Start(ih.String(), reader.Reconfigure)()
+
+		var length int64
+		paths := make([]string, 0, len(files))
+		for _, f := range files {
+			length += f.Length()
+			paths = append(paths, f.DisplayPath())
+		}
+		setStreamCacheHeaders(w, u, ih.String(), length, paths...)
+		http.ServeContent(tw, r, files[0].DisplayPath(), time.Unix(t.Metainfo().CreationDate, 0), reader)
+	})
+}
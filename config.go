@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/anacrolix/torrent"
+)
+
+const redacted = "REDACTED"
+
+// configMu guards the ClientConfig fields that PATCH /config changes at
+// runtime.
+var configMu sync.RWMutex
+
+// Redacted returns a copy of config with every non-empty string field tagged
+// `secret:"true"` replaced by a placeholder.
+func (config ClientConfig) Redacted() ClientConfig {
+	v := reflect.ValueOf(&config).Elem()
+	for i := range v.NumField() {
+		f := v.Field(i)
+		if v.Type().Field(i).Tag.Get("secret") == "true" && f.Kind() == reflect.String && f.String() != "" {
+			f.SetString(redacted)
+		}
+	}
+	return config
+}
+
+func HandleGetConfig(config *ClientConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		configMu.RLock()
+		parsed, err := json.Marshal(config.Redacted())
+		configMu.RUnlock()
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(parsed)
+	})
+}
+
+// ConfigUpdate lists the settings that can be changed without a restart.
+type ConfigUpdate struct {
+	MaxConnsPerTorrent *int
+	MaxDownloadRate    *int64
+	MaxUploadRate      *int64
+	RateSchedule       *[]ScheduleRule
+	Readahead          *int64
+	Responsive         *bool
+}
+
+// ApplyConnLimit sets the torrent's connection limit from the configuration.
+// The client's own default is fixed at startup, so torrents added after a
+// PATCH /config need this to pick up the new limit.
+func ApplyConnLimit(t *torrent.Torrent, config *ClientConfig) {
+	configMu.RLock()
+	n := config.MaxConnsPerTorrent
+	configMu.RUnlock()
+	t.SetMaxEstablishedConns(n)
+}
+
+func HandlePatchConfig(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var update ConfigUpdate
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&update); err != nil {
+			http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if update.MaxConnsPerTorrent != nil && *update.MaxConnsPerTorrent <= 0 {
+			http.Error(w, "MaxConnsPerTorrent must be positive", http.StatusBadRequest)
+			return
+		}
+		if update.RateSchedule != nil {
+			if err := ValidateRateSchedule(*update.RateSchedule); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		configMu.Lock()
+		if update.MaxDownloadRate != nil || update.MaxUploadRate != nil {
+			if update.MaxDownloadRate != nil {
+				config.MaxDownloadRate = *update.MaxDownloadRate
+			}
+			if update.MaxUploadRate != nil {
+				config.MaxUploadRate = *update.MaxUploadRate
+			}
+			log.Printf("Rate limits changed: download %d B/s, upload %d B/s", config.MaxDownloadRate, config.MaxUploadRate)
+		}
+		if update.RateSchedule != nil {
+			config.RateSchedule = *update.RateSchedule
+			log.Printf("Rate schedule changed: %d rules", len(config.RateSchedule))
+		}
+		if update.MaxConnsPerTorrent != nil {
+			config.MaxConnsPerTorrent = *update.MaxConnsPerTorrent
+			for _, t := range c.Torrents() {
+				t.SetMaxEstablishedConns(config.MaxConnsPerTorrent)
+			}
+			log.Printf("Connection limit changed: %d per torrent", config.MaxConnsPerTorrent)
+		}
+		if update.Readahead != nil {
+			config.Readahead = *update.Readahead
+		}
+		if update.Responsive != nil {
+			config.Responsive = *update.Responsive
+		}
+		configMu.Unlock()
+
+		// A scheduled limit may take precedence over the new ones.
+		if update.MaxDownloadRate != nil || update.MaxUploadRate != nil || update.RateSchedule != nil {
+			svc.Scheduler.Apply()
+		}
+
+		// Open streams pick up the new reader options right away.
+		if update.Readahead != nil || update.Responsive != nil {
+			svc.Streams.Reconfigure()
+		}
+
+		HandleGetConfig(config).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const configEnvPrefix = "GO_TORRENT_MPV_"
+
+// defaultConfigPath is config.toml in the user's configuration directory,
+// e.g. %AppData%\go_torrent_mpv on Windows or ~/.config/go_torrent_mpv
+// elsewhere.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "go_torrent_mpv", "config.toml")
+}
+
+// ApplyConfigSources fills in the flags that weren't given on the command
+// line, first from GO_TORRENT_MPV_<FLAG> environment variables, then from
+// the config file. A missing file is only an error if its path was given
+// explicitly.
+func ApplyConfigSources(fs *flag.FlagSet, path string) error {
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath()
+	}
+
+	values := map[string]string{}
+	if path != "" {
+		var err error
+		values, err = readConfigFile(path)
+		if errors.Is(err, os.ErrNotExist) && !explicit {
+			values = map[string]string{}
+		} else if err != nil {
+			return err
+		}
+	}
+	for key := range values {
+		if fs.Lookup(key) == nil {
+			return fmt.Errorf("unknown option %q in %s", key, path)
+		}
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] {
+			return
+		}
+		if v, ok := os.LookupEnv(configEnvPrefix + strings.ToUpper(f.Name)); ok {
+			if err := fs.Set(f.Name, v); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s%s: %w", configEnvPrefix, strings.ToUpper(f.Name), err))
+			}
+			return
+		}
+		if v, ok := values[f.Name]; ok {
+			if err := fs.Set(f.Name, v); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s in %s: %w", f.Name, path, err))
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// readConfigFile parses the flat subset of TOML the options need: one
+// `Name = value` per line with the option names of the command line flags,
+// strings in double quotes and # comments. Tables are not supported.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config file: %w", err)
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected Name = value", path, n)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			// Everything after the closing quote may only be a comment.
+			end := closingQuote(value)
+			if end < 0 {
+				return nil, fmt.Errorf("%s:%d: unterminated string", path, n)
+			}
+			if rest := strings.TrimSpace(value[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, fmt.Errorf("%s:%d: unexpected %q after string", path, n, rest)
+			}
+			if value, err = strconv.Unquote(value[:end+1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid string: %w", path, n, err)
+			}
+		} else {
+			value, _, _ = strings.Cut(value, "#")
+			value = strings.ReplaceAll(strings.TrimSpace(value), "_", "")
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	return values, nil
+}
+
+// closingQuote returns the index of the quote ending the string that s
+// starts with, or -1.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `# go_torrent_mpv options
+
+DownloadDir = "C:\\Torrents # not a comment"  # a comment
+Port = 6_969
+ResumeTorrents = true # trailing comment
+Empty = ""
+  Indented   =   "spaces"
+`)
+	values, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"DownloadDir":    `C:\Torrents # not a comment`,
+		"Port":           "6969",
+		"ResumeTorrents": "true",
+		"Empty":          "",
+		"Indented":       "spaces",
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("readConfigFile = %q, want %q", values, want)
+	}
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"missing equals":      "Port 6969\n",
+		"unterminated string": `DownloadDir = "C:\Torrents` + "\n",
+		"text after string":   `DownloadDir = "a" b` + "\n",
+		"invalid escape":      `DownloadDir = "\q"` + "\n",
+	} {
+		if _, err := readConfigFile(writeConfigFile(t, content)); err == nil {
+			t.Errorf("readConfigFile with a %s succeeded", name)
+		}
+	}
+	if _, err := readConfigFile(filepath.Join(t.TempDir(), "missing.toml")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("readConfigFile of a missing file = %v, want a not exist error", err)
+	}
+}
+
+func newTestFlagSet() (*flag.FlagSet, *int, *string) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	port := fs.Int("Port", 6969, "")
+	dir := fs.String("DownloadDir", "default", "")
+	return fs, port, dir
+}
+
+func TestApplyConfigSources(t *testing.T) {
+	path := writeConfigFile(t, "Port = 1000\nDownloadDir = \"file\"\n")
+
+	// The command line wins over the environment, which wins over the file.
+	fs, port, dir := newTestFlagSet()
+	if err := fs.Parse([]string{"-Port", "2000"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(configEnvPrefix+"PORT", "3000")
+	t.Setenv(configEnvPrefix+"DOWNLOADDIR", "env")
+	if err := ApplyConfigSources(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if *port != 2000 || *dir != "env" {
+		t.Errorf("Port, DownloadDir = %d, %q, want 2000, \"env\"", *port, *dir)
+	}
+
+	os.Unsetenv(configEnvPrefix + "DOWNLOADDIR")
+	fs, port, dir = newTestFlagSet()
+	if err := ApplyConfigSources(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if *port != 3000 || *dir != "file" {
+		t.Errorf("Port, DownloadDir = %d, %q, want 3000, \"file\"", *port, *dir)
+	}
+}
+
+func TestApplyConfigSourcesErrors(t *testing.T) {
+	fs, _, _ := newTestFlagSet()
+	if err := ApplyConfigSources(fs, writeConfigFile(t, "Unknown = 1\n")); err == nil {
+		t.Error("an unknown option was accepted")
+	}
+	fs, _, _ = newTestFlagSet()
+	if err := ApplyConfigSources(fs, writeConfigFile(t, "Port = many\n")); err == nil {
+		t.Error("an invalid value was accepted")
+	}
+	fs, _, _ = newTestFlagSet()
+	if err := ApplyConfigSources(fs, filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Error("a missing config file given explicitly was accepted")
+	}
+}
@@ -0,0 +1,261 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: control.proto
+
+// The gRPC control API served on GRPCPort. The Go code is generated with
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//	  --go-grpc_out=. --go-grpc_opt=paths=source_relative control.proto
+
+package main
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Control_AddTorrent_FullMethodName   = "/gotorrentmpv.Control/AddTorrent"
+	Control_ListTorrents_FullMethodName = "/gotorrentmpv.Control/ListTorrents"
+	Control_StreamEvents_FullMethodName = "/gotorrentmpv.Control/StreamEvents"
+	Control_DropTorrent_FullMethodName  = "/gotorrentmpv.Control/DropTorrent"
+)
+
+// ControlClient is the client API for Control service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ControlClient interface {
+	// AddTorrent adds a torrent and, unless async is set, returns once its
+	// metadata is known.
+	AddTorrent(ctx context.Context, in *AddTorrentRequest, opts ...grpc.CallOption) (*Torrent, error)
+	ListTorrents(ctx context.Context, in *ListTorrentsRequest, opts ...grpc.CallOption) (*ListTorrentsResponse, error)
+	// StreamEvents sends an ADDED event for every current torrent, then one
+	// whenever a torrent is added, changes state or is dropped.
+	StreamEvents(ctx context.Context, in *StreamEventsRequest, opts ...grpc.CallOption) (Control_StreamEventsClient, error)
+	DropTorrent(ctx context.Context, in *DropTorrentRequest, opts ...grpc.CallOption) (*DropTorrentResponse, error)
+}
+
+type controlClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewControlClient(cc grpc.ClientConnInterface) ControlClient {
+	return &controlClient{cc}
+}
+
+func (c *controlClient) AddTorrent(ctx context.Context, in *AddTorrentRequest, opts ...grpc.CallOption) (*Torrent, error) {
+	out := new(Torrent)
+	err := c.cc.Invoke(ctx, Control_AddTorrent_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) ListTorrents(ctx context.Context, in *ListTorrentsRequest, opts ...grpc.CallOption) (*ListTorrentsResponse, error) {
+	out := new(ListTorrentsResponse)
+	err := c.cc.Invoke(ctx, Control_ListTorrents_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) StreamEvents(ctx context.Context, in *StreamEventsRequest, opts ...grpc.CallOption) (Control_StreamEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Control_ServiceDesc.Streams[0], Control_StreamEvents_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &controlStreamEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Control_StreamEventsClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type controlStreamEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *controlStreamEventsClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *controlClient) DropTorrent(ctx context.Context, in *DropTorrentRequest, opts ...grpc.CallOption) (*DropTorrentResponse, error) {
+	out := new(DropTorrentResponse)
+	err := c.cc.Invoke(ctx, Control_DropTorrent_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ControlServer is the server API for Control service.
+// All implementations must embed UnimplementedControlServer
+// for forward compatibility
+type ControlServer interface {
+	// AddTorrent adds a torrent and, unless async is set, returns once its
+	// metadata is known.
+	AddTorrent(context.Context, *AddTorrentRequest) (*Torrent, error)
+	ListTorrents(context.Context, *ListTorrentsRequest) (*ListTorrentsResponse, error)
+	// StreamEvents sends an ADDED event for every current torrent, then one
+	// whenever a torrent is added, changes state or is dropped.
+	StreamEvents(*StreamEventsRequest, Control_StreamEventsServer) error
+	DropTorrent(context.Context, *DropTorrentRequest) (*DropTorrentResponse, error)
+	mustEmbedUnimplementedControlServer()
+}
+
+// UnimplementedControlServer must be embedded to have forward compatible implementations.
+type UnimplementedControlServer struct {
+}
+
+func (UnimplementedControlServer) AddTorrent(context.Context, *AddTorrentRequest) (*Torrent, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddTorrent not implemented")
+}
+func (UnimplementedControlServer) ListTorrents(context.Context, *ListTorrentsRequest) (*ListTorrentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListTorrents not implemented")
+}
+func (UnimplementedControlServer) StreamEvents(*StreamEventsRequest, Control_StreamEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamEvents not implemented")
+}
+func (UnimplementedControlServer) DropTorrent(context.Context, *DropTorrentRequest) (*DropTorrentResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DropTorrent not implemented")
+}
+func (UnimplementedControlServer) mustEmbedUnimplementedControlServer() {}
+
+// UnsafeControlServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ControlServer will
+// result in compilation errors.
+type UnsafeControlServer interface {
+	mustEmbedUnimplementedControlServer()
+}
+
+func RegisterControlServer(s grpc.ServiceRegistrar, srv ControlServer) {
+	s.RegisterService(&Control_ServiceDesc, srv)
+}
+
+func _Control_AddTorrent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddTorrentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).AddTorrent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_AddTorrent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).AddTorrent(ctx, req.(*AddTorrentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_ListTorrents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListTorrentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).ListTorrents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_ListTorrents_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).ListTorrents(ctx, req.(*ListTorrentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_StreamEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ControlServer).StreamEvents(m, &controlStreamEventsServer{stream})
+}
+
+type Control_StreamEventsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type controlStreamEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *controlStreamEventsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Control_DropTorrent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DropTorrentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).DropTorrent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_DropTorrent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).DropTorrent(ctx, req.(*DropTorrentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Control_ServiceDesc is the grpc.ServiceDesc for Control service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Control_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gotorrentmpv.Control",
+	HandlerType: (*ControlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AddTorrent",
+			Handler:    _Control_AddTorrent_Handler,
+		},
+		{
+			MethodName: "ListTorrents",
+			Handler:    _Control_ListTorrents_Handler,
+		},
+		{
+			MethodName: "DropTorrent",
+			Handler:    _Control_DropTorrent_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamEvents",
+			Handler:       _Control_StreamEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "control.proto",
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	corsAllowMethods = "GET, HEAD, POST, PATCH, DELETE"
+	corsMaxAge       = 10 * time.Minute
+)
+
+// Response headers a page may read besides the CORS safelisted ones, for
+// paging, seeking in streams and polling asynchronous adds.
+const corsExposeHeaders = "Accept-Ranges, Content-Length, Content-Range, ETag, Location, Retry-After, X-Total-Count"
+
+// CORS lets pages from the origins in CorsOrigins call the API. It answers
+// preflight OPTIONS requests itself, as routes are registered per method,
+// and sits outside the mux so they don't reach the token checks.
+func CORS(config *ClientConfig, next http.Handler) http.Handler {
+	if config.CorsOrigins == "" {
+		return next
+	}
+
+	var anyOrigin bool
+	allowed := make(map[string]bool)
+	for _, origin := range strings.Split(config.CorsOrigins, ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin == "*" {
+			anyOrigin = true
+		}
+		allowed[origin] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !anyOrigin && !allowed[origin] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Tokens are sent as a header or query parameter, never as
+		// cookies, so credentialed requests aren't allowed.
+		if anyOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
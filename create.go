@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+type CreateRequest struct {
+	Path        string // relative to CreateDir
+	PieceLength int64  // chosen from the total size when zero
+	Trackers    []string
+	Private     bool
+	Comment     string
+}
+
+type CreateResponse struct {
+	InfoHash string
+	Magnet   string
+	Metainfo []byte
+}
+
+// CreateTorrent hashes the files under req.Path in CreateDir into a new
+// torrent and starts seeding it straight from disk.
+func CreateTorrent(c *torrent.Client, config *ClientConfig, req CreateRequest) (*torrent.Torrent, *metainfo.MetaInfo, error) {
+	if config.CreateDir == "" {
+		return nil, nil, errors.New("CreateDir isn't set")
+	}
+	if req.Path == "" {
+		return nil, nil, errors.New("path is required")
+	}
+	root, err := resolveUnder(config.CreateDir, req.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mi, err := BuildMetainfo(root, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t, err := SeedLocal(c, mi, root, storage.NewMapPieceCompletion())
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, mi, nil
+}
+
+func BuildMetainfo(root string, req CreateRequest) (*metainfo.MetaInfo, error) {
+	info := metainfo.Info{PieceLength: req.PieceLength}
+	if req.Private {
+		info.Private = &req.Private
+	}
+	if err := info.BuildFromFilePath(root); err != nil {
+		return nil, fmt.Errorf("error building torrent info: %w", err)
+	}
+
+	mi := &metainfo.MetaInfo{
+		Comment:      req.Comment,
+		CreatedBy:    "go_torrent_mpv",
+		CreationDate: time.Now().Unix(),
+	}
+	for _, tracker := range req.Trackers {
+		mi.AnnounceList = append(mi.AnnounceList, []string{tracker})
+	}
+	if len(req.Trackers) > 0 {
+		mi.Announce = req.Trackers[0]
+	}
+
+	var err error
+	mi.InfoBytes, err = bencode.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding torrent info: %w", err)
+	}
+	return mi, nil
+}
+
+// SeedLocal adds mi to the client using the files at root as its storage
+// instead of the piece cache. The client hashes the pieces completion doesn't
+// know about when the torrent is added, and then starts seeding them.
+func SeedLocal(c *torrent.Client, mi *metainfo.MetaInfo, root string, completion storage.PieceCompletion) (*torrent.Torrent, error) {
+	spec, err := torrent.TorrentSpecFromMetaInfoErr(mi)
+	if err != nil {
+		return nil, fmt.Errorf("error creating torrent spec: %w", err)
+	}
+	spec.Storage = storage.NewFileOpts(storage.NewFileClientOpts{
+		ClientBaseDir:   filepath.Dir(root),
+		PieceCompletion: completion,
+	})
+
+	t, _, err := c.AddTorrentSpec(spec)
+	if err != nil {
+		return nil, fmt.Errorf("error adding local torrent: %w", err)
+	}
+	return t, nil
+}
+
+// HandleCreateTorrent serves POST /create. Only admins can use it, and only
+// when authentication is configured, as it reads files from disk and can
+// announce them to any tracker.
+func HandleCreateTorrent(c *torrent.Client, config *ClientConfig, users *UserStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req CreateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		t, mi, err := CreateTorrent(c, config, req)
+		if err != nil {
+			log.Printf("error creating torrent: %v", err)
+			http.Error(w, fmt.Sprintf("Error creating torrent: %v", err), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Created torrent: %s", t.Name())
+
+		if err := users.AddOwner(UserFromContext(r.Context()), t.InfoHash().String()); err != nil {
+			log.Print(err)
+		}
+
+		var buf bytes.Buffer
+		if err := mi.Write(&buf); err != nil {
+			log.Printf("error encoding torrent file: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		info := t.Info()
+		parsed, err := json.Marshal(CreateResponse{
+			InfoHash: t.InfoHash().String(),
+			Magnet:   mi.Magnet(nil, info).String(),
+			Metainfo: buf.Bytes(),
+		})
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		w.WriteHeader(http.StatusCreated)
+		w.Write(parsed)
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/krpc"
+	"github.com/anacrolix/torrent"
+)
+
+const dhtNodesInterval = 10 * time.Minute
+
+func dhtNodesPath(config *ClientConfig) string {
+	return filepath.Join(config.DownloadDir, "dht_nodes")
+}
+
+// DHTStartingNodes bootstraps each DHT server from the nodes saved by the
+// previous run, followed by DHTBootstrap or the default global routers.
+func DHTStartingNodes(config *ClientConfig) func(network string) dht.StartingNodesGetter {
+	return func(network string) dht.StartingNodesGetter {
+		return func() ([]dht.Addr, error) {
+			var addrs []dht.Addr
+			saved, err := dht.ReadNodesFromFile(dhtNodesPath(config))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("error reading saved DHT nodes: %v", err)
+			}
+			for _, ni := range saved {
+				if matchesNetwork(network, ni.Addr.IP) {
+					addrs = append(addrs, dht.NewAddr(ni.Addr.UDP()))
+				}
+			}
+
+			if config.DHTBootstrap == "" {
+				global, err := dht.GlobalBootstrapAddrs(network)
+				if err != nil && len(addrs) > 0 {
+					log.Printf("error resolving DHT bootstrap routers: %v", err)
+					return addrs, nil
+				}
+				return append(addrs, global...), err
+			}
+			for _, node := range strings.Split(config.DHTBootstrap, ",") {
+				addr, err := net.ResolveUDPAddr(network, strings.TrimSpace(node))
+				if err != nil {
+					log.Printf("error resolving DHT bootstrap node %s: %v", node, err)
+					continue
+				}
+				addrs = append(addrs, dht.NewAddr(addr))
+			}
+			return addrs, nil
+		}
+	}
+}
+
+// matchesNetwork reports whether ip can be reached over a "udp4", "udp6" or
+// "udp" socket.
+func matchesNetwork(network string, ip net.IP) bool {
+	switch network {
+	case "udp4":
+		return ip.To4() != nil
+	case "udp6":
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// SaveDHTNodes writes the routing tables of every DHT server to DownloadDir.
+// An empty table doesn't replace a previous save.
+func SaveDHTNodes(c *torrent.Client, config *ClientConfig) error {
+	var nodes []krpc.NodeInfo
+	for _, s := range c.DhtServers() {
+		if s, ok := s.(torrent.AnacrolixDhtServerWrapper); ok {
+			nodes = append(nodes, s.Nodes()...)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	if err := dht.WriteNodesToFile(nodes, dhtNodesPath(config)); err != nil {
+		return fmt.Errorf("error saving DHT nodes: %w", err)
+	}
+	return nil
+}
+
+// RunDHTNodesSaver periodically saves the DHT routing tables, so they
+// survive the server being killed.
+func RunDHTNodesSaver(ctx context.Context, c *torrent.Client, config *ClientConfig) {
+	ticker := time.NewTicker(dhtNodesInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := SaveDHTNodes(c, config); err != nil {
+				log.Print(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// DHTServerStats describes one DHT server (there is one per listen address
+// family). Stats holds the server's node table and query counters.
+type DHTServerStats struct {
+	Addr  string
+	ID    string
+	Stats any
+}
+
+type DHTNodeResult struct {
+	Node  string
+	Added []string `json:",omitempty"`
+	Error string   `json:",omitempty"`
+}
+
+func HandleGetDHT(c *torrent.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		servers := make([]DHTServerStats, 0, len(c.DhtServers()))
+		for _, s := range c.DhtServers() {
+			id := s.ID()
+			servers = append(servers, DHTServerStats{
+				Addr:  s.Addr().String(),
+				ID:    hex.EncodeToString(id[:]),
+				Stats: s.Stats(),
+			})
+		}
+
+		parsed, err := json.Marshal(servers)
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(parsed)
+	})
+}
+
+// HandleGetDHTTable dumps every DHT server's routing table as text.
+func HandleGetDHTTable(c *torrent.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, s := range c.DhtServers() {
+			s.WriteStatus(w)
+		}
+	})
+}
+
+// HandlePostDHTNodes feeds a JSON array of host:port entries to the DHT
+// servers, for bootstrapping where the default routers are unreachable.
+// Hostnames are resolved here since the DHT only takes IP addresses.
+func HandlePostDHTNodes(c *torrent.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(c.DhtServers()) == 0 {
+			http.Error(w, "DHT is disabled", http.StatusConflict)
+			return
+		}
+
+		var nodes []string
+		if err := json.NewDecoder(r.Body).Decode(&nodes); err != nil || len(nodes) == 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		results := make([]DHTNodeResult, 0, len(nodes))
+		for _, node := range nodes {
+			result := DHTNodeResult{Node: node}
+			addrs, err := resolveDHTNode(r, node)
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				c.AddDhtNodes(addrs)
+				result.Added = addrs
+			}
+			results = append(results, result)
+		}
+
+		parsed, err := json.Marshal(results)
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		w.Write(parsed)
+	})
+}
+
+func resolveDHTNode(r *http.Request, node string) ([]string, error) {
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+
+	if net.ParseIP(host) != nil {
+		return []string{node}, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(r.Context(), host)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %s: %w", host, err)
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.IP.String(), port))
+	}
+	return addrs, nil
+}
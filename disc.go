@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+)
+
+// Disc is a Blu-ray (BDMV) or DVD (VIDEO_TS) folder inside a torrent. Title
+// holds the files making up its main title, in playback order.
+type Disc struct {
+	Name  string
+	Kind  string // "Blu-ray" or "DVD"
+	Dir   string // path of the BDMV or VIDEO_TS folder
+	Title []*torrent.File
+}
+
+var dvdTitlePattern = regexp.MustCompile(`(?i)^VTS_(\d\d)_(\d)\.VOB$`)
+
+// DetectDiscs finds disc structures and picks their main title: the largest
+// .m2ts stream for Blu-rays, and the largest VTS title set (menus excluded)
+// for DVDs.
+func DetectDiscs(t *torrent.Torrent) []Disc {
+	type candidate struct {
+		dir   string
+		files []*torrent.File
+	}
+	candidates := make(map[string]*candidate)
+	var roots []string
+
+	for _, f := range t.Files() {
+		parts := strings.Split(f.DisplayPath(), "/")
+		for i, part := range parts[:len(parts)-1] {
+			kind := strings.ToUpper(part)
+			if kind != "BDMV" && kind != "VIDEO_TS" {
+				continue
+			}
+			root := strings.Join(parts[:i], "/")
+			c, ok := candidates[root]
+			if !ok {
+				c = &candidate{dir: strings.Join(parts[:i+1], "/")}
+				candidates[root] = c
+				roots = append(roots, root)
+			}
+			c.files = append(c.files, f)
+			break
+		}
+	}
+
+	var discs []Disc
+	for _, root := range roots {
+		c := candidates[root]
+		disc := Disc{Name: path.Base(root), Kind: "DVD", Dir: c.dir}
+		if root == "" {
+			disc.Name = t.Name()
+		}
+		if strings.EqualFold(path.Base(c.dir), "BDMV") {
+			disc.Kind = "Blu-ray"
+			disc.Title = blurayTitle(c.files)
+		} else {
+			disc.Title = dvdTitle(c.files)
+		}
+		if len(disc.Title) > 0 {
+			discs = append(discs, disc)
+		}
+	}
+	return discs
+}
+
+func blurayTitle(files []*torrent.File) []*torrent.File {
+	var largest *torrent.File
+	for _, f := range files {
+		if !strings.EqualFold(path.Ext(f.DisplayPath()), ".m2ts") {
+			continue
+		}
+		if largest == nil || f.Length() > largest.Length() {
+			largest = f
+		}
+	}
+	if largest == nil {
+		return nil
+	}
+	return []*torrent.File{largest}
+}
+
+func dvdTitle(files []*torrent.File) []*torrent.File {
+	sets := make(map[string][]*torrent.File)
+	sizes := make(map[string]int64)
+	for _, f := range files {
+		m := dvdTitlePattern.FindStringSubmatch(path.Base(f.DisplayPath()))
+		// VTS_xx_0.VOB is the title set's menu.
+		if m == nil || m[2] == "0" {
+			continue
+		}
+		sets[m[1]] = append(sets[m[1]], f)
+		sizes[m[1]] += f.Length()
+	}
+
+	var best string
+	for set := range sets {
+		if best == "" || sizes[set] > sizes[best] {
+			best = set
+		}
+	}
+	title := sets[best]
+	sort.Slice(title, func(i, j int) bool {
+		return title[i].DisplayPath() < title[j].DisplayPath()
+	})
+	return title
+}
+
+// Contains reports whether a file path belongs to the disc structure.
+func (d Disc) Contains(filePath string) bool {
+	return strings.HasPrefix(filePath, d.Dir+"/")
+}
+
+// URL streams the main title, joining multi-part DVD titles through the
+// concat endpoint.
+func (d Disc) URL(localIP net.IP, Port int, u *User) string {
+	if len(d.Title) == 1 {
+		return BuildUrl(d.Title[0], localIP, Port, u)
+	}
+
+	query := url.Values{}
+	for _, f := range d.Title {
+		query.Add("file", f.DisplayPath())
+	}
+	if u != nil {
+		query.Set("token", u.Token)
+	}
+	return fmt.Sprintf("%s://%s/concat/%s?%s", urlScheme, net.JoinHostPort(localIP.String(), strconv.Itoa(Port)), d.Title[0].Torrent().InfoHash(), query.Encode())
+}
+
+func isDiscFile(discs []Disc, filePath string) bool {
+	for _, d := range discs {
+		if d.Contains(filePath) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d Disc) EntryName() string {
+	return fmt.Sprintf("%s (%s)", d.Name, d.Kind)
+}
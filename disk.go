@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const diskGuardInterval = 15 * time.Second
+
+var errDiskFull = errors.New("not enough free disk space")
+
+// DiskGuard pauses downloads while the DownloadDir volume has less than
+// MinFreeSpace available, and resumes the torrents it paused once there is
+// enough again. Torrents paused through the API are left alone.
+type DiskGuard struct {
+	c        *torrent.Client
+	config   *ClientConfig
+	settings *SettingsStore
+
+	mu     sync.Mutex
+	low    bool
+	paused map[metainfo.Hash]bool
+}
+
+func NewDiskGuard(c *torrent.Client, config *ClientConfig, settings *SettingsStore) *DiskGuard {
+	return &DiskGuard{c: c, config: config, settings: settings, paused: make(map[metainfo.Hash]bool)}
+}
+
+// Check returns errDiskFull if new torrents shouldn't be added.
+func (g *DiskGuard) Check() error {
+	if g.config.MinFreeSpace <= 0 {
+		return nil
+	}
+	free, _, err := diskSpace(g.config.DownloadDir)
+	if err != nil {
+		log.Printf("error checking disk space: %v", err)
+		return nil
+	}
+	if free < uint64(g.config.MinFreeSpace) {
+		return fmt.Errorf("%w: %d bytes left", errDiskFull, free)
+	}
+	return nil
+}
+
+func (g *DiskGuard) Low() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.low
+}
+
+// Run checks the free space every diskGuardInterval until ctx is done.
+func (g *DiskGuard) Run(ctx context.Context) {
+	ticker := time.NewTicker(diskGuardInterval)
+	defer ticker.Stop()
+
+	for {
+		g.update()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *DiskGuard) update() {
+	free, _, err := diskSpace(g.config.DownloadDir)
+	if err != nil {
+		log.Printf("error checking disk space: %v", err)
+		return
+	}
+	low := free < uint64(g.config.MinFreeSpace)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if low != g.low {
+		if low {
+			log.Printf("Only %d bytes free in %s, pausing downloads", free, g.config.DownloadDir)
+		} else {
+			log.Printf("%d bytes free in %s, resuming downloads", free, g.config.DownloadDir)
+		}
+	}
+	g.low = low
+
+	if !low {
+		for ih := range g.paused {
+			// Paused through the API meanwhile.
+			if t, ok := g.c.Torrent(ih); ok && !g.settings.Get(ih.String()).Paused {
+				t.AllowDataDownload()
+			}
+			delete(g.paused, ih)
+		}
+		return
+	}
+	// Also catches torrents added since the last check.
+	for _, t := range g.c.Torrents() {
+		ih := t.InfoHash()
+		if g.paused[ih] || g.settings.Get(ih.String()).Paused || t.Info() != nil && t.Complete().Bool() {
+			continue
+		}
+		t.DisallowDataDownload()
+		g.paused[ih] = true
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/types/infohash"
+)
+
+const (
+	ssdpAddr           = "239.255.255.250:1900"
+	ssdpMaxAge         = 30 * time.Minute
+	ssdpNotifyInterval = ssdpMaxAge / 2
+	dlnaUUIDKey        = "dlna-uuid"
+
+	mediaServerType       = "urn:schemas-upnp-org:device:MediaServer:1"
+	contentDirectoryType  = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	connectionManagerType = "urn:schemas-upnp-org:service:ConnectionManager:1"
+	dlnaServerHeader      = "OS/1.0 UPnP/1.0 go_torrent_mpv/1.0"
+)
+
+// DLNAServer makes the torrents browsable from smart TVs and other UPnP
+// media renderers: it announces a MediaServer over SSDP and answers
+// ContentDirectory browsing with one folder per torrent holding its media
+// files. Renderers can't send API tokens, so it can't be combined with
+// UsersFile or ApiToken.
+type DLNAServer struct {
+	c    *torrent.Client
+	bind net.IP // nil when listening on all interfaces
+	port int
+	uuid string
+	name string
+}
+
+func NewDLNAServer(c *torrent.Client, config *ClientConfig, meta *MetadataStore) (*DLNAServer, error) {
+	var id string
+	if _, err := meta.Get(dlnaUUIDKey, &id); err != nil {
+		return nil, err
+	}
+	if id == "" {
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, fmt.Errorf("error generating DLNA UUID: %w", err)
+		}
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		id = fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+		if err := meta.Put(dlnaUUIDKey, id); err != nil {
+			return nil, err
+		}
+	}
+
+	name := "go_torrent_mpv"
+	if host, err := os.Hostname(); err == nil {
+		name += " (" + host + ")"
+	}
+	d := &DLNAServer{c: c, port: config.Port, uuid: id, name: name}
+	if ip := net.ParseIP(config.HttpBind); ip != nil && !ip.IsUnspecified() {
+		if ip.IsLoopback() {
+			return nil, fmt.Errorf("DLNA needs HttpBind to be a LAN address or empty, renderers can't reach the loopback address")
+		}
+		d.bind = ip
+	}
+	return d, nil
+}
+
+// notificationTypes returns the SSDP NT/ST values the server answers to with
+// their USNs.
+func (d *DLNAServer) notificationTypes() [][2]string {
+	udn := "uuid:" + d.uuid
+	return [][2]string{
+		{"upnp:rootdevice", udn + "::upnp:rootdevice"},
+		{udn, udn},
+		{mediaServerType, udn + "::" + mediaServerType},
+		{contentDirectoryType, udn + "::" + contentDirectoryType},
+		{connectionManagerType, udn + "::" + connectionManagerType},
+	}
+}
+
+// location returns the device description URL reachable from remote, or
+// from the first local address when remote is nil.
+func (d *DLNAServer) location(remote net.IP) (string, error) {
+	if d.bind != nil {
+		return fmt.Sprintf("http://%s/dlna/device.xml", net.JoinHostPort(d.bind.String(), strconv.Itoa(d.port))), nil
+	}
+	ips, err := GetLocalIPs()
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no local IPv4 address")
+	}
+	ip := ips[0]
+	if remote != nil {
+		if addrs, err := net.InterfaceAddrs(); err == nil {
+			for _, addr := range addrs {
+				if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil && ipnet.Contains(remote) {
+					ip = ipnet.IP.To4()
+					break
+				}
+			}
+		}
+	}
+	return fmt.Sprintf("http://%s:%d/dlna/device.xml", ip, d.port), nil
+}
+
+// Run announces the server and answers searches until ctx is done, then
+// says goodbye.
+func (d *DLNAServer) Run(ctx context.Context) error {
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return err
+	}
+	listener, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return fmt.Errorf("error joining SSDP multicast group: %w", err)
+	}
+	sender, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("error opening SSDP socket: %w", err)
+	}
+	defer sender.Close()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go func() {
+		ticker := time.NewTicker(ssdpNotifyInterval)
+		defer ticker.Stop()
+		for {
+			d.notify(sender, group, "ssdp:alive")
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				d.notify(sender, group, "ssdp:byebye")
+				return
+			}
+		}
+	}()
+	log.Printf("Announcing DLNA media server %q", d.name)
+
+	buf := make([]byte, 2048)
+	for {
+		n, remote, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("error reading SSDP: %w", err)
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("Man") != `"ssdp:discover"` {
+			continue
+		}
+		d.answerSearch(sender, remote, req.Header.Get("St"))
+	}
+}
+
+func (d *DLNAServer) notify(conn *net.UDPConn, group *net.UDPAddr, nts string) {
+	location, err := d.location(nil)
+	if err != nil {
+		log.Printf("error announcing DLNA server: %v", err)
+		return
+	}
+	for _, nt := range d.notificationTypes() {
+		msg := "NOTIFY * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddr + "\r\n" +
+			fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", int(ssdpMaxAge.Seconds())) +
+			"LOCATION: " + location + "\r\n" +
+			"NT: " + nt[0] + "\r\n" +
+			"NTS: " + nts + "\r\n" +
+			"SERVER: " + dlnaServerHeader + "\r\n" +
+			"USN: " + nt[1] + "\r\n\r\n"
+		if _, err := conn.WriteToUDP([]byte(msg), group); err != nil {
+			log.Printf("error announcing DLNA server: %v", err)
+			return
+		}
+	}
+}
+
+func (d *DLNAServer) answerSearch(conn *net.UDPConn, remote *net.UDPAddr, st string) {
+	location, err := d.location(remote.IP)
+	if err != nil {
+		log.Printf("error answering SSDP search: %v", err)
+		return
+	}
+	for _, nt := range d.notificationTypes() {
+		if st != "ssdp:all" && st != nt[0] {
+			continue
+		}
+		msg := "HTTP/1.1 200 OK\r\n" +
+			fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", int(ssdpMaxAge.Seconds())) +
+			"EXT:\r\n" +
+			"LOCATION: " + location + "\r\n" +
+			"SERVER: " + dlnaServerHeader + "\r\n" +
+			"ST: " + nt[0] + "\r\n" +
+			"USN: " + nt[1] + "\r\n\r\n"
+		if _, err := conn.WriteToUDP([]byte(msg), remote); err != nil {
+			log.Printf("error answering SSDP search: %v", err)
+			return
+		}
+	}
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func writeXML(w http.ResponseWriter, r *http.Request, body string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.WriteString(w, body)
+}
+
+func (d *DLNAServer) HandleDeviceDescription() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeXML(w, r, `<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>`+mediaServerType+`</deviceType>
+    <friendlyName>`+xmlEscape(d.name)+`</friendlyName>
+    <manufacturer>go_torrent_mpv</manufacturer>
+    <modelName>go_torrent_mpv</modelName>
+    <UDN>uuid:`+d.uuid+`</UDN>
+    <serviceList>
+      <service>
+        <serviceType>`+contentDirectoryType+`</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId>
+        <SCPDURL>/dlna/ContentDirectory.xml</SCPDURL>
+        <controlURL>/dlna/control/ContentDirectory</controlURL>
+        <eventSubURL>/dlna/events/ContentDirectory</eventSubURL>
+      </service>
+      <service>
+        <serviceType>`+connectionManagerType+`</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+        <SCPDURL>/dlna/ConnectionManager.xml</SCPDURL>
+        <controlURL>/dlna/control/ConnectionManager</controlURL>
+        <eventSubURL>/dlna/events/ConnectionManager</eventSubURL>
+      </service>
+    </serviceList>
+  </device>
+</root>
+`)
+	})
+}
+
+const contentDirectorySCPD = `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action><name>Browse</name><argumentList>
+      <argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+      <argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>
+      <argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+      <argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+      <argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+      <argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+      <argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSystemUpdateID</name><argumentList>
+      <argument><name>Id</name><direction>out</direction><relatedStateVariable>SystemUpdateID</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSearchCapabilities</name><argumentList>
+      <argument><name>SearchCaps</name><direction>out</direction><relatedStateVariable>SearchCapabilities</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSortCapabilities</name><argumentList>
+      <argument><name>SortCaps</name><direction>out</direction><relatedStateVariable>SortCapabilities</relatedStateVariable></argument>
+    </argumentList></action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SystemUpdateID</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SearchCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SortCapabilities</name><dataType>string</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>
+`
+
+const connectionManagerSCPD = `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action><name>GetProtocolInfo</name><argumentList>
+      <argument><name>Source</name><direction>out</direction><relatedStateVariable>SourceProtocolInfo</relatedStateVariable></argument>
+      <argument><name>Sink</name><direction>out</direction><relatedStateVariable>SinkProtocolInfo</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetCurrentConnectionIDs</name><argumentList>
+      <argument><name>ConnectionIDs</name><direction>out</direction><relatedStateVariable>CurrentConnectionIDs</relatedStateVariable></argument>
+    </argumentList></action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="yes"><name>SourceProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SinkProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>CurrentConnectionIDs</name><dataType>string</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>
+`
+
+func (d *DLNAServer) HandleSCPD(scpd string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeXML(w, r, scpd)
+	})
+}
+
+type browseRequest struct {
+	ObjectID       string
+	BrowseFlag     string
+	StartingIndex  int
+	RequestedCount int
+}
+
+type soapEnvelope struct {
+	Body struct {
+		Browse browseRequest
+	}
+}
+
+// soapAction returns the action name from a SOAPACTION header such as
+// "urn:schemas-upnp-org:service:ContentDirectory:1#Browse".
+func soapAction(r *http.Request) string {
+	_, action, _ := strings.Cut(strings.Trim(r.Header.Get("Soapaction"), `"`), "#")
+	return action
+}
+
+func writeSOAP(w http.ResponseWriter, r *http.Request, serviceType, action, args string) {
+	writeXML(w, r, `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`+
+		`<u:`+action+`Response xmlns:u="`+serviceType+`">`+args+`</u:`+action+`Response>`+
+		`</s:Body></s:Envelope>`)
+}
+
+func writeSOAPFault(w http.ResponseWriter, code int, description string) {
+	body := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><s:Fault>`+
+		`<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError>`+
+		`</detail></s:Fault></s:Body></s:Envelope>`, code, xmlEscape(description))
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	io.WriteString(w, body)
+}
+
+func (d *DLNAServer) HandleConnectionManager() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch soapAction(r) {
+		case "GetProtocolInfo":
+			writeSOAP(w, r, connectionManagerType, "GetProtocolInfo",
+				"<Source>http-get:*:video/*:*,http-get:*:audio/*:*,http-get:*:image/*:*</Source><Sink></Sink>")
+		case "GetCurrentConnectionIDs":
+			writeSOAP(w, r, connectionManagerType, "GetCurrentConnectionIDs", "<ConnectionIDs>0</ConnectionIDs>")
+		default:
+			writeSOAPFault(w, 401, "Invalid Action")
+		}
+	})
+}
+
+func (d *DLNAServer) HandleContentDirectory() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch soapAction(r) {
+		case "Browse":
+		case "GetSystemUpdateID":
+			writeSOAP(w, r, contentDirectoryType, "GetSystemUpdateID", "<Id>1</Id>")
+			return
+		case "GetSearchCapabilities":
+			writeSOAP(w, r, contentDirectoryType, "GetSearchCapabilities", "<SearchCaps></SearchCaps>")
+			return
+		case "GetSortCapabilities":
+			writeSOAP(w, r, contentDirectoryType, "GetSortCapabilities", "<SortCaps></SortCaps>")
+			return
+		default:
+			writeSOAPFault(w, 401, "Invalid Action")
+			return
+		}
+
+		var env soapEnvelope
+		if err := xml.NewDecoder(r.Body).Decode(&env); err != nil {
+			writeSOAPFault(w, 402, "Invalid Args")
+			return
+		}
+		req := env.Body.Browse
+
+		objects, ok := d.browse(req)
+		if !ok {
+			writeSOAPFault(w, 701, "No such object")
+			return
+		}
+		total := len(objects)
+		start := min(max(req.StartingIndex, 0), total)
+		end := total
+		if req.RequestedCount > 0 {
+			end = min(start+req.RequestedCount, total)
+		}
+
+		didl := `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">` +
+			strings.Join(objects[start:end], "") + `</DIDL-Lite>`
+		writeSOAP(w, r, contentDirectoryType, "Browse", fmt.Sprintf(
+			"<Result>%s</Result><NumberReturned>%d</NumberReturned><TotalMatches>%d</TotalMatches><UpdateID>1</UpdateID>",
+			xmlEscape(didl), end-start, total,
+		))
+	})
+}
+
+// browse returns the DIDL-Lite objects for a request. Object "0" is the root
+// holding a container per torrent, identified by infohash, whose items are
+// "<infohash>/<file index>".
+func (d *DLNAServer) browse(req browseRequest) ([]string, bool) {
+	children := req.BrowseFlag == "BrowseDirectChildren"
+	if req.ObjectID == "0" {
+		if !children {
+			return []string{fmt.Sprintf(`<container id="0" parentID="-1" restricted="1" childCount="%d"><dc:title>%s</dc:title><upnp:class>object.container.storageFolder</upnp:class></container>`,
+				len(d.c.Torrents()), xmlEscape(d.name))}, true
+		}
+		var objects []string
+		for _, t := range d.c.Torrents() {
+			if t.Info() != nil {
+				objects = append(objects, d.torrentContainer(t))
+			}
+		}
+		return objects, true
+	}
+
+	ihString, index, isItem := strings.Cut(req.ObjectID, "/")
+	b, err := hex.DecodeString(ihString)
+	if err != nil || len(b) != 20 {
+		return nil, false
+	}
+	var ih infohash.T
+	copy(ih[:], b)
+	t, ok := d.c.Torrent(ih)
+	if !ok || t.Info() == nil {
+		return nil, false
+	}
+
+	ip := d.bind
+	if ip == nil {
+		ips, err := GetLocalIPs()
+		if err != nil || len(ips) == 0 {
+			return nil, false
+		}
+		ip = ips[0]
+	}
+	files := t.Files()
+	if isItem {
+		i, err := strconv.Atoi(index)
+		if err != nil || i < 0 || i >= len(files) {
+			return nil, false
+		}
+		item, ok := d.fileItem(files[i], i, ip)
+		return []string{item}, ok
+	}
+	if !children {
+		return []string{d.torrentContainer(t)}, true
+	}
+	var objects []string
+	for i, f := range files {
+		if item, ok := d.fileItem(f, i, ip); ok {
+			objects = append(objects, item)
+		}
+	}
+	return objects, true
+}
+
+func (d *DLNAServer) torrentContainer(t *torrent.Torrent) string {
+	return fmt.Sprintf(`<container id="%s" parentID="0" restricted="1"><dc:title>%s</dc:title><upnp:class>object.container.storageFolder</upnp:class></container>`,
+		t.InfoHash(), xmlEscape(t.Name()))
+}
+
+// fileItem describes a media file, reporting false for other files.
+func (d *DLNAServer) fileItem(f *torrent.File, index int, ip net.IP) (string, bool) {
+	mimeType, _, _ := strings.Cut(mime.TypeByExtension(filepath.Ext(f.DisplayPath())), ";")
+	var class string
+	switch {
+	case strings.HasPrefix(mimeType, "video/"):
+		class = "object.item.videoItem"
+	case strings.HasPrefix(mimeType, "audio/"):
+		class = "object.item.audioItem.musicTrack"
+	case strings.HasPrefix(mimeType, "image/"):
+		class = "object.item.imageItem.photo"
+	default:
+		return "", false
+	}
+
+	ih := f.Torrent().InfoHash()
+	return fmt.Sprintf(`<item id="%s/%d" parentID="%s" restricted="1"><dc:title>%s</dc:title><upnp:class>%s</upnp:class><res protocolInfo="http-get:*:%s:*" size="%d">%s</res></item>`,
+		ih, index, ih, xmlEscape(filepath.Base(f.DisplayPath())), class, mimeType, f.Length(),
+		xmlEscape(BuildUrl(f, ip, d.port, nil))), true
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/anacrolix/torrent"
+)
+
+type ExportResult struct {
+	Dest     string
+	Exported []string
+	Skipped  []string // files not fully downloaded yet
+	Existing []string // files already in dest, left as they are
+}
+
+// HandlePostExport serves POST /torrents/{infohash}/export?dest=. It copies
+// the torrent's completed files out of storage into dest, a directory under
+// ExportDir, recreating the torrent's file tree, so they can be kept after
+// the torrent is dropped. Files that already exist are never overwritten.
+// ?file= limits the export to the given files and can be repeated.
+func HandlePostExport(c *torrent.Client, config *ClientConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ih, ok := ParseInfoHashParam(w, r)
+		if !ok {
+			return
+		}
+		if config.ExportDir == "" {
+			http.Error(w, "Exports are disabled, ExportDir isn't set", http.StatusForbidden)
+			return
+		}
+		rel := filepath.FromSlash(r.URL.Query().Get("dest"))
+		if rel == "" {
+			rel = "."
+		}
+		if rel != "." && !filepath.IsLocal(rel) {
+			http.Error(w, "dest must be a directory under ExportDir", http.StatusBadRequest)
+			return
+		}
+
+		t, ok := c.Torrent(ih)
+		if !ok {
+			http.Error(w, "Torrent not found", http.StatusNotFound)
+			return
+		}
+		if !awaitInfo(w, r, t, config) {
+			return
+		}
+
+		if err := os.MkdirAll(filepath.Join(config.ExportDir, rel), 0o777); err != nil {
+			log.Printf("error creating export directory: %v", err)
+			http.Error(w, "Error creating export directory", http.StatusInternalServerError)
+			return
+		}
+		dest, err := resolveUnder(config.ExportDir, rel)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		wanted := make(map[string]bool)
+		for _, name := range r.URL.Query()["file"] {
+			wanted[name] = true
+		}
+
+		result := ExportResult{Dest: dest, Exported: []string{}, Skipped: []string{}, Existing: []string{}}
+		for _, f := range t.Files() {
+			if len(wanted) > 0 && !wanted[f.DisplayPath()] {
+				continue
+			}
+			if f.BytesCompleted() < f.Length() {
+				result.Skipped = append(result.Skipped, f.DisplayPath())
+				continue
+			}
+			err := exportFile(r, f, dest)
+			if errors.Is(err, fs.ErrExist) {
+				result.Existing = append(result.Existing, f.DisplayPath())
+				continue
+			}
+			if err != nil {
+				log.Print(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			result.Exported = append(result.Exported, f.DisplayPath())
+		}
+		log.Printf("Exported %d files of %s to %s", len(result.Exported), t.Name(), dest)
+
+		parsed, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		w.Write(parsed)
+	})
+}
+
+// exportFile writes f under dest through a temporary file, so an interrupted
+// export doesn't leave a truncated file behind. It fails with fs.ErrExist if
+// the file is already there.
+func exportFile(r *http.Request, f *torrent.File, dest string) error {
+	rel := filepath.FromSlash(f.Path())
+	if !filepath.IsLocal(rel) {
+		return fmt.Errorf("refusing to export %q outside the destination", f.Path())
+	}
+	target := filepath.Join(dest, rel)
+	if _, err := os.Lstat(target); err == nil {
+		return fs.ErrExist
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o777); err != nil {
+		return fmt.Errorf("error creating export directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".*.part")
+	if err != nil {
+		return fmt.Errorf("error creating export file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	reader := f.NewReader()
+	defer reader.Close()
+	if _, err := io.Copy(tmp, ContextReader{reader, r.Context()}); err != nil {
+		return fmt.Errorf("error exporting %s: %w", f.DisplayPath(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error exporting %s: %w", f.DisplayPath(), err)
+	}
+	// Checked again right before moving the file in, as the copy takes a
+	// while.
+	if _, err := os.Lstat(target); err == nil {
+		return fs.ErrExist
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return fmt.Errorf("error exporting %s: %w", f.DisplayPath(), err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/anacrolix/torrent"
+)
+
+// FileSelection sets the download priority of one file in a torrent.
+// Priority is one of "none", "normal" or "high"; files set to "none" are only
+// fetched as far as a stream reads them.
+type FileSelection struct {
+	Path     string
+	Priority string
+}
+
+var filePriorities = map[string]torrent.PiecePriority{
+	"none":   torrent.PiecePriorityNone,
+	"normal": torrent.PiecePriorityNormal,
+	"high":   torrent.PiecePriorityHigh,
+}
+
+func priorityName(p torrent.PiecePriority) string {
+	for name, prio := range filePriorities {
+		if prio == p {
+			return name
+		}
+	}
+	return strconv.Itoa(int(p))
+}
+
+// HandlePostFiles serves POST /torrents/{infohash}/files. The body is a JSON
+// list of FileSelection entries; files not listed keep their priority. The
+// response lists every file with its priority after the update.
+func HandlePostFiles(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ih, ok := ParseInfoHashParam(w, r)
+		if !ok {
+			return
+		}
+		t, ok := c.Torrent(ih)
+		if !ok || !svc.Users.CanAccess(UserFromContext(r.Context()), ih.String()) {
+			http.Error(w, "Torrent not found", http.StatusNotFound)
+			return
+		}
+
+		var selections []FileSelection
+		if err := json.NewDecoder(r.Body).Decode(&selections); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		if !awaitInfo(w, r, t, config) {
+			return
+		}
+
+		files := make(map[string]*torrent.File, len(t.Files()))
+		for _, f := range t.Files() {
+			files[f.DisplayPath()] = f
+		}
+
+		// Validate everything first so a bad entry doesn't leave the torrent
+		// half updated.
+		for _, s := range selections {
+			if _, ok := files[s.Path]; !ok {
+				http.Error(w, fmt.Sprintf("File not found: %s", s.Path), http.StatusBadRequest)
+				return
+			}
+			if _, ok := filePriorities[s.Priority]; !ok {
+				http.Error(w, fmt.Sprintf("Invalid priority: %s", s.Priority), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, s := range selections {
+			files[s.Path].SetPriority(filePriorities[s.Priority])
+		}
+
+		result := make([]FileSelection, 0, len(t.Files()))
+		for _, f := range t.Files() {
+			result = append(result, FileSelection{Path: f.DisplayPath(), Priority: priorityName(f.Priority())})
+		}
+
+		parsed, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		w.Write(parsed)
+	})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// How often StreamEvents looks for changes.
+const eventPollInterval = time.Second
+
+// ControlAPI implements the gRPC control API in control.proto on top of
+// the same client and services as the HTTP API. It applies the same network
+// guard and tokens, sent as authorization: Bearer metadata.
+type ControlAPI struct {
+	UnimplementedControlServer
+	ctx    context.Context
+	c      *torrent.Client
+	config *ClientConfig
+	svc    *Services
+}
+
+// ServeGRPC listens on GRPCPort until ctx is done.
+func ServeGRPC(ctx context.Context, c *torrent.Client, config *ClientConfig, svc *Services, tlsConfig *tls.Config) error {
+	l, err := net.Listen("tcp", net.JoinHostPort(config.HttpBind, strconv.Itoa(config.GRPCPort)))
+	if err != nil {
+		return fmt.Errorf("error listening for gRPC: %w", err)
+	}
+
+	cs := &ControlAPI{ctx: ctx, c: c, config: config, svc: svc}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(cs.unaryInterceptor),
+		grpc.StreamInterceptor(cs.streamInterceptor),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(opts...)
+	RegisterControlServer(server, cs)
+
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+	log.Printf("gRPC listening on %s...", l.Addr())
+	if err := server.Serve(l); err != nil {
+		return fmt.Errorf("error serving gRPC: %w", err)
+	}
+	return nil
+}
+
+// authenticate applies the network guard and returns ctx with the user the
+// call's token belongs to.
+func (s *ControlAPI) authenticate(ctx context.Context) (context.Context, error) {
+	if g := s.svc.Guard; g != nil {
+		p, ok := peer.FromContext(ctx)
+		if !ok {
+			return nil, status.Error(codes.PermissionDenied, "Forbidden")
+		}
+		addrPort, err := netip.ParseAddrPort(p.Addr.String())
+		if err != nil || !g.Allows(addrPort.Addr()) {
+			return nil, status.Error(codes.PermissionDenied, "Forbidden")
+		}
+	}
+	if s.svc.Users == nil {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if token, ok := strings.CutPrefix(v, "Bearer "); ok {
+			if u, ok := s.svc.Users.Authenticate(token); ok {
+				return context.WithValue(ctx, userContextKey{}, u), nil
+			}
+		}
+	}
+	return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+}
+
+func (s *ControlAPI) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *ControlAPI) streamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+func (s *ControlAPI) AddTorrent(ctx context.Context, req *AddTorrentRequest) (*Torrent, error) {
+	u := UserFromContext(ctx)
+	if err := canAdd(s.c, s.svc, u); errors.Is(err, errDraining) {
+		return nil, status.Error(codes.Unavailable, "Server is shutting down")
+	} else if err != nil {
+		return nil, status.Errorf(codes.ResourceExhausted, "Error adding torrent: %v", err)
+	}
+
+	opts := addOptions{seed: !s.config.NoSeed, persist: req.Persist}
+	if req.Seed != nil {
+		opts.seed = *req.Seed
+		opts.settings.Seed = req.Seed
+	}
+	if req.Label != "" {
+		opts.settings.Label = &req.Label
+	}
+
+	id := req.Id
+	var spec *torrent.TorrentSpec
+	var err error
+	if len(req.Metainfo) > 0 {
+		id = "uploaded torrent"
+		var mi *metainfo.MetaInfo
+		if mi, err = metainfo.Load(bytes.NewReader(req.Metainfo)); err == nil {
+			spec, err = torrent.TorrentSpecFromMetaInfoErr(mi)
+		}
+	} else {
+		spec, err = ParseTorrentSpec(id)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Error adding torrent: %v", err)
+	}
+
+	t, isNew, err := addSpec(s.c, s.config, s.svc, id, spec, opts)
+	if err != nil {
+		log.Printf("error adding torrent: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "Error adding torrent: %v", err)
+	}
+
+	if req.Async {
+		finishAddAsync(t, s.config, s.svc, u, opts.settings)
+		return s.describe(t, u)
+	}
+
+	switch err := awaitAdded(ctx, t, isNew, s.config, s.svc, u, opts); {
+	case err == nil:
+		return s.describe(t, u)
+	case errors.Is(err, errMetadataTimeout):
+		return nil, status.Error(codes.DeadlineExceeded, "Timed out waiting for torrent metadata")
+	case errors.Is(err, errTorrentClosed):
+		return nil, status.Error(codes.NotFound, "Torrent not found")
+	default:
+		return nil, status.FromContextError(err).Err()
+	}
+}
+
+func (s *ControlAPI) describe(t *torrent.Torrent, u *User) (*Torrent, error) {
+	info, err := DescribeTorrent(t, s.config, s.svc, u, s.svc.Archives.Cached(t))
+	if err != nil {
+		log.Printf("error describing torrent: %v", err)
+		return nil, status.Errorf(codes.Internal, "Error describing torrent: %v", err)
+	}
+	return torrentMessage(info), nil
+}
+
+func torrentMessage(info TorrentInfo) *Torrent {
+	msg := &Torrent{
+		InfoHash:    info.InfoHash,
+		Name:        info.Name,
+		HasMetadata: info.HasMetadata,
+		Length:      info.Length,
+		Paused:      info.Paused,
+		Label:       info.Label,
+		Added:       timestamppb.New(info.Added),
+	}
+	for _, f := range info.Files {
+		msg.Files = append(msg.Files, &File{
+			Name:           f.Name,
+			Path:           f.Path,
+			Url:            f.URL,
+			Length:         f.Length,
+			BytesCompleted: f.BytesCompleted,
+		})
+	}
+	return msg
+}
+
+func (s *ControlAPI) ListTorrents(ctx context.Context, req *ListTorrentsRequest) (*ListTorrentsResponse, error) {
+	// Parsed like GET /torrents' query for the same validation.
+	query := url.Values{}
+	for name, v := range map[string]string{"label": req.Label, "state": req.State, "sort": req.Sort} {
+		if v != "" {
+			query.Set(name, v)
+		}
+	}
+	if req.Desc {
+		query.Set("order", "desc")
+	}
+	if req.Limit != 0 {
+		query.Set("limit", strconv.Itoa(int(req.Limit)))
+	}
+	if req.Offset != 0 {
+		query.Set("offset", strconv.Itoa(int(req.Offset)))
+	}
+	q, err := ParseTorrentQuery(query)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	torrents, total, err := ListTorrents(s.c, s.config, s.svc, UserFromContext(ctx), q)
+	if err != nil {
+		log.Printf("error listing torrents: %v", err)
+		return nil, status.Errorf(codes.Internal, "Error listing torrents: %v", err)
+	}
+	resp := &ListTorrentsResponse{Total: int32(total)}
+	for _, info := range torrents {
+		resp.Torrents = append(resp.Torrents, torrentMessage(info))
+	}
+	return resp, nil
+}
+
+func (s *ControlAPI) DropTorrent(ctx context.Context, req *DropTorrentRequest) (*DropTorrentResponse, error) {
+	var ih metainfo.Hash
+	if err := ih.FromHexString(req.InfoHash); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Invalid infohash")
+	}
+	u := UserFromContext(ctx)
+	t, ok := s.c.Torrent(ih)
+	if !ok || !s.svc.Users.CanAccess(u, ih.String()) {
+		return nil, status.Error(codes.NotFound, "Torrent not found")
+	}
+
+	unowned, err := s.svc.Users.RemoveOwner(u, ih.String())
+	if err != nil {
+		log.Print(err)
+	}
+	if unowned {
+		DropTorrent(t, s.config, s.svc)
+	}
+	return &DropTorrentResponse{}, nil
+}
+
+func (s *ControlAPI) StreamEvents(req *StreamEventsRequest, stream Control_StreamEventsServer) error {
+	u := UserFromContext(stream.Context())
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+
+	known := make(map[string]TorrentStatus)
+	for {
+		current := make(map[string]TorrentStatus)
+		for _, t := range s.c.Torrents() {
+			ih := t.InfoHash().String()
+			if req.InfoHash != "" && ih != req.InfoHash || !s.svc.Users.CanAccess(u, ih) {
+				continue
+			}
+			current[ih] = GetTorrentStatus(t, s.svc)
+		}
+
+		var events []*Event
+		now := timestamppb.Now()
+		for ih, st := range current {
+			prev, ok := known[ih]
+			switch {
+			case !ok:
+				events = append(events, &Event{Type: Event_ADDED, Status: statusMessage(st), Time: now})
+			case prev.State != st.State:
+				events = append(events, &Event{Type: Event_STATE_CHANGED, Status: statusMessage(st), Time: now})
+			}
+		}
+		for ih, st := range known {
+			if _, ok := current[ih]; !ok {
+				events = append(events, &Event{Type: Event_DROPPED, Status: statusMessage(st), Time: now})
+			}
+		}
+		for _, e := range events {
+			if err := stream.Send(e); err != nil {
+				return err
+			}
+		}
+		known = current
+
+		select {
+		case <-ticker.C:
+		case <-stream.Context().Done():
+			return nil
+		case <-s.ctx.Done():
+			return nil
+		}
+	}
+}
+
+func statusMessage(st TorrentStatus) *Status {
+	return &Status{
+		InfoHash:       st.InfoHash,
+		Name:           st.Name,
+		State:          st.State,
+		HasInfo:        st.HasInfo,
+		Peers:          int32(st.Peers),
+		KnownPeers:     int32(st.KnownPeers),
+		Seeders:        int32(st.Seeders),
+		Length:         st.Length,
+		BytesCompleted: st.BytesCompleted,
+		Progress:       st.Progress,
+	}
+}
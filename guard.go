@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// NetworkGuard rejects requests from outside the local network, for when the
+// HTTP port ends up forwarded on a router by accident. A nil *NetworkGuard
+// allows everything.
+type NetworkGuard struct {
+	allowed []netip.Prefix
+}
+
+// NewNetworkGuard returns nil unless LanOnly is set. AllowedNetworks is a
+// comma separated list of extra CIDR ranges to let through.
+func NewNetworkGuard(config *ClientConfig) (*NetworkGuard, error) {
+	if !config.LanOnly {
+		return nil, nil
+	}
+
+	g := &NetworkGuard{}
+	if config.AllowedNetworks == "" {
+		return g, nil
+	}
+	for _, s := range strings.Split(config.AllowedNetworks, ",") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed network %q: %w", s, err)
+		}
+		g.allowed = append(g.allowed, prefix.Masked())
+	}
+	return g, nil
+}
+
+func (g *NetworkGuard) Allows(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() {
+		return true
+	}
+	for _, prefix := range g.allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *NetworkGuard) Middleware(next http.Handler) http.Handler {
+	if g == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil || !g.Allows(addr) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
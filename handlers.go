@@ -1,26 +1,73 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
-	"os"
+	"net/url"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/anacrolix/squirrel"
 	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
 	"github.com/anacrolix/torrent/types/infohash"
 )
 
-func HandleGetTorrents(c *torrent.Client, config *ClientConfig) http.Handler {
+// ParseInfoHashParam validates the {infohash} path value, writing a JSON 400
+// response if it is malformed. v2 hashes are truncated to 20 bytes, which is
+// how the client keys v2-only torrents.
+func ParseInfoHashParam(w http.ResponseWriter, r *http.Request) (infohash.T, bool) {
+	s := r.PathValue("infohash")
+	if len(s) != 40 && len(s) != 64 {
+		WriteJSONError(w, "Infohash must be 40 (v1) or 64 (v2) hex characters", http.StatusBadRequest)
+		return infohash.T{}, false
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		WriteJSONError(w, "Infohash must be hexadecimal", http.StatusBadRequest)
+		return infohash.T{}, false
+	}
+
+	var ih infohash.T
+	copy(ih[:], b)
+	return ih, true
+}
+
+func WriteJSONError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct{ Error string }{msg})
+}
+
+func HandleGetTorrents(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, err := ParseTorrentQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		torrents, total, err := ListTorrents(c, config, svc, UserFromContext(r.Context()), q)
+		if err != nil {
+			log.Printf("error listing torrents: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 
-		parsed, err := MarshalTorrents(c, config)
+		parsed, err := json.Marshal(torrents)
 		if err != nil {
 			log.Printf("error encoding JSON response: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -29,6 +76,7 @@ func HandleGetTorrents(c *torrent.Client, config *ClientConfig) http.Handler {
 
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
 		if r.Method == http.MethodHead {
 			return
 		}
@@ -36,54 +84,568 @@ func HandleGetTorrents(c *torrent.Client, config *ClientConfig) http.Handler {
 	})
 }
 
-func HandlePostTorrents(c *torrent.Client, config *ClientConfig) http.Handler {
+// Orders GET /torrents can sort by. The default is the order they were
+// added in.
+const (
+	sortAdded    = "added"
+	sortName     = "name"
+	sortSize     = "size"
+	sortProgress = "progress"
+)
+
+// TorrentQuery selects and pages the torrents listed by GET /torrents.
+type TorrentQuery struct {
+	Label  string
+	State  string
+	Sort   string
+	Desc   bool
+	Limit  int // 0 is unlimited
+	Offset int
+}
+
+// ParseTorrentQuery reads ?label=, ?state= (as reported by the status
+// endpoint), ?sort=added|name|size|progress, ?order=asc|desc, ?limit= and
+// ?offset=.
+func ParseTorrentQuery(query url.Values) (TorrentQuery, error) {
+	q := TorrentQuery{Label: query.Get("label"), State: query.Get("state"), Sort: sortAdded}
+	switch q.State {
+	case "", stateFetchingMetadata, stateDownloading, statePaused, stateComplete, stateVerifying:
+	default:
+		return q, fmt.Errorf("invalid state parameter")
+	}
+	if v := query.Get("sort"); v != "" {
+		switch v {
+		case sortAdded, sortName, sortSize, sortProgress:
+			q.Sort = v
+		default:
+			return q, fmt.Errorf("invalid sort parameter")
+		}
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("invalid order parameter")
+	}
+	for _, p := range []struct {
+		name string
+		v    *int
+	}{{"limit", &q.Limit}, {"offset", &q.Offset}} {
+		if v := query.Get(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return q, fmt.Errorf("invalid %s parameter", p.name)
+			}
+			*p.v = n
+		}
+	}
+	return q, nil
+}
+
+// Uploaded .torrent files larger than this are rejected.
+const maxTorrentFileSize = 16 << 20
+
+// readTorrentUpload returns the .torrent file uploaded as an
+// application/x-bittorrent body or as the first file of a multipart form,
+// with its name. ok is false when the body is a plain torrent id instead.
+func readTorrentUpload(w http.ResponseWriter, r *http.Request) (name string, data []byte, ok bool, err error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	body := http.MaxBytesReader(w, r.Body, maxTorrentFileSize)
+	switch mediaType {
+	case "application/x-bittorrent":
+		data, err = io.ReadAll(body)
+		return "uploaded torrent file", data, true, err
+	case "multipart/form-data":
+		r.Body = body
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return "", nil, true, err
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return "", nil, true, errors.New("no torrent file in form")
+			}
+			if err != nil {
+				return "", nil, true, err
+			}
+			if part.FileName() == "" {
+				continue
+			}
+			data, err = io.ReadAll(part)
+			return part.FileName(), data, true, err
+		}
+	}
+	return "", nil, false, nil
+}
+
+func HandlePostTorrents(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		body, err := io.ReadAll(r.Body)
+		name, upload, isUpload, err := readTorrentUpload(w, r)
 		if err != nil {
-			log.Printf("error reading request body: %v", err)
-			http.Error(w, "Bad request", http.StatusBadRequest)
+			log.Printf("error reading uploaded torrent: %v", err)
+			http.Error(w, fmt.Sprintf("Bad request: %v", err), http.StatusBadRequest)
 			return
 		}
+		var body []byte
+		if !isUpload {
+			if body, err = io.ReadAll(r.Body); err != nil {
+				log.Printf("error reading request body: %v", err)
+				http.Error(w, "Bad request", http.StatusBadRequest)
+				return
+			}
+		}
 
-		t, err := AddTorrent(c, string(body))
+		opts, err := ParsePlaylistOptions(r)
 		if err != nil {
-			log.Printf("error adding torrent: %v", err)
-			http.Error(w, fmt.Sprintf("Error adding torrent: %v", err), http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var async bool
+		if v := r.URL.Query().Get("async"); v != "" {
+			if async, err = strconv.ParseBool(v); err != nil {
+				http.Error(w, "Invalid async parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		var t *torrent.Torrent
+		var ok bool
+		if isUpload {
+			t, ok = AddMetainfoFromRequest(c, config, svc, w, r, name, upload, async)
+		} else {
+			t, ok = AddFromRequest(c, config, svc, w, r, string(body), async)
+		}
+		if !ok {
+			return
+		}
+
+		if async {
+			WriteAddAccepted(w, t)
+			return
+		}
+		if acceptsJSON(r) {
+			WriteAddedTorrent(w, t, config, svc, UserFromContext(r.Context()), opts)
+			return
+		}
+		WritePlaylist(w, t, config, UserFromContext(r.Context()), opts, svc.Archives.Get(t))
+	})
+}
+
+// acceptsJSON reports whether the request's Accept header asks for JSON.
+func acceptsJSON(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, _ := mime.ParseMediaType(v); mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleGetAdd is POST /torrents for clients that can only open a URL:
+// /add?uri=<magnet> returns the playlist, and with format=redirect it
+// redirects to the torrent's playlist URL instead.
+func HandleGetAdd(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uri := r.URL.Query().Get("uri")
+		if uri == "" {
+			http.Error(w, "Missing uri parameter", http.StatusBadRequest)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "m3u" && format != "redirect" {
+			http.Error(w, fmt.Sprintf("unsupported format %q", format), http.StatusBadRequest)
 			return
 		}
 
-		playlist, err := BuildPlaylist(t, config)
+		opts, err := ParsePlaylistOptions(r)
 		if err != nil {
-			log.Printf("error building playlist: %v", err)
-			http.Error(w, fmt.Sprintf("Error building playlist: %v", err), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
-		fmt.Fprint(w, playlist)
+		t, ok := AddFromRequest(c, config, svc, w, r, uri, false)
+		if !ok {
+			return
+		}
 
-		if !config.ResumeTorrents {
+		if format == "redirect" {
+			query := url.Values{}
+			for _, key := range []string{"player", "relative", "token"} {
+				if v := r.URL.Query().Get(key); v != "" {
+					query.Set(key, v)
+				}
+			}
+			location := "/torrents/" + t.InfoHash().String()
+			if len(query) > 0 {
+				location += "?" + query.Encode()
+			}
+			http.Redirect(w, r, location, http.StatusSeeOther)
 			return
 		}
 
+		WritePlaylist(w, t, config, UserFromContext(r.Context()), opts, svc.Archives.Get(t))
+	})
+}
+
+// AddFromRequest adds the torrent identified by id using the add-time options
+// in the request's query and waits for its metadata. It writes an error
+// response and returns false if that fails. With async it returns right away
+// and finishes setting the torrent up once the metadata arrives.
+func AddFromRequest(c *torrent.Client, config *ClientConfig, svc *Services, w http.ResponseWriter, r *http.Request, id string, async bool) (*torrent.Torrent, bool) {
+	return addFromRequest(c, config, svc, w, r, id, func() (*torrent.TorrentSpec, error) { return ParseTorrentSpec(id) }, async)
+}
+
+// AddMetainfoFromRequest is AddFromRequest for the contents of an uploaded
+// .torrent file, called name in the log.
+func AddMetainfoFromRequest(c *torrent.Client, config *ClientConfig, svc *Services, w http.ResponseWriter, r *http.Request, name string, data []byte, async bool) (*torrent.Torrent, bool) {
+	return addFromRequest(c, config, svc, w, r, name, func() (*torrent.TorrentSpec, error) {
+		mi, err := metainfo.Load(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("error loading torrent metadata: %w", err)
+		}
+		return torrent.TorrentSpecFromMetaInfoErr(mi)
+	}, async)
+}
+
+// addOptions are the add-time options in a request's query.
+type addOptions struct {
+	seed     bool
+	persist  bool
+	storage  string
+	settings TorrentSettings
+}
+
+func parseAddOptions(config *ClientConfig, r *http.Request) (addOptions, error) {
+	var opts addOptions
+	var err error
+	if v := r.URL.Query().Get("persist"); v != "" {
+		if opts.persist, err = strconv.ParseBool(v); err != nil {
+			return opts, errors.New("Invalid persist parameter")
+		}
+	}
+	if opts.settings, err = ParseTorrentSettings(r.URL.Query()); err != nil {
+		return opts, err
+	}
+	opts.storage, opts.settings.Storage = opts.settings.Storage, ""
+	opts.seed = Seeds(config, opts.settings)
+	return opts, nil
+}
+
+// errDraining is returned for torrents added while the server shuts down.
+var errDraining = errors.New("server is shutting down")
+
+// AddGate refuses new torrents while the server shuts down or the disk is
+// below MinFreeSpace, for adds from requests as well as the watch directory,
+// RSS feeds and imports.
+type AddGate struct {
+	disk    *DiskGuard
+	streams *StreamTracker
+}
+
+func NewAddGate(disk *DiskGuard, streams *StreamTracker) *AddGate {
+	return &AddGate{disk: disk, streams: streams}
+}
+
+func (g *AddGate) Check() error {
+	if g.streams.Draining() {
+		return errDraining
+	}
+	return g.disk.Check()
+}
+
+// canAdd reports why u can't add torrents right now, if anything.
+func canAdd(c *torrent.Client, svc *Services, u *User) error {
+	if err := svc.Adds.Check(); err != nil {
+		return err
+	}
+	return svc.Users.CheckStorageQuota(c, u)
+}
+
+// checkCanAdd writes an error response and returns false if u can't add
+// torrents right now.
+func checkCanAdd(c *torrent.Client, svc *Services, w http.ResponseWriter, u *User) bool {
+	err := canAdd(c, svc, u)
+	switch {
+	case errors.Is(err, errDraining):
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Error adding torrent: %v", err), http.StatusInsufficientStorage)
+	}
+	return err == nil
+}
+
+// addSpec adds spec to the client with the add-time options applied.
+func addSpec(c *torrent.Client, config *ClientConfig, svc *Services, id string, spec *torrent.TorrentSpec, opts addOptions) (*torrent.Torrent, bool, error) {
+	svc.InfoCache.Fill(spec)
+
+	// The storage has to be known before the torrent opens it, and can't
+	// change for a torrent that is already open.
+	if _, exists := c.Torrent(spec.InfoHash); !exists && opts.storage != "" {
+		if _, err := svc.Settings.Update(spec.InfoHash.String(), TorrentSettings{Storage: opts.storage}); err != nil {
+			log.Print(err)
+		}
+	}
+
+	log.Printf("Adding torrent: %s", id)
+	t, isNew, err := c.AddTorrentSpec(spec)
+	if err != nil {
+		return nil, false, err
+	}
+	if isNew {
+		ApplyConnLimit(t, config)
+	}
+
+	if !opts.seed {
+		StopSeeding(t)
+	}
+	return t, isNew, nil
+}
+
+// finishAddAsync claims t for u right away, so u can poll its status, and
+// calls finishAdd once the metadata arrives.
+func finishAddAsync(t *torrent.Torrent, config *ClientConfig, svc *Services, u *User, settings TorrentSettings) {
+	if err := svc.Users.AddOwner(u, t.InfoHash().String()); err != nil {
+		log.Print(err)
+	}
+	go func() {
+		select {
+		case <-t.GotInfo():
+			finishAdd(t, config, svc, u, settings)
+		case <-t.Closed():
+		}
+	}()
+}
+
+func addFromRequest(c *torrent.Client, config *ClientConfig, svc *Services, w http.ResponseWriter, r *http.Request, id string, load func() (*torrent.TorrentSpec, error), async bool) (*torrent.Torrent, bool) {
+	opts, err := parseAddOptions(config, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	u := UserFromContext(r.Context())
+	if !checkCanAdd(c, svc, w, u) {
+		return nil, false
+	}
+
+	spec, err := load()
+	if err != nil {
+		log.Printf("error adding torrent: %v", err)
+		http.Error(w, fmt.Sprintf("Error adding torrent: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+
+	t, isNew, err := addSpec(c, config, svc, id, spec, opts)
+	if err != nil {
+		log.Printf("error adding torrent: %v", err)
+		http.Error(w, fmt.Sprintf("Error adding torrent: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if async {
+		finishAddAsync(t, config, svc, u, opts.settings)
+		return t, true
+	}
+
+	if err := awaitAdded(r.Context(), t, isNew, config, svc, u, opts); err != nil {
+		writeInfoError(w, err)
+		return nil, false
+	}
+	return t, true
+}
+
+// Why waitForInfo gave up, besides the context ending.
+var (
+	errMetadataTimeout = errors.New("timed out waiting for torrent metadata")
+	errTorrentClosed   = errors.New("torrent was dropped")
+)
+
+// waitForInfo waits for the torrent's metadata until MetadataTimeout passes,
+// the torrent is dropped or ctx is done.
+func waitForInfo(ctx context.Context, t *torrent.Torrent, config *ClientConfig) error {
+	var timeout <-chan time.Time
+	if config.MetadataTimeout > 0 {
+		timer := time.NewTimer(config.MetadataTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-t.GotInfo():
+		return nil
+	case <-timeout:
+		return errMetadataTimeout
+	case <-t.Closed():
+		return errTorrentClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// awaitAdded waits for the metadata of a torrent u just added, for POST
+// /torrents and the gRPC AddTorrent alike, and finishes the add. If the
+// metadata doesn't arrive, the torrent isn't left behind unless it was
+// already there or asked to stay, and waitForInfo's error is returned.
+func awaitAdded(ctx context.Context, t *torrent.Torrent, isNew bool, config *ClientConfig, svc *Services, u *User, opts addOptions) error {
+	err := waitForInfo(ctx, t, config)
+	switch {
+	case err == nil:
+		finishAdd(t, config, svc, u, opts.settings)
+		return nil
+	case errors.Is(err, errTorrentClosed):
+		// Whoever dropped it cleaned up after it.
+		return err
+	}
+
+	if isNew && !opts.persist {
+		t.Drop()
+		log.Printf("Abandoned torrent: %s", t.InfoHash())
+		if err := svc.Settings.Delete(t.InfoHash().String()); err != nil {
+			log.Print(err)
+		}
+	}
+	return err
+}
+
+// awaitInfo waits for the torrent's metadata like waitForInfo, answering the
+// request when it gives up.
+func awaitInfo(w http.ResponseWriter, r *http.Request, t *torrent.Torrent, config *ClientConfig) bool {
+	err := waitForInfo(r.Context(), t, config)
+	if err != nil {
+		writeInfoError(w, err)
+	}
+	return err == nil
+}
+
+// writeInfoError answers a request whose torrent's metadata didn't arrive. A
+// timeout is answered with 504 and a Retry-After hint, as the metadata may
+// still arrive from peers found later. Nothing is written if the client hung
+// up.
+func writeInfoError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errMetadataTimeout):
+		w.Header().Set("Retry-After", strconv.Itoa(int(metadataRetryAfter.Seconds())))
+		http.Error(w, "Timed out waiting for torrent metadata", http.StatusGatewayTimeout)
+	case errors.Is(err, errTorrentClosed):
+		http.Error(w, "Torrent not found", http.StatusNotFound)
+	}
+}
+
+// finishAdd records a torrent added by u once its metadata is known.
+func finishAdd(t *torrent.Torrent, config *ClientConfig, svc *Services, u *User, settings TorrentSettings) {
+	if err := svc.Users.AddOwner(u, t.InfoHash().String()); err != nil {
+		log.Print(err)
+	}
+	if _, err := svc.Settings.Update(t.InfoHash().String(), settings); err != nil {
+		log.Print(err)
+	}
+
+	if config.ResumeTorrents {
 		if err := saveTorrentFile(config, t); err != nil {
 			log.Print(err)
 		}
+	}
+}
 
-	})
+// AddedTorrent is the JSON answer to adding a torrent, its playlist being
+// what is returned otherwise.
+type AddedTorrent struct {
+	TorrentInfo
+	Playlist string
+}
+
+// DescribeTorrent returns t's TorrentInfo as listed by GET /torrents.
+func DescribeTorrent(t *torrent.Torrent, config *ClientConfig, svc *Services, u *User, archives []Archive) (TorrentInfo, error) {
+	ih := t.InfoHash().String()
+	torrentInfo := TorrentInfo{Name: t.Name(), InfoHash: ih, Files: []FileInfo{}}
+	if t.Info() != nil {
+		var err error
+		if torrentInfo, err = WrapTorrent(t, config, u, archives); err != nil {
+			return TorrentInfo{}, err
+		}
+	}
+
+	settings := svc.Settings.Get(ih)
+	torrentInfo.Stale = svc.Resumer.IsStale(ih)
+	torrentInfo.Paused = settings.Paused
+	if settings.Label != nil {
+		torrentInfo.Label = *settings.Label
+	}
+	torrentInfo.Added = svc.Session.Added(ih)
+	return torrentInfo, nil
+}
+
+func WriteAddedTorrent(w http.ResponseWriter, t *torrent.Torrent, config *ClientConfig, svc *Services, u *User, opts PlaylistOptions) {
+	archives := svc.Archives.Get(t)
+	torrentInfo, err := DescribeTorrent(t, config, svc, u, archives)
+	if err != nil {
+		log.Printf("error describing torrent: %v", err)
+		http.Error(w, fmt.Sprintf("Error describing torrent: %v", err), http.StatusInternalServerError)
+		return
+	}
+	playlist, err := BuildPlaylist(t, config, u, opts, archives)
+	if err != nil {
+		log.Printf("error building playlist: %v", err)
+		http.Error(w, fmt.Sprintf("Error building playlist: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	parsed, err := json.Marshal(AddedTorrent{TorrentInfo: torrentInfo, Playlist: playlist})
+	if err != nil {
+		log.Printf("error encoding JSON response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+	w.Write(parsed)
 }
 
-func HandleGetInfoHash(c *torrent.Client, config *ClientConfig) http.Handler {
+func WritePlaylist(w http.ResponseWriter, t *torrent.Torrent, config *ClientConfig, u *User, opts PlaylistOptions, archives []Archive) {
+	playlist, err := BuildPlaylist(t, config, u, opts, archives)
+	if err != nil {
+		log.Printf("error building playlist: %v", err)
+		http.Error(w, fmt.Sprintf("Error building playlist: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	fmt.Fprint(w, playlist)
+}
+
+func HandleGetInfoHash(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ih := infohash.FromHexString(r.PathValue("infohash"))
+		ih, ok := ParseInfoHashParam(w, r)
+		if !ok {
+			return
+		}
+
+		opts, err := ParsePlaylistOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		t, ok := c.Torrent(ih)
+		u := UserFromContext(r.Context())
 
-		if !ok {
+		if !ok || !svc.Users.CanAccess(u, ih.String()) {
 			http.Error(w, "Torrent not found", http.StatusNotFound)
 			return
 		}
+		if svc.Resumer.IsStale(ih.String()) {
+			http.Error(w, "Torrent metadata unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if !awaitInfo(w, r, t, config) {
+			return
+		}
 
-		playlist, err := BuildPlaylist(t, config)
+		playlist, err := BuildPlaylist(t, config, u, opts, svc.Archives.Get(t))
 		if err != nil {
 			log.Printf("error building playlist: %v", err)
 			http.Error(w, fmt.Sprintf("Error building playlist %v", err), http.StatusInternalServerError)
@@ -95,87 +657,288 @@ func HandleGetInfoHash(c *torrent.Client, config *ClientConfig) http.Handler {
 	})
 }
 
-func HandleDeleteInfoHash(c *torrent.Client, config *ClientConfig) http.Handler {
+func HandleDeleteInfoHash(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ih := infohash.FromHexString(r.PathValue("infohash"))
-		t, ok := c.Torrent(ih)
+		ih, ok := ParseInfoHashParam(w, r)
 		if !ok {
+			return
+		}
+		t, ok := c.Torrent(ih)
+		u := UserFromContext(r.Context())
+		if !ok || !svc.Users.CanAccess(u, ih.String()) {
 			http.Error(w, "Torrent not found", http.StatusNotFound)
 			return
 		}
-		defer func() {
-			t.Drop()
-			log.Printf("Dropped torrent: %s", t.Name())
-		}()
 
-		w.WriteHeader(http.StatusNoContent)
-		w.Header().Set("Content-Length", "0")
+		var drain bool
+		var err error
+		if v := r.URL.Query().Get("drain"); v != "" {
+			if drain, err = strconv.ParseBool(v); err != nil {
+				http.Error(w, "Invalid drain parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		timeout := defaultDrainTimeout
+		if v := r.URL.Query().Get("timeout"); v != "" {
+			if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+				http.Error(w, "Invalid timeout parameter", http.StatusBadRequest)
+				return
+			}
+		}
 
-		if !config.DeleteDataOnTorrentDrop {
+		unowned, err := svc.Users.RemoveOwner(u, ih.String())
+		if err != nil {
+			log.Print(err)
+		}
+		if !unowned {
+			// Other users still want this torrent, only our claim goes away.
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 
-		sq, err := squirrel.NewCache(createDBOptions(config))
-		if err != nil {
-			log.Printf("error opening database: %v", err)
+		if !drain {
+			w.WriteHeader(http.StatusNoContent)
+			w.Header().Set("Content-Length", "0")
+			DropTorrent(t, config, svc)
 			return
 		}
-		defer sq.Close()
 
-		err = sq.Tx(func(tx *squirrel.Tx) error {
-			for i := range t.NumPieces() {
-				p := t.Piece(i)
-				piece_hash := p.Info().V1Hash().Value.HexString()
-				err := tx.Delete(piece_hash)
-				if err != nil && !errors.Is(err, squirrel.ErrNotFound) {
-					return fmt.Errorf("error deleting piece: %w", err)
-				}
+		// Let open streams finish before their data disappears.
+		w.WriteHeader(http.StatusAccepted)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if err := svc.Streams.Wait(ctx, ih.String()); err != nil {
+				log.Printf("Dropping torrent %s with streams still open", t.Name())
 			}
-			return nil
-		})
+			DropTorrent(t, config, svc)
+		}()
+	})
+}
 
-		if err != nil {
-			log.Printf("error deleting torrent data: %v", err)
+// DropTorrent removes t from the client, along with its data when
+// DeleteDataOnTorrentDrop is set.
+func DropTorrent(t *torrent.Torrent, config *ClientConfig, svc *Services) {
+	ih := t.InfoHash()
+	defer func() {
+		svc.Readers.DropTorrent(t)
+		t.Drop()
+		log.Printf("Dropped torrent: %s", t.Name())
+		// Files can only be removed once the storage has closed them.
+		if config.DeleteDataOnTorrentDrop && svc.Settings.Get(ih.String()).Storage == storageFile && t.Info() != nil {
+			if err := deleteTorrentFiles(config, t.Info()); err != nil {
+				log.Printf("error deleting torrent data: %v", err)
+			}
+		}
+		if err := svc.Settings.Delete(ih.String()); err != nil {
+			log.Print(err)
 		}
+		svc.Session.Forget(ih.String())
+		svc.InfoCache.Forget(ih)
+	}()
 
-		err = os.Remove(filepath.Join(config.DownloadDir, "torrents", fmt.Sprintf("%s.torrent", t.Name())))
-		if err != nil && !os.IsNotExist(err) {
-			log.Printf("error deleting torrent file: %v", err)
+	if !config.DeleteDataOnTorrentDrop {
+		return
+	}
+
+	sq, err := squirrel.NewCache(createDBOptions(config))
+	if err != nil {
+		log.Printf("error opening database: %v", err)
+		return
+	}
+	defer sq.Close()
+
+	err = sq.Tx(func(tx *squirrel.Tx) error {
+		for i := range t.NumPieces() {
+			p := t.Piece(i)
+			piece_hash := p.Info().V1Hash().Value.HexString()
+			err := tx.Delete(piece_hash)
+			if err != nil && !errors.Is(err, squirrel.ErrNotFound) {
+				return fmt.Errorf("error deleting piece: %w", err)
+			}
 		}
+		return nil
 	})
+
+	if err != nil {
+		log.Printf("error deleting torrent data: %v", err)
+	}
+
+	if err := removeTorrentFile(config, ih); err != nil {
+		log.Print(err)
+	}
 }
 
-func HandleGetInfoHashFile(c *torrent.Client, config *ClientConfig) http.Handler {
+func HandleGetInfoHashFile(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ih := infohash.FromHexString(r.PathValue("infohash"))
+		ih, ok := ParseInfoHashParam(w, r)
+		if !ok {
+			return
+		}
 		query := r.PathValue("query")
 
 		t, ok := c.Torrent(ih)
-		if !ok {
+		u := UserFromContext(r.Context())
+		if !ok || !svc.Users.CanAccess(u, ih.String()) {
 			http.Error(w, "Torrent not found", http.StatusNotFound)
 			return
 		}
+		if !awaitInfo(w, r, t, config) {
+			return
+		}
 
 		for _, file := range t.Files() {
 			if file.DisplayPath() == query {
-				reader := file.NewReader()
-				defer reader.Close()
+				if file.BytesCompleted() < file.Length() {
+					if err := svc.Users.CheckStorageQuota(c, u); err != nil {
+						http.Error(w, err.Error(), http.StatusInsufficientStorage)
+						return
+					}
+				}
 
-				if config.Responsive {
-					reader.SetResponsive()
+				tw, err := svc.Users.ThrottleWriter(r.Context(), w, u)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusTooManyRequests)
+					return
 				}
-				if config.Readahead >= 0 {
-					reader.SetReadahead(config.Readahead)
+
+				// A player's range requests share readers, so one that
+				// seeks back or reconnects finds its readahead warm.
+				client := readerPoolClient(r)
+				reader := svc.Readers.Get(client, file, rangeStart(r), StreamReadahead(config, svc.Settings.Get(ih.String()), query))
+				configure := func() { ConfigureReader(reader, config, svc.Settings.Get(ih.String()), query) }
+				configure()
+				defer svc.Streams.Start(ih.String(), configure)()
+
+				var stream io.ReadSeeker = ContextReader{reader, r.Context()}
+				// A readahead set for the torrent is left alone.
+				if config.AdaptiveReadahead > 0 && svc.Settings.Get(ih.String()).Readahead == nil {
+					stream = NewAdaptiveReader(stream, reader, config.AdaptiveReadahead)
 				}
-				http.ServeContent(w, r, query, time.Unix(t.Metainfo().CreationDate, 0), reader)
+				window := svc.Priorities.Track(stream, file)
+				defer func() { svc.Readers.Put(client, file, reader, window.pos) }()
+				defer window.Close()
+
+				setStreamCacheHeaders(w, u, ih.String(), file.Length(), query)
+				http.ServeContent(tw, r, query, time.Unix(t.Metainfo().CreationDate, 0), NewMeteredReader(window, file))
 				return
 			}
 		}
 
+		if entry, ok := svc.Archives.Entry(t, query); ok {
+			serveArchiveEntry(w, r, c, t, entry, config, svc)
+			return
+		}
+
 		http.Error(w, "File not found", http.StatusNotFound)
 	})
 }
 
+// serveArchiveEntry streams a file stored in an archive from the volumes
+// holding its data.
+func serveArchiveEntry(w http.ResponseWriter, r *http.Request, c *torrent.Client, t *torrent.Torrent, entry ArchiveEntry, config *ClientConfig, svc *Services) {
+	u := UserFromContext(r.Context())
+	if entry.BytesCompleted() < entry.Size {
+		if err := svc.Users.CheckStorageQuota(c, u); err != nil {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+	}
+	tw, err := svc.Users.ThrottleWriter(r.Context(), w, u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	ih := t.InfoHash().String()
+	reader := newSegmentReader(r.Context(), config, svc.Settings.Get(ih), entry.segments)
+	defer reader.Close()
+	defer svc.Streams.Start(ih, reader.Reconfigure)()
+
+	setStreamCacheHeaders(w, u, ih, entry.Size, entry.Path)
+	http.ServeContent(tw, r, entry.Path, time.Unix(t.Metainfo().CreationDate, 0), reader)
+}
+
+// streamMaxAge is how long players and browsers may cache streams. A
+// torrent's content never changes, so it is as long as allowed.
+const streamMaxAge = 365 * 24 * time.Hour
+
+// setStreamCacheHeaders sets a strong ETag built from the infohash and the
+// streamed files, which ServeContent then checks If-None-Match and If-Range
+// against, and marks the stream immutable. Streams are private once users
+// have to authenticate.
+func setStreamCacheHeaders(w http.ResponseWriter, u *User, infoHash string, length int64, paths ...string) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d", infoHash, length)
+	for _, p := range paths {
+		fmt.Fprintf(h, "\n%s", p)
+	}
+	w.Header().Set("ETag", `"`+hex.EncodeToString(h.Sum(nil)[:16])+`"`)
+
+	cacheControl := fmt.Sprintf("max-age=%d, immutable", int(streamMaxAge.Seconds()))
+	if u != nil {
+		cacheControl = "private, " + cacheControl
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+}
+
+// ConfigureReader applies the streaming options for a file, with the
+// torrent's own settings taking precedence over the configuration.
+func ConfigureReader(reader torrent.Reader, config *ClientConfig, settings TorrentSettings, name string) {
+	configMu.RLock()
+	responsive := config.Responsive
+	configMu.RUnlock()
+
+	if settings.Responsive != nil {
+		responsive = *settings.Responsive
+	}
+	// Readers can't be made unresponsive again once set.
+	if responsive {
+		reader.SetResponsive()
+	}
+
+	if readahead := StreamReadahead(config, settings, name); readahead >= 0 {
+		reader.SetReadahead(readahead)
+	}
+}
+
+// StreamReadahead is the readahead for streaming the file called name, or
+// negative to leave the client's default.
+func StreamReadahead(config *ClientConfig, settings TorrentSettings, name string) int64 {
+	if settings.Readahead != nil {
+		return *settings.Readahead
+	}
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return ReadaheadFor(config, name)
+}
+
+// ReadaheadFor picks the readahead preset matching the file's MIME type,
+// either exactly ("audio/flac") or by class ("audio"), falling back to the
+// global Readahead.
+func ReadaheadFor(config *ClientConfig, name string) int64 {
+	mimeType, _, _ := strings.Cut(mime.TypeByExtension(filepath.Ext(name)), ";")
+	if readahead, ok := config.ReadaheadByType[mimeType]; ok {
+		return readahead
+	}
+	class, _, _ := strings.Cut(mimeType, "/")
+	if readahead, ok := config.ReadaheadByType[class]; ok {
+		return readahead
+	}
+	return config.Readahead
+}
+
+// ContextReader makes reads give up when ctx is done instead of waiting for
+// pieces nobody is going to consume.
+type ContextReader struct {
+	torrent.Reader
+	ctx context.Context
+}
+
+func (r ContextReader) Read(b []byte) (int, error) {
+	return r.ReadContext(r.ctx, b)
+}
+
 func HandleExit(cancel context.CancelFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusAccepted)
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseInfoHashParam(t *testing.T) {
+	for _, tc := range []struct {
+		param string
+		ok    bool
+	}{
+		{testInfoHash, true},
+		{strings.ToUpper(testInfoHash), true},
+		{strings.Repeat("ab", 32), true}, // v2
+		{"", false},
+		{testInfoHash[:39], false},
+		{testInfoHash + "0", false},
+		{strings.Repeat("zz", 20), false},
+		{"magnet:?xt=urn:btih:" + testInfoHash, false},
+	} {
+		r := httptest.NewRequest("GET", "/torrents/x", nil)
+		r.SetPathValue("infohash", tc.param)
+		w := httptest.NewRecorder()
+		ih, ok := ParseInfoHashParam(w, r)
+		if ok != tc.ok {
+			t.Errorf("ParseInfoHashParam(%q) ok = %v, want %v", tc.param, ok, tc.ok)
+			continue
+		}
+		if !ok {
+			var body struct{ Error string }
+			if w.Code != http.StatusBadRequest || json.Unmarshal(w.Body.Bytes(), &body) != nil || body.Error == "" {
+				t.Errorf("ParseInfoHashParam(%q) answered %d %q, want a 400 JSON error", tc.param, w.Code, w.Body)
+			}
+			continue
+		}
+		// v2 infohashes are truncated to the v1 length, as the client does.
+		if want := strings.ToLower(tc.param[:40]); ih.HexString() != want {
+			t.Errorf("ParseInfoHashParam(%q) = %s, want %s", tc.param, ih.HexString(), want)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+const (
+	hlsPlaylist       = "index.m3u8"
+	hlsSegmentTime    = 6 // seconds
+	hlsStartTimeout   = 30 * time.Second
+	hlsIdleTimeout    = 2 * time.Minute
+	hlsPlaylistPoll   = 250 * time.Millisecond
+	hlsContentType    = "application/vnd.apple.mpegurl"
+	hlsSegmentPattern = "seg%05d.ts"
+)
+
+// HLSManager runs one ffmpeg process per streamed file, writing HLS segments
+// to CacheDir/hls. ffmpeg reads the file back from this server, so it gets
+// the same prioritization as any other stream. Sessions nobody has requested
+// for hlsIdleTimeout are stopped and their segments deleted, the rest when
+// the server shuts down.
+type HLSManager struct {
+	ffmpeg string
+	dir    string
+	host   net.IP
+	port   int
+
+	mu       sync.Mutex
+	sessions map[string]*hlsSession
+}
+
+type hlsSession struct {
+	dir      string
+	cancel   context.CancelFunc
+	done     chan struct{}
+	err      error // set before done is closed
+	lastUsed time.Time
+}
+
+func NewHLSManager(ctx context.Context, config *ClientConfig) *HLSManager {
+	m := &HLSManager{
+		ffmpeg:   config.FFmpegPath,
+		dir:      filepath.Join(config.CacheDir, "hls"),
+		host:     loopbackHost(config),
+		port:     config.Port,
+		sessions: make(map[string]*hlsSession),
+	}
+	// Segments left behind by a server that didn't shut down cleanly.
+	if err := os.RemoveAll(m.dir); err != nil {
+		log.Printf("error removing HLS segments: %v", err)
+	}
+	go m.reap(ctx)
+	return m
+}
+
+// session returns the running session for the file, starting ffmpeg if
+// there is none. remux copies the streams instead of transcoding them to
+// H.264 and AAC.
+func (m *HLSManager) session(f *torrent.File, u *User, remux bool) (*hlsSession, error) {
+	key := f.Torrent().InfoHash().String() + "/" + f.DisplayPath()
+	if remux {
+		key += "?remux"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[key]; ok {
+		select {
+		case <-s.done:
+			// ffmpeg finished; its segments stay valid unless it failed.
+			if s.err == nil {
+				s.lastUsed = time.Now()
+				return s, nil
+			}
+			os.RemoveAll(s.dir)
+			delete(m.sessions, key)
+		default:
+			s.lastUsed = time.Now()
+			return s, nil
+		}
+	}
+
+	// Every session gets its own directory, as a stopped session's segments
+	// are deleted after it leaves the map.
+	if err := os.MkdirAll(m.dir, 0o777); err != nil {
+		return nil, fmt.Errorf("error creating HLS directory: %w", err)
+	}
+	sum := sha1.Sum([]byte(key))
+	dir, err := os.MkdirTemp(m.dir, hex.EncodeToString(sum[:8])+"-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating HLS directory: %w", err)
+	}
+
+	codecs := []string{"-c:v", "libx264", "-preset", "veryfast", "-c:a", "aac", "-ac", "2"}
+	if remux {
+		codecs = []string{"-c", "copy"}
+	}
+	args := []string{"-nostdin", "-loglevel", "error", "-i", BuildUrl(f, m.host, m.port, u), "-map", "0:v:0", "-map", "0:a:0?"}
+	args = append(args, codecs...)
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(hlsSegmentTime),
+		"-hls_list_size", "0",
+		"-hls_playlist_type", "event",
+		"-hls_segment_filename", filepath.Join(dir, hlsSegmentPattern),
+		filepath.Join(dir, hlsPlaylist),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, m.ffmpeg, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		cancel()
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("error starting ffmpeg: %w", err)
+	}
+	log.Printf("Started HLS session for %s", f.DisplayPath())
+
+	s := &hlsSession{dir: dir, cancel: cancel, done: make(chan struct{}), lastUsed: time.Now()}
+	go func() {
+		if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+			s.err = fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+			log.Print(s.err)
+		}
+		close(s.done)
+	}()
+	m.sessions[key] = s
+	return s, nil
+}
+
+func (m *HLSManager) reap(ctx context.Context) {
+	ticker := time.NewTicker(hlsIdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var idle []*hlsSession
+			m.mu.Lock()
+			for key, s := range m.sessions {
+				if time.Since(s.lastUsed) > hlsIdleTimeout {
+					idle = append(idle, s)
+					delete(m.sessions, key)
+				}
+			}
+			m.mu.Unlock()
+			stopHLSSessions(idle)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close stops every session and deletes the segments.
+func (m *HLSManager) Close() {
+	var sessions []*hlsSession
+	m.mu.Lock()
+	for key, s := range m.sessions {
+		sessions = append(sessions, s)
+		delete(m.sessions, key)
+	}
+	m.mu.Unlock()
+	stopHLSSessions(sessions)
+}
+
+// stopHLSSessions stops ffmpeg and deletes the segments of sessions already
+// removed from the manager. It waits for ffmpeg to exit, so it's called
+// without holding the manager's lock.
+func stopHLSSessions(sessions []*hlsSession) {
+	for _, s := range sessions {
+		s.cancel()
+	}
+	for _, s := range sessions {
+		<-s.done
+		if err := os.RemoveAll(s.dir); err != nil {
+			log.Printf("error removing HLS segments: %v", err)
+		}
+	}
+}
+
+// waitPlaylist blocks until ffmpeg has written the first segment.
+func (s *hlsSession) waitPlaylist(ctx context.Context) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, hlsStartTimeout)
+	defer cancel()
+	ticker := time.NewTicker(hlsPlaylistPoll)
+	defer ticker.Stop()
+
+	for {
+		data, err := os.ReadFile(filepath.Join(s.dir, hlsPlaylist))
+		if err == nil {
+			return data, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			if s.err != nil {
+				return nil, s.err
+			}
+			return nil, errors.New("ffmpeg exited without writing a playlist")
+		case <-ctx.Done():
+			return nil, errors.New("timed out waiting for ffmpeg")
+		}
+	}
+}
+
+// HandleGetHLS serves GET /hls/{infohash}/{file}/index.m3u8 and the segments
+// it lists. ?remux=true repackages the original streams instead of
+// transcoding, which is much cheaper when the device supports the codecs.
+func HandleGetHLS(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ih, ok := ParseInfoHashParam(w, r)
+		if !ok {
+			return
+		}
+		name, resource := path.Split(r.PathValue("query"))
+		name = strings.TrimSuffix(name, "/")
+
+		t, ok := c.Torrent(ih)
+		u := UserFromContext(r.Context())
+		if !ok || !svc.Users.CanAccess(u, ih.String()) {
+			http.Error(w, "Torrent not found", http.StatusNotFound)
+			return
+		}
+		if !awaitInfo(w, r, t, config) {
+			return
+		}
+
+		var file *torrent.File
+		for _, f := range t.Files() {
+			if f.DisplayPath() == name {
+				file = f
+				break
+			}
+		}
+		if file == nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		remux, _ := strconv.ParseBool(r.URL.Query().Get("remux"))
+		s, err := svc.HLS.session(file, u, remux)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if resource != hlsPlaylist {
+			var n int
+			if _, err := fmt.Sscanf(resource, hlsSegmentPattern, &n); err != nil || fmt.Sprintf(hlsSegmentPattern, n) != resource {
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "video/mp2t")
+			http.ServeFile(w, r, filepath.Join(s.dir, resource))
+			return
+		}
+
+		playlist, err := s.waitPlaylist(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		playlist = rewriteHLSPlaylist(playlist, r.URL.Query())
+
+		w.Header().Set("Content-Type", hlsContentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(playlist)))
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(playlist)
+	})
+}
+
+// rewriteHLSPlaylist carries the token and remux parameters over to the
+// segment URLs, which players resolve relative to the playlist without its
+// query string.
+func rewriteHLSPlaylist(playlist []byte, query url.Values) []byte {
+	params := url.Values{}
+	for _, key := range []string{"token", "remux"} {
+		if v := query.Get(key); v != "" {
+			params.Set(key, v)
+		}
+	}
+	if len(params) == 0 {
+		return playlist
+	}
+
+	var b strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(string(playlist)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" && !strings.HasPrefix(line, "#") {
+			line += "?" + params.Encode()
+		}
+		b.WriteString(line + "\n")
+	}
+	return []byte(b.String())
+}
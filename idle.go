@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// IdleTimer shuts the server down once no request has arrived and no stream
+// has been open for the timeout, so the process doesn't outlive the player.
+type IdleTimer struct {
+	timeout time.Duration
+	streams *StreamTracker
+	last    atomic.Int64 // unix nanoseconds of the last request activity
+}
+
+func NewIdleTimer(timeout time.Duration, streams *StreamTracker) *IdleTimer {
+	if timeout <= 0 {
+		return nil
+	}
+	t := &IdleTimer{timeout: timeout, streams: streams}
+	t.touch()
+	return t
+}
+
+func (t *IdleTimer) touch() {
+	t.last.Store(time.Now().UnixNano())
+}
+
+// Middleware counts every request as activity, both when it arrives and when
+// it finishes.
+func (t *IdleTimer) Middleware(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.touch()
+		defer t.touch()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Run calls cancel when the server has been idle for the timeout.
+func (t *IdleTimer) Run(ctx context.Context, cancel context.CancelFunc) {
+	ticker := time.NewTicker(max(t.timeout/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if t.streams.Count() > 0 {
+				t.touch()
+				continue
+			}
+			if idle := time.Since(time.Unix(0, t.last.Load())); idle >= t.timeout {
+				log.Printf("Idle for %s, shutting down", idle.Round(time.Second))
+				cancel()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
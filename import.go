@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Uploaded archives larger than this are rejected.
+const maxImportArchiveSize = 64 << 20
+
+type ImportRequest struct {
+	Path string
+}
+
+type ImportResult struct {
+	File     string
+	InfoHash string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+// ImportTorrent adds a single .torrent file's contents to the client and
+// saves it for resuming like torrents added through POST /torrents.
+func ImportTorrent(c *torrent.Client, config *ClientConfig, adds *AddGate, r io.Reader) (*torrent.Torrent, error) {
+	if err := adds.Check(); err != nil {
+		return nil, err
+	}
+	mi, err := metainfo.Load(r)
+	if err != nil {
+		return nil, fmt.Errorf("error loading torrent metadata: %w", err)
+	}
+
+	t, err := c.AddTorrent(mi)
+	if err != nil {
+		return nil, err
+	}
+	ApplyConnLimit(t, config)
+	if config.NoSeed {
+		StopSeeding(t)
+	}
+	if config.ResumeTorrents {
+		if err := saveTorrentFile(config, t); err != nil {
+			log.Print(err)
+		}
+	}
+	return t, nil
+}
+
+func importDirectory(c *torrent.Client, config *ClientConfig, adds *AddGate, dir string) ([]ImportResult, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading import directory: %w", err)
+	}
+
+	results := make([]ImportResult, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !isMatched(torrentPattern, e.Name()) {
+			continue
+		}
+		results = append(results, importOne(e.Name(), func() (*torrent.Torrent, error) {
+			f, err := os.Open(filepath.Join(dir, e.Name()))
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			return ImportTorrent(c, config, adds, f)
+		}))
+	}
+	return results, nil
+}
+
+func importArchive(c *torrent.Client, config *ClientConfig, adds *AddGate, archive []byte) ([]ImportResult, error) {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive: %w", err)
+	}
+
+	results := make([]ImportResult, 0, len(zr.File))
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() || !isMatched(torrentPattern, zf.Name) {
+			continue
+		}
+		results = append(results, importOne(zf.Name, func() (*torrent.Torrent, error) {
+			f, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			return ImportTorrent(c, config, adds, f)
+		}))
+	}
+	return results, nil
+}
+
+func importOne(name string, add func() (*torrent.Torrent, error)) ImportResult {
+	t, err := add()
+	if err != nil {
+		log.Printf("error importing %s: %v", name, err)
+		return ImportResult{File: name, Error: err.Error()}
+	}
+	log.Printf("Imported torrent: %s", t.Name())
+	return ImportResult{File: name, InfoHash: t.InfoHash().String()}
+}
+
+// HandleImportTorrents loads every .torrent file in a server side directory
+// (authenticated admins only, sent as JSON) or an uploaded zip archive,
+// reporting the outcome per file.
+func HandleImportTorrents(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := UserFromContext(r.Context())
+		if !checkCanAdd(c, svc, w, u) {
+			return
+		}
+
+		var (
+			results []ImportResult
+			err     error
+		)
+		// Both branches need a content type a plain form can't send, so a
+		// cross-site page can't post here without a CORS preflight.
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/zip":
+			archive, readErr := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportArchiveSize))
+			if readErr != nil {
+				http.Error(w, "Bad request", http.StatusBadRequest)
+				return
+			}
+			results, err = importArchive(c, config, svc.Adds, archive)
+		case "application/json":
+			// Reading server directories is only for admins who logged in;
+			// without UsersFile or ApiToken anyone could list the disk.
+			if svc.Users == nil || u == nil || !u.Admin {
+				http.Error(w, "Forbidden, importing a server directory needs an admin with UsersFile or ApiToken", http.StatusForbidden)
+				return
+			}
+			var req ImportRequest
+			if decodeErr := json.NewDecoder(r.Body).Decode(&req); decodeErr != nil || req.Path == "" {
+				http.Error(w, "Bad request", http.StatusBadRequest)
+				return
+			}
+			results, err = importDirectory(c, config, svc.Adds, req.Path)
+		default:
+			http.Error(w, "Content-Type must be application/zip or application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			log.Printf("error importing torrents: %v", err)
+			http.Error(w, fmt.Sprintf("Error importing torrents: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		for _, result := range results {
+			if result.InfoHash == "" {
+				continue
+			}
+			if err := svc.Users.AddOwner(u, result.InfoHash); err != nil {
+				log.Print(err)
+			}
+		}
+
+		parsed, err := json.Marshal(results)
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		w.Write(parsed)
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const (
+	infoCacheInterval = 10 * time.Second
+	infoCacheIndexKey = "info-index"
+	// Past this many infos the least recently used ones are deleted.
+	maxInfoCacheEntries = 1000
+)
+
+// InfoCache keeps the info dictionary of every torrent that got one, whether
+// or not ResumeTorrents is set, so a magnet added again starts with its
+// metadata instead of waiting for peers to send it. Infos of dropped
+// torrents are forgotten, and the rest are kept for the
+// maxInfoCacheEntries torrents added most recently.
+type InfoCache struct {
+	meta *MetadataStore
+
+	mu    sync.Mutex
+	used  map[string]time.Time   // when each stored info was last saved or filled in
+	saved map[metainfo.Hash]bool // loaded torrents whose info is stored
+}
+
+func NewInfoCache(meta *MetadataStore) *InfoCache {
+	ic := &InfoCache{meta: meta, saved: make(map[metainfo.Hash]bool)}
+	if _, err := meta.Get(infoCacheIndexKey, &ic.used); err != nil {
+		log.Print(err)
+	}
+	if ic.used == nil {
+		ic.used = make(map[string]time.Time)
+	}
+	return ic
+}
+
+func infoCacheKey(ih metainfo.Hash) string {
+	return "info/" + ih.HexString()
+}
+
+// Fill sets the spec's info from the cache if it has none.
+func (ic *InfoCache) Fill(spec *torrent.TorrentSpec) {
+	if len(spec.InfoBytes) > 0 {
+		return
+	}
+	var infoBytes []byte
+	ok, err := ic.meta.Get(infoCacheKey(spec.InfoHash), &infoBytes)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	// Guard against a corrupted entry, which the client would reject.
+	if ok && metainfo.HashBytes(infoBytes) == spec.InfoHash {
+		spec.InfoBytes = infoBytes
+		ic.mu.Lock()
+		defer ic.mu.Unlock()
+		ic.used[spec.InfoHash.HexString()] = time.Now()
+		if err := ic.saveIndex(); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// Forget deletes the info of a torrent that was dropped.
+func (ic *InfoCache) Forget(ih metainfo.Hash) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	delete(ic.saved, ih)
+	if _, ok := ic.used[ih.HexString()]; !ok {
+		return
+	}
+	delete(ic.used, ih.HexString())
+	if err := ic.meta.Delete(infoCacheKey(ih)); err != nil {
+		log.Print(err)
+	}
+	if err := ic.saveIndex(); err != nil {
+		log.Print(err)
+	}
+}
+
+// Run saves the info of torrents as their metadata arrives until ctx is done.
+func (ic *InfoCache) Run(ctx context.Context, c *torrent.Client) {
+	ticker := time.NewTicker(infoCacheInterval)
+	defer ticker.Stop()
+
+	for {
+		ic.save(c.Torrents())
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (ic *InfoCache) save(torrents []*torrent.Torrent) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	loaded := make(map[metainfo.Hash]bool, len(torrents))
+	var changed bool
+	for _, t := range torrents {
+		ih := t.InfoHash()
+		loaded[ih] = true
+		if ic.saved[ih] || t.Info() == nil {
+			continue
+		}
+		if err := ic.meta.Put(infoCacheKey(ih), t.Metainfo().InfoBytes); err != nil {
+			log.Print(err)
+			continue
+		}
+		ic.saved[ih] = true
+		ic.used[ih.HexString()] = time.Now()
+		changed = true
+	}
+	for ih := range ic.saved {
+		if !loaded[ih] {
+			delete(ic.saved, ih)
+		}
+	}
+	if !changed {
+		return
+	}
+
+	if excess := len(ic.used) - maxInfoCacheEntries; excess > 0 {
+		oldest := make([]string, 0, len(ic.used))
+		for hex := range ic.used {
+			oldest = append(oldest, hex)
+		}
+		sort.Slice(oldest, func(i, j int) bool { return ic.used[oldest[i]].Before(ic.used[oldest[j]]) })
+		for _, hex := range oldest[:excess] {
+			ih := metainfo.NewHashFromHex(hex)
+			if err := ic.meta.Delete(infoCacheKey(ih)); err != nil {
+				log.Print(err)
+				continue
+			}
+			delete(ic.used, hex)
+			delete(ic.saved, ih)
+		}
+	}
+	if err := ic.saveIndex(); err != nil {
+		log.Print(err)
+	}
+}
+
+func (ic *InfoCache) saveIndex() error {
+	return ic.meta.Put(infoCacheIndexKey, ic.used)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// appID identifies this server in GET /id responses, so a port probe can tell
+// another go_torrent_mpv instance apart from an unrelated program.
+const appID = "go_torrent_mpv"
+
+const instanceProbeTimeout = 2 * time.Second
+
+type InstanceID struct {
+	App string
+	PID int
+}
+
+func HandleGetID() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parsed, err := json.Marshal(InstanceID{App: appID, PID: os.Getpid()})
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(parsed)
+	})
+}
+
+// CheckRunningInstance asks whatever listens on the HTTP port to identify
+// itself and fails only if it is another instance of this server. Anything
+// else on the port is left for the listener to report.
+func CheckRunningInstance(config *ClientConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), instanceProbeTimeout)
+	defer cancel()
+	scheme, client := "http", http.DefaultClient
+	if TLSEnabled(config) {
+		// Only asks our own port to identify itself, whatever certificate
+		// it serves.
+		scheme = "https"
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/id", scheme, net.JoinHostPort(loopbackHost(config).String(), strconv.Itoa(config.Port))), nil)
+	if err != nil {
+		return err
+	}
+	if config.ApiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config.ApiToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	var id InstanceID
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&id) != nil || id.App != appID {
+		return nil
+	}
+	return fmt.Errorf("server already running on port %d (pid %d)", config.Port, id.PID)
+}
+
+// InstanceLock is an exclusive lock on DownloadDir held for the lifetime of
+// the server, so two instances never share the same database and files.
+type InstanceLock struct {
+	f *os.File
+}
+
+func AcquireInstanceLock(config *ClientConfig) (*InstanceLock, error) {
+	if err := os.MkdirAll(config.DownloadDir, 0o777); err != nil {
+		return nil, fmt.Errorf("error creating download directory: %w", err)
+	}
+	path := filepath.Join(config.DownloadDir, "lock")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file: %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("another instance is using %s: %w", config.DownloadDir, err)
+	}
+
+	// The PID is informational, the lock itself is what counts.
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	return &InstanceLock{f: f}, nil
+}
+
+// Release drops the lock. The file is left behind since removing it could
+// race with the next instance locking it.
+func (l *InstanceLock) Release() {
+	if err := unlockFile(l.f); err != nil {
+		log.Printf("error releasing lock file: %v", err)
+	}
+	l.f.Close()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	alog "github.com/anacrolix/log"
+)
+
+// Identical log lines are printed at most once per window, with a summary of
+// how many were suppressed.
+const logRepeatWindow = 30 * time.Second
+
+type repeatedLine struct {
+	count int
+}
+
+// dedupWriter collapses repeated log lines so that flaky trackers or readers
+// erroring on every seek don't flood the log.
+type dedupWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	seen map[string]*repeatedLine
+}
+
+func newDedupWriter(w io.Writer) *dedupWriter {
+	d := &dedupWriter{w: w, seen: make(map[string]*repeatedLine)}
+	go func() {
+		for range time.Tick(logRepeatWindow) {
+			d.flush()
+		}
+	}()
+	return d
+}
+
+func (d *dedupWriter) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	line := string(p)
+	if r, ok := d.seen[line]; ok {
+		r.count++
+		return len(p), nil
+	}
+	d.seen[line] = &repeatedLine{}
+	return d.writeLine(line)
+}
+
+func (d *dedupWriter) flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for line, r := range d.seen {
+		if r.count > 0 {
+			d.writeLine(fmt.Sprintf("message repeated %d times: %s", r.count, line))
+		}
+	}
+	clear(d.seen)
+}
+
+func (d *dedupWriter) writeLine(line string) (int, error) {
+	return io.WriteString(d.w, time.Now().Format("2006/01/02 15:04:05 ")+line)
+}
+
+// InitLogging routes the standard logger through a dedupWriter. Timestamps
+// are added by the writer so identical messages compare equal.
+func InitLogging() {
+	log.SetFlags(0)
+	log.SetOutput(newDedupWriter(log.Writer()))
+}
+
+// stdLogHandler forwards the torrent library's logs to the standard logger so
+// they get deduplicated too.
+type stdLogHandler struct{}
+
+func (stdLogHandler) Handle(r alog.Record) {
+	log.Printf("[%s %s] %s", r.Level.LogString(), strings.Join(r.Names, " "), r.Text())
+}
+
+func newTorrentLogger() alog.Logger {
+	logger := alog.NewLogger("torrent")
+	logger.SetHandlers(stdLogHandler{})
+	return logger
+}
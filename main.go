@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,11 +10,15 @@ import (
 	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -23,23 +27,87 @@ import (
 	"github.com/anacrolix/squirrel"
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/mse"
 	"github.com/anacrolix/torrent/storage"
 	sqliteStorage "github.com/anacrolix/torrent/storage/sqlite"
 	"github.com/anacrolix/torrent/types/infohash"
-	"golang.org/x/sys/windows"
 	"golang.org/x/time/rate"
 )
 
 type ClientConfig struct {
+	AccessLog               bool
+	AdaptiveReadahead       time.Duration
+	AllowedNetworks         string
+	ApiToken                string `secret:"true"`
+	BlocklistInterval       time.Duration
+	BlocklistURL            string
+	CorsOrigins             string
+	CreateDir               string
+	DHT                     bool
+	DHTBootstrap            string
+	DLNA                    bool
 	DeleteDatabaseOnExit    bool
 	DeleteDataOnTorrentDrop bool
+	DisableAggressiveUpload bool
 	DisableUTP              bool
+	CacheDir                string
 	DownloadDir             string
+	DropStaleTorrents       bool
+	EnableUTP               bool
+	Encryption              string
+	ExportDir               string
+	FFmpegPath              string
+	GRPCPort                int
+	HttpBind                string
+	IdleTimeout             time.Duration
+	LanOnly                 bool
+	MaxCacheSize            int64
 	MaxConnsPerTorrent      int
+	MaxDownloadRate         int64
+	MaxUnverifiedBytes      int64
+	MaxUploadBufferPerConn  int64
+	MaxUploadRate           int64
+	MaxUploadSlots          int
+	MemoryLimit             int64
+	MetadataTimeout         time.Duration
+	MinFreeSpace            int64
+	MpvSocket               string
+	NoSeed                  bool
+	NoUpload                bool
+	PeerPort                int
+	PeerPortPolicy          string
+	PieceHashers            int
+	PlaylistTypes           []string
 	Port                    int
+	PortForwarding          bool
+	PortTestURL             string
+	PriorityWindow          int64
+	PublicIP                string
+	RSSInterval             time.Duration
+	RateSchedule            []ScheduleRule
 	Readahead               int64
+	ReadaheadByType         map[string]int64
 	Responsive              bool
+	ResumeTimeout           time.Duration
 	ResumeTorrents          bool
+	ResumeWorkers           int
+	Seed                    string
+	SeedLimitAction         string
+	SeedRatioLimit          float64
+	SeedTimeLimit           time.Duration
+	ShutdownTimeout         time.Duration
+	StorageBackend          string
+	StrmDir                 string
+	TLSCert                 string
+	TLSKey                  string
+	TLSSelfSigned           bool
+	TorznabAPIKey           string `secret:"true"`
+	TorznabURL              string
+	UsersFile               string
+	WatchDir                string
+	WatchDirAction          string
+	WriteBatchInterval      time.Duration
+	WriteBatchSize          int64
 
 	Profiling bool
 }
@@ -47,14 +115,54 @@ type ClientConfig struct {
 type TorrentInfo struct {
 	Name     string
 	InfoHash string
-	Files    []FileInfo
-	Length   int64
+	// False while the metadata is being fetched, when Files is empty and
+	// Name is the magnet link's display name, if any.
+	HasMetadata bool
+	Files       []FileInfo
+	Length      int64
+	Stale       bool
+	Paused      bool
+	Label       string `json:",omitempty"`
+	Added       time.Time
+}
+
+// Services bundles the long-lived state shared by the HTTP handlers.
+type Services struct {
+	Adds       *AddGate
+	Archives   *ArchiveIndex
+	Blocklist  *Blocklist
+	DLNA       *DLNAServer
+	Disk       *DiskGuard
+	Guard      *NetworkGuard
+	HLS        *HLSManager
+	Idle       *IdleTimer
+	InfoCache  *InfoCache
+	Limits     *RateLimits
+	Meta       *MetadataStore
+	Peers      *PeerMeter
+	PortMapper *PortMapper
+	Priorities *PriorityManager
+	RSS        *RSS
+	Rates      *RateSampler
+	Readers    *ReaderPool
+	Resumer    *Resumer
+	Scheduler  *Scheduler
+	SeedLimits *SeedLimiter
+	Session    *SessionStats
+	Settings   *SettingsStore
+	Streams    *StreamTracker
+	Users      *UserStore
+	Verifier   *Verifier
 }
 
 type FileInfo struct {
-	Name   string
-	URL    string
-	Length int64
+	Name           string
+	Path           string
+	ParsedTitle    string // readable title parsed from a video's release name
+	URL            string
+	Length         int64
+	BytesCompleted int64
+	Subtitles      []string `json:",omitempty"` // URLs of matching subtitle files
 }
 
 const (
@@ -63,9 +171,29 @@ const (
 	infoHashPattern  = "^[0-9a-fA-F]{40}$"
 	httpPattern      = "^https?"
 	defaultHTTPPort  = 6969
+	defaultPeerPort  = 42069
 	defaultMaxConns  = 200
 	defaultReadahead = 32 * 1024 * 1024 // 32 MB
-	shutdownTimeout  = 9 * time.Second
+	defaultUploadBuf = 1 << 20          // 1 MB
+	defaultHashers   = 2
+
+	defaultShutdownTimeout = 30 * time.Second
+	shutdownGrace          = 5 * time.Second // for aborted streams to return
+
+	vlcNetworkCaching = 10000 // ms
+
+	defaultMetadataTimeout = 2 * time.Minute
+	metadataRetryAfter     = 30 * time.Second
+
+	defaultResumeTimeout = time.Minute
+	defaultResumeWorkers = 4
+
+	defaultBlocklistInterval = 24 * time.Hour
+
+	defaultUnverified = 64 << 20 // 64 MB
+
+	defaultWriteBatchSize     = 64 << 20 // 64 MB
+	defaultWriteBatchInterval = 2 * time.Second
 )
 
 func GetLocalIPs() ([]net.IP, error) {
@@ -87,52 +215,159 @@ func GetLocalIPs() ([]net.IP, error) {
 	return ips, nil
 }
 
-func MarshalTorrents(c *torrent.Client, config *ClientConfig) ([]byte, error) {
-	torrents := make([]TorrentInfo, 0, len(c.Torrents()))
+// URLHost is the address put in stream URLs: HttpBind when it is a single
+// address, otherwise the first LAN address.
+func URLHost(config *ClientConfig) (net.IP, error) {
+	if ip := net.ParseIP(config.HttpBind); ip != nil && !ip.IsUnspecified() {
+		return ip, nil
+	}
+	ips, err := GetLocalIPs()
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no local IPv4 address")
+	}
+	return ips[0], nil
+}
+
+// loopbackHost is the address the server reaches itself on.
+func loopbackHost(config *ClientConfig) net.IP {
+	if ip := net.ParseIP(config.HttpBind); ip != nil && !ip.IsUnspecified() {
+		return ip
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
 
+// ListTorrents returns the page of torrents u can access that q selects,
+// and how many matched before paging. Torrents still fetching their metadata
+// are listed without files rather than waited for.
+func ListTorrents(c *torrent.Client, config *ClientConfig, svc *Services, u *User, q TorrentQuery) ([]TorrentInfo, int, error) {
+	type entry struct {
+		t      *torrent.Torrent
+		status TorrentStatus
+		label  string
+		added  time.Time
+	}
+	var entries []entry
 	for _, t := range c.Torrents() {
-		<-t.GotInfo()
+		ih := t.InfoHash().String()
+		if !svc.Users.CanAccess(u, ih) {
+			continue
+		}
+		e := entry{t: t, status: GetTorrentStatus(t, svc), added: svc.Session.Added(ih)}
+		if label := svc.Settings.Get(ih).Label; label != nil {
+			e.label = *label
+		}
+		if q.Label != "" && e.label != q.Label || q.State != "" && e.status.State != q.State {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if q.Desc {
+			a, b = b, a
+		}
+		switch q.Sort {
+		case sortName:
+			return naturalCompare(a.status.Name, b.status.Name) < 0
+		case sortSize:
+			return a.status.Length < b.status.Length
+		case sortProgress:
+			return a.status.Progress < b.status.Progress
+		default:
+			return a.added.Before(b.added)
+		}
+	})
+
+	total := len(entries)
+	entries = entries[min(q.Offset, total):]
+	if q.Limit > 0 && q.Limit < len(entries) {
+		entries = entries[:q.Limit]
+	}
+
+	torrents := make([]TorrentInfo, 0, len(entries))
+	for _, e := range entries {
+		t, ih := e.t, e.status.InfoHash
+		if t.Info() == nil {
+			torrents = append(torrents, TorrentInfo{
+				Name:     t.Name(),
+				InfoHash: ih,
+				Files:    []FileInfo{},
+				Stale:    svc.Resumer.IsStale(ih),
+				Paused:   svc.Settings.Get(ih).Paused,
+				Label:    e.label,
+				Added:    e.added,
+			})
+			continue
+		}
 
-		torrentInfo, err := WrapTorrent(t, config)
+		torrentInfo, err := WrapTorrent(t, config, u, svc.Archives.Cached(t))
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
+		torrentInfo.Paused = svc.Settings.Get(ih).Paused
+		torrentInfo.Label = e.label
+		torrentInfo.Added = e.added
 		torrents = append(torrents, torrentInfo)
-
 	}
 
-	return json.Marshal(torrents)
+	return torrents, total, nil
 }
 
-func WrapTorrent(t *torrent.Torrent, config *ClientConfig) (TorrentInfo, error) {
+// WrapTorrent describes the torrent's files, listing the entries of archives
+// as files of their own.
+func WrapTorrent(t *torrent.Torrent, config *ClientConfig, u *User, archives []Archive) (TorrentInfo, error) {
 	<-t.GotInfo()
-	ips, err := GetLocalIPs()
+	localIP, err := URLHost(config)
 	if err != nil {
 		return TorrentInfo{}, err
 	}
 
-	localIP := ips[0]
 	files := make([]FileInfo, 0, len(t.Files()))
 	var torrentLength int64 = 0
 
 	for _, f := range t.Files() {
 		torrentLength += f.Length()
-		files = append(files, FileInfo{
-			Name:   filepath.Base(f.DisplayPath()),
-			URL:    BuildUrl(f, localIP, config.Port),
-			Length: f.Length(),
-		})
+		fileInfo := FileInfo{
+			Name:           filepath.Base(f.DisplayPath()),
+			Path:           f.DisplayPath(),
+			URL:            BuildUrl(f, localIP, config.Port, u),
+			Length:         f.Length(),
+			BytesCompleted: f.BytesCompleted(),
+		}
+		if isVideo(fileInfo.Name) {
+			fileInfo.ParsedTitle = ParseReleaseName(fileInfo.Name).DisplayTitle()
+		}
+		files = append(files, fileInfo)
+	}
+	for _, a := range archives {
+		for _, e := range a.Entries {
+			fileInfo := FileInfo{
+				Name:           path.Base(e.Path),
+				Path:           e.Path,
+				URL:            buildFileURL(t.InfoHash().String(), e.Path, localIP, config.Port, u),
+				Length:         e.Size,
+				BytesCompleted: e.BytesCompleted(),
+			}
+			if isVideo(fileInfo.Name) {
+				fileInfo.ParsedTitle = ParseReleaseName(fileInfo.Name).DisplayTitle()
+			}
+			files = append(files, fileInfo)
+		}
 	}
 
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].Name < files[j].Name
-	})
+	SortFiles(files)
+	AttachSubtitles(files)
 
 	return TorrentInfo{
-		Name:     t.Name(),
-		InfoHash: t.InfoHash().String(),
-		Files:    files,
-		Length:   torrentLength,
+		Name:        t.Name(),
+		InfoHash:    t.InfoHash().String(),
+		HasMetadata: true,
+		Files:       files,
+		Length:      torrentLength,
 	}, nil
 }
 
@@ -142,8 +377,11 @@ func createDBOptions(config *ClientConfig) squirrel.NewCacheOpts {
 	opts.RequireAutoVacuum = generics.Some[any](2)
 	opts.SetJournalMode = "wal"
 	opts.SetSynchronous = 0
-	opts.Path = filepath.Join(config.DownloadDir, "torrents.db")
+	opts.Path = filepath.Join(config.CacheDir, "torrents.db")
 	opts.Capacity = -1
+	if config.MaxCacheSize > 0 {
+		opts.Capacity = config.MaxCacheSize
+	}
 	opts.MmapSizeOk = true
 	opts.MmapSize = 64 << 20
 	opts.CacheSize = generics.Some[int64](-32 << 20)
@@ -153,56 +391,231 @@ func createDBOptions(config *ClientConfig) squirrel.NewCacheOpts {
 	return opts
 }
 
-func InitStorage(config *ClientConfig) (storage.ClientImplCloser, error) {
-	return sqliteStorage.NewDirectStorage(createDBOptions(config))
+func InitStorage(config *ClientConfig, settings *SettingsStore) (storage.ClientImplCloser, error) {
+	if !isStorageBackend(config.StorageBackend) {
+		return nil, fmt.Errorf("invalid storage backend %q", config.StorageBackend)
+	}
+	if err := os.MkdirAll(config.CacheDir, 0o777); err != nil {
+		return nil, fmt.Errorf("error creating cache directory: %w", err)
+	}
+	db, err := sqliteStorage.NewDirectStorage(createDBOptions(config))
+	if err != nil {
+		return nil, err
+	}
+	if config.WriteBatchSize > 0 {
+		db = NewBatchedStorage(db, config.WriteBatchSize, config.WriteBatchInterval)
+	}
+	return NewStorageRouter(config, db, settings), nil
 }
 
-func InitClient(userConfig *ClientConfig, db storage.ClientImplCloser) (*torrent.Client, error) {
+func InitClient(userConfig *ClientConfig, db storage.ClientImplCloser, blocklist *Blocklist, limits *RateLimits, peers *PeerMeter) (*torrent.Client, error) {
 	config := torrent.NewDefaultClientConfig()
 	config.AlwaysWantConns = true
 	config.DefaultStorage = db
 	config.DialRateLimiter = rate.NewLimiter(rate.Inf, 0)
-	config.DisableUTP = userConfig.DisableUTP
+	config.DisableAggressiveUpload = userConfig.DisableAggressiveUpload
+	config.DownloadRateLimiter = limits.Download
+	// EnableUTP wins over DisableUTP, which defaults to true. The uTP socket
+	// is bound on the same host and port as the TCP listener.
+	config.DisableUTP = userConfig.DisableUTP && !userConfig.EnableUTP
+	config.DhtStartingNodes = DHTStartingNodes(userConfig)
 	config.EstablishedConnsPerTorrent = userConfig.MaxConnsPerTorrent
+	config.Logger = newTorrentLogger()
+	config.MaxAllocPeerRequestDataPerConn = userConfig.MaxUploadBufferPerConn
+	config.MaxUnverifiedBytes = userConfig.MaxUnverifiedBytes
+	config.NoDHT = !userConfig.DHT
+	config.NoDefaultPortForwarding = true // see PortMapper
+	config.NoUpload = userConfig.NoUpload
+	config.PieceHashersPerTorrent = max(userConfig.PieceHashers, 1)
 	config.Seed = true
+	config.UploadRateLimiter = limits.Upload
+	if blocklist != nil {
+		config.IPBlocklist = blocklist
+	}
+	peers.Install(&config.Callbacks)
+
+	if err := setPublicIPs(config, userConfig.PublicIP); err != nil {
+		return nil, err
+	}
+
+	if err := setEncryption(config, userConfig.Encryption); err != nil {
+		return nil, err
+	}
+
+	port, err := peerPort(userConfig)
+	if err != nil {
+		return nil, err
+	}
+	config.ListenPort = port
 
 	c, err := torrent.NewClient(config)
 	if err != nil {
 		return nil, fmt.Errorf("error initializing torrent client: %w", err)
 	}
 
-	if !userConfig.ResumeTorrents {
-		return c, nil
+	if !config.DisableUTP {
+		for _, addr := range c.ListenAddrs() {
+			log.Printf("Listening for peers on %s %s", addr.Network(), addr)
+		}
+	}
+
+	if userConfig.PeerPortPolicy == "persist" && config.ListenPort == 0 {
+		if err := savePeerPort(userConfig, c.LocalPort()); err != nil {
+			log.Print(err)
+		}
+	}
+
+	return c, nil
+}
+
+// peerPort picks the peer listen port according to the configured policy.
+// Zero lets the OS choose a random free port.
+func peerPort(config *ClientConfig) (int, error) {
+	switch config.PeerPortPolicy {
+	case "fixed":
+		return config.PeerPort, nil
+	case "random":
+		return 0, nil
+	case "persist":
+		data, err := os.ReadFile(filepath.Join(config.DownloadDir, "peer_port"))
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("error reading saved peer port: %w", err)
+		}
+		port, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return 0, fmt.Errorf("error parsing saved peer port: %w", err)
+		}
+		return port, nil
+	default:
+		return 0, fmt.Errorf("invalid peer port policy %q", config.PeerPortPolicy)
+	}
+}
+
+func savePeerPort(config *ClientConfig, port int) error {
+	if err := os.MkdirAll(config.DownloadDir, 0o777); err != nil {
+		return fmt.Errorf("error creating download directory: %w", err)
+	}
+	err := os.WriteFile(filepath.Join(config.DownloadDir, "peer_port"), []byte(strconv.Itoa(port)), 0o666)
+	if err != nil {
+		return fmt.Errorf("error saving peer port: %w", err)
+	}
+	return nil
+}
+
+// setPublicIPs parses a comma separated list of IPv4 and/or IPv6 addresses to
+// advertise to trackers and the DHT instead of the detected ones.
+func setPublicIPs(config *torrent.ClientConfig, publicIPs string) error {
+	if publicIPs == "" {
+		return nil
+	}
+
+	for _, s := range strings.Split(publicIPs, ",") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		switch {
+		case ip == nil:
+			return fmt.Errorf("invalid public IP %q", s)
+		case ip.To4() != nil:
+			config.PublicIp4 = ip.To4()
+		default:
+			config.PublicIp6 = ip
+		}
+	}
+	return nil
+}
+
+// setEncryption configures protocol encryption (MSE) from one of the policies
+// listed in the Encryption flag, strongest last.
+func setEncryption(config *torrent.ClientConfig, policy string) error {
+	switch policy {
+	case "disable":
+		config.HeaderObfuscationPolicy = torrent.HeaderObfuscationPolicy{}
+	case "prefer":
+		config.HeaderObfuscationPolicy = torrent.HeaderObfuscationPolicy{Preferred: true}
+	case "require":
+		config.HeaderObfuscationPolicy = torrent.HeaderObfuscationPolicy{Preferred: true, RequirePreferred: true}
+	case "require-rc4":
+		config.HeaderObfuscationPolicy = torrent.HeaderObfuscationPolicy{Preferred: true, RequirePreferred: true}
+		config.CryptoProvides = mse.CryptoMethodRC4
+		config.CryptoSelector = func(mse.CryptoMethod) mse.CryptoMethod {
+			return mse.CryptoMethodRC4
+		}
+	default:
+		return fmt.Errorf("invalid encryption policy %q", policy)
 	}
+	return nil
+}
 
-	files, err := os.ReadDir(filepath.Join(userConfig.DownloadDir, "torrents"))
-	if err != nil && !os.IsNotExist(err) {
-		log.Printf("error retrieving saved torrents: %v", err)
+// ParseReadaheadPresets parses the ReadaheadByType flag. Sizes are bytes with
+// an optional KB, MB or GB suffix.
+func ParseReadaheadPresets(s string) (map[string]int64, error) {
+	presets := make(map[string]int64)
+	if s == "" {
+		return presets, nil
 	}
 
-	for _, v := range files {
-		_, err := AddTorrent(c, filepath.Join(userConfig.DownloadDir, "torrents", v.Name()))
+	for _, entry := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid readahead preset %q", entry)
+		}
+		size, err := parseByteSize(value)
 		if err != nil {
-			log.Printf(
-				"error resuming torrent %s: %v",
-				v.Name(),
-				err,
-			)
+			return nil, fmt.Errorf("invalid readahead preset %q: %w", entry, err)
 		}
+		presets[strings.ToLower(key)] = size
 	}
+	return presets, nil
+}
 
-	return c, nil
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if trimmed, ok := strings.CutSuffix(s, unit.suffix); ok {
+			s, multiplier = strings.TrimSpace(trimmed), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
 }
 
-func InitServer(c *torrent.Client, config *ClientConfig, cancel context.CancelFunc) *http.Server {
+func InitServer(c *torrent.Client, config *ClientConfig, svc *Services, tlsConfig *tls.Config, cancel context.CancelFunc) *http.Server {
 	mux := http.NewServeMux()
+	requestCtx, abortRequests := context.WithCancel(context.Background())
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", config.Port),
-		Handler: mux,
+		Addr:        net.JoinHostPort(config.HttpBind, strconv.Itoa(config.Port)),
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return requestCtx },
+		TLSConfig:   tlsConfig,
+	}
+	// Open streams get ShutdownTimeout to finish. Cancelling every request
+	// context after that closes the torrent readers behind the stragglers,
+	// so Shutdown doesn't sit out its own timeout waiting on them.
+	server.RegisterOnShutdown(func() { time.AfterFunc(config.ShutdownTimeout, abortRequests) })
+	RegisterRoutes(mux, c, config, svc, cancel)
+	server.Handler = CORS(config, mux)
+	if config.AccessLog {
+		// Outside the mux so requests matching no route are logged too.
+		server.Handler = AccessLog(server.Handler)
 	}
-	RegisterRoutes(mux, c, config, cancel)
 	go func() {
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Printf("error on server ListenAndServe: %v", err)
 		}
 		cancel()
@@ -211,78 +624,260 @@ func InitServer(c *torrent.Client, config *ClientConfig, cancel context.CancelFu
 	return server
 }
 
-func BuildUrl(f *torrent.File, localIP net.IP, Port int) string {
-	return fmt.Sprintf("http://%s:%d/torrents/%s/%s", localIP, Port, f.Torrent().InfoHash(), f.DisplayPath())
+func BuildUrl(f *torrent.File, localIP net.IP, Port int, u *User) string {
+	return buildFileURL(f.Torrent().InfoHash().String(), f.DisplayPath(), localIP, Port, u)
+}
+
+func buildFileURL(infoHash, filePath string, localIP net.IP, Port int, u *User) string {
+	fileURL := fmt.Sprintf("%s://%s/torrents/%s/%s", urlScheme, net.JoinHostPort(localIP.String(), strconv.Itoa(Port)), infoHash, escapePath(filePath))
+	if u != nil {
+		// mpv fetches playlist entries without our headers, so the token has
+		// to travel in the URL itself.
+		fileURL += "?token=" + url.QueryEscape(u.Token)
+	}
+	return fileURL
+}
+
+// PlaylistOptions tweak the playlist for the player that will consume it.
+type PlaylistOptions struct {
+	Player   string // "mpv" (default) or "vlc"
+	Relative bool   // paths from the server root instead of absolute URLs
+}
+
+func ParsePlaylistOptions(r *http.Request) (PlaylistOptions, error) {
+	opts := PlaylistOptions{Player: r.URL.Query().Get("player")}
+	switch opts.Player {
+	case "":
+		opts.Player = "mpv"
+	case "mpv", "vlc":
+	default:
+		return opts, fmt.Errorf("unsupported player %q", opts.Player)
+	}
+
+	if v := r.URL.Query().Get("relative"); v != "" {
+		relative, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid relative parameter")
+		}
+		opts.Relative = relative
+	}
+	return opts, nil
 }
 
-func BuildPlaylist(t *torrent.Torrent, config *ClientConfig) (string, error) {
+func BuildPlaylist(t *torrent.Torrent, config *ClientConfig, u *User, opts PlaylistOptions, archives []Archive) (string, error) {
 	<-t.GotInfo()
 
-	torrentInfo, err := WrapTorrent(t, config)
+	torrentInfo, err := WrapTorrent(t, config, u, archives)
 	if err != nil {
 		return "", err
 	}
 
-	playlist := []string{"#EXTM3U"}
-	files := torrentInfo.Files
+	// Disc folders get one entry for their main title in place of the
+	// individual stream files.
+	var files []FileInfo
+	discs := DetectDiscs(t)
+	if len(discs) > 0 {
+		localIP, err := URLHost(config)
+		if err != nil {
+			return "", err
+		}
+		for _, d := range discs {
+			files = append(files, FileInfo{Name: d.EntryName(), URL: d.URL(localIP, config.Port, u)})
+		}
+	}
+	for _, file := range torrentInfo.Files {
+		if inPlaylist(config, file.Name) && !isDiscFile(discs, file.Path) {
+			files = append(files, file)
+		}
+	}
 
+	playlist := []string{"#EXTM3U"}
 	for _, file := range files {
-		ext := mime.TypeByExtension(filepath.Ext(file.Name))
-		if strings.HasPrefix(ext, "video") {
-			playlist = append(playlist, fmt.Sprintf("#EXTINF:0,%s", file.Name))
-			playlist = append(playlist, file.URL)
+		if opts.Relative {
+			fileURL, err := url.Parse(file.URL)
+			if err != nil {
+				return "", fmt.Errorf("error parsing file URL: %w", err)
+			}
+			file.URL = fileURL.RequestURI()
+			for i, sub := range file.Subtitles {
+				subURL, err := url.Parse(sub)
+				if err != nil {
+					return "", fmt.Errorf("error parsing subtitle URL: %w", err)
+				}
+				file.Subtitles[i] = subURL.RequestURI()
+			}
+		}
+		title := file.Name
+		if file.ParsedTitle != "" {
+			title = file.ParsedTitle
+		}
+		if opts.Player == "vlc" {
+			// VLC treats a zero duration as a real length and wants its
+			// stream options right before the entry they apply to.
+			playlist = append(playlist, fmt.Sprintf("#EXTINF:-1,%s", title))
+			playlist = append(playlist, fmt.Sprintf("#EXTVLCOPT:network-caching=%d", vlcNetworkCaching))
+			playlist = append(playlist, fmt.Sprintf("#EXTVLCOPT:meta-title=%s", title))
+			if len(file.Subtitles) > 0 {
+				playlist = append(playlist, fmt.Sprintf("#EXTVLCOPT:input-slave=%s", strings.Join(file.Subtitles, "#")))
+			}
+		} else {
+			playlist = append(playlist, fmt.Sprintf("#EXTINF:0,%s", title))
+			if len(file.Subtitles) > 0 {
+				// mpv has no per-entry options in M3U, but an EDL entry can
+				// carry the subtitles as extra tracks.
+				file.URL = edlURL(file.URL, file.Subtitles)
+			}
 		}
+		playlist = append(playlist, file.URL)
 	}
 
 	return strings.Join(playlist, "\n"), nil
 }
 
+func isVideo(name string) bool {
+	return strings.HasPrefix(mime.TypeByExtension(filepath.Ext(name)), "video")
+}
+
+// Audio types missing from the MIME tables of some systems.
+var audioTypes = map[string]string{
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".mp3":  "audio/mpeg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/opus",
+	".wav":  "audio/wav",
+}
+
+func init() {
+	for ext, typ := range audioTypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, typ)
+		}
+	}
+}
+
+// ParsePlaylistTypes parses the PlaylistTypes flag.
+func ParsePlaylistTypes(s string) ([]string, error) {
+	var types []string
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			return nil, fmt.Errorf("invalid playlist types %q", s)
+		}
+		types = append(types, entry)
+	}
+	return types, nil
+}
+
+// inPlaylist reports whether the file's MIME type or class is one of
+// PlaylistTypes.
+func inPlaylist(config *ClientConfig, name string) bool {
+	mimeType, _, _ := strings.Cut(mime.TypeByExtension(filepath.Ext(name)), ";")
+	class, _, _ := strings.Cut(mimeType, "/")
+	for _, t := range config.PlaylistTypes {
+		if t == mimeType || t == class {
+			return mimeType != ""
+		}
+	}
+	return false
+}
+
 func AddTorrent(c *torrent.Client, id string) (*torrent.Torrent, error) {
+	t, _, err := AddTorrentNew(c, id)
+	return t, err
+}
+
+// AddTorrentNew is like AddTorrent but also reports whether the torrent was
+// not already in the client.
+func AddTorrentNew(c *torrent.Client, id string) (*torrent.Torrent, bool, error) {
 	log.Printf("Adding torrent: %s", id)
 
+	spec, err := ParseTorrentSpec(id)
+	if err != nil {
+		return nil, false, err
+	}
+	return c.AddTorrentSpec(spec)
+}
+
+// torrentURLClient follows redirects like http.DefaultClient, but stops at
+// one to a magnet link which ParseTorrentSpec then adds instead.
+var torrentURLClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if req.URL.Scheme == "magnet" {
+			return http.ErrUseLastResponse
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	},
+}
+
+// ParseTorrentSpec turns a torrent URL, file path, infohash or magnet link
+// into a spec without adding it to a client.
+func ParseTorrentSpec(id string) (*torrent.TorrentSpec, error) {
 	switch {
 	case isMatched(httpPattern, id):
-		resp, err := http.Get(id)
+		resp, err := torrentURLClient.Get(id)
 		if err != nil {
 			return nil, fmt.Errorf("error getting torrent from URL: %w", err)
 		}
 		defer resp.Body.Close()
 
+		// Indexer download links often redirect to a magnet link.
+		if location := resp.Header.Get("Location"); isMatched(magnetPattern, location) {
+			return torrent.TorrentSpecFromMagnetUri(location)
+		}
+
 		metaInfo, err := metainfo.Load(resp.Body)
 		if err != nil {
 			return nil, fmt.Errorf("error loading torrent metadata: %w", err)
 		}
 
-		return c.AddTorrent(metaInfo)
+		return torrent.TorrentSpecFromMetaInfoErr(metaInfo)
 
 	case isMatched(torrentPattern, id):
-		return c.AddTorrentFromFile(id)
+		metaInfo, err := metainfo.LoadFromFile(id)
+		if err != nil {
+			return nil, fmt.Errorf("error loading torrent file: %w", err)
+		}
+
+		return torrent.TorrentSpecFromMetaInfoErr(metaInfo)
 
 	case isMatched(infoHashPattern, id):
-		ih := infohash.FromHexString(id)
-		t, _ := c.AddTorrentInfoHash(ih)
-		return t, nil
+		return &torrent.TorrentSpec{InfoHash: infohash.FromHexString(id)}, nil
 
 	case isMatched(magnetPattern, id):
-		return c.AddMagnet(id)
+		return torrent.TorrentSpecFromMagnetUri(id)
 
 	default:
 		return nil, errors.New("invalid torrent id")
 	}
 }
 
+// StopSeeding disallows uploads for t once it has been fully downloaded.
+func StopSeeding(t *torrent.Torrent) {
+	go func() {
+		select {
+		case <-t.Complete().On():
+			t.DisallowDataUpload()
+		case <-t.Closed():
+		}
+	}()
+}
+
 func isMatched(pattern, input string) bool {
 	matched, _ := regexp.MatchString(pattern, input)
 	return matched
 }
 
 func saveTorrentFile(config *ClientConfig, t *torrent.Torrent) error {
-	err := os.MkdirAll(filepath.Join(config.DownloadDir, "torrents"), 0o777)
+	err := os.MkdirAll(torrentsDir(config), 0o777)
 	if err != nil {
 		return fmt.Errorf("error creating torrents directory: %w", err)
 	}
 
-	f, err := os.Create(filepath.Join(config.DownloadDir, "torrents", fmt.Sprintf("%s.torrent", t.Name())))
+	f, err := os.Create(torrentFilePath(config, t.InfoHash()))
 	if err != nil {
 		return fmt.Errorf("error creating torrent file: %w", err)
 	}
@@ -293,12 +888,23 @@ func saveTorrentFile(config *ClientConfig, t *torrent.Torrent) error {
 		return fmt.Errorf("error writing torrent file: %w", err)
 	}
 
-	return nil
+	return updateTorrentIndex(config, t.InfoHash(), t.Name())
 }
 
-func gracefulShutdown(server *http.Server) error {
-	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+// gracefulShutdown stops accepting torrents and connections, then waits for
+// the open streams to end. Responses sent from now on carry Connection: close
+// so players don't try to reuse the connection.
+func gracefulShutdown(server *http.Server, config *ClientConfig, svc *Services) error {
+	svc.Streams.Drain()
+	if n := svc.Streams.Count(); n > 0 {
+		log.Printf("Waiting up to %s for %d streams to finish", config.ShutdownTimeout, n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout+shutdownGrace)
 	defer cancel()
+	// Pooled readers would otherwise hold on to their pieces until the
+	// client closes.
+	defer svc.Readers.Close()
 
 	if err := server.Shutdown(ctx); err != nil {
 		return fmt.Errorf("error shutting down server: %w", err)
@@ -312,7 +918,7 @@ func deleteDatabase(config *ClientConfig, db storage.ClientImplCloser) error {
 	if err := db.Close(); err != nil {
 		return fmt.Errorf("error closing database: %w", err)
 	}
-	if err := os.Remove(filepath.Join(config.DownloadDir, "bolt.db")); err != nil {
+	if err := os.Remove(createDBOptions(config).Path); err != nil {
 		return fmt.Errorf("error deleting database: %w", err)
 	}
 	return nil
@@ -324,18 +930,79 @@ func run(ctx context.Context, config *ClientConfig) error {
 	ctx, cancel = context.WithCancel(ctx)
 	defer cancel()
 
-	db, err := InitStorage(config)
+	lock, err := AcquireInstanceLock(config)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	tlsConfig, err := LoadTLSConfig(config)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		urlScheme = "https"
+	}
+
+	guard, err := NewNetworkGuard(config)
 	if err != nil {
 		return err
 	}
 
-	c, err := InitClient(config, db)
+	meta, err := OpenMetadataStore(config)
+	if err != nil {
+		return err
+	}
+	defer meta.Close()
+
+	users, err := LoadUsers(config, meta)
+	if err != nil {
+		return err
+	}
+
+	settings := LoadSettings(config, meta)
+	db, err := InitStorage(config, settings)
+	if err != nil {
+		return err
+	}
+
+	session := LoadSessionStats(meta)
+	blocklist := LoadBlocklist(config, meta)
+
+	// Closed after the client, which records completion in it until then.
+	var seeded storage.PieceCompletion
+	if config.Seed != "" {
+		if seeded, err = OpenSeedCompletion(config); err != nil {
+			return err
+		}
+		defer seeded.Close()
+	}
+
+	limits := NewRateLimits(config)
+	scheduler := NewScheduler(config, limits)
+	peers := NewPeerMeter()
+	c, err := InitClient(config, db, blocklist, limits, peers)
 	if err != nil {
 		return err
 	}
 	log.Print("Torrent client started")
+	resumer := ResumeTorrents(c, config, settings)
+	go session.Run(ctx, c)
+	go scheduler.Run(ctx)
+	infoCache := NewInfoCache(meta)
+	go infoCache.Run(ctx, c)
+	go RunDHTNodesSaver(ctx, c, config)
 
 	defer func() {
+		if err := session.Save(c); err != nil {
+			log.Print(err)
+		}
+		if err := SaveDHTNodes(c, config); err != nil {
+			log.Print(err)
+		}
+		if err := session.WriteSummary(c, config); err != nil {
+			log.Print(err)
+		}
 		errs := c.Close()
 		<-c.Closed()
 		for _, err := range errs {
@@ -349,12 +1016,134 @@ func run(ctx context.Context, config *ClientConfig) error {
 		}
 	}()
 
-	server := InitServer(c, config, cancel)
+	if config.Seed != "" {
+		go func() {
+			if err := SeedDirectory(c, config, seeded); err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+
+	if blocklist != nil {
+		go blocklist.Run(ctx)
+	}
+
+	if config.StrmDir != "" {
+		go RunStrmExporter(ctx, c, config, meta)
+	}
+
+	disk := NewDiskGuard(c, config, settings)
+	if config.MinFreeSpace > 0 {
+		go disk.Run(ctx)
+	}
+	streams := NewStreamTracker()
+	adds := NewAddGate(disk, streams)
+
+	if config.WatchDir != "" {
+		go func() {
+			if err := RunWatcher(ctx, c, config, adds, infoCache); err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+
+	rss := LoadRSS(c, config, meta, adds, infoCache)
+	if config.RSSInterval > 0 {
+		go rss.Run(ctx)
+	}
+
+	var dlna *DLNAServer
+	if config.DLNA {
+		if users != nil {
+			return fmt.Errorf("DLNA can't be used with UsersFile or ApiToken, renderers can't authenticate")
+		}
+		if tlsConfig != nil {
+			return fmt.Errorf("DLNA can't be used with TLS, renderers only play plain HTTP streams")
+		}
+		if dlna, err = NewDLNAServer(c, config, meta); err != nil {
+			return err
+		}
+		go func() {
+			if err := dlna.Run(ctx); err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+
+	hls := NewHLSManager(ctx, config)
+	defer hls.Close()
+
+	var portMapper *PortMapper
+	if config.PortForwarding {
+		portMapper = NewPortMapper(c)
+		go portMapper.Run(ctx)
+		defer portMapper.Unmap()
+	}
+
+	rates := NewRateSampler()
+	go rates.Run(ctx, c)
+	go peers.Run(ctx)
+	if slots := NewUploadSlots(c, config, peers); slots != nil {
+		go slots.Run(ctx)
+	}
+
+	idle := NewIdleTimer(config.IdleTimeout, streams)
+	if idle != nil {
+		go idle.Run(ctx, cancel)
+	}
+
+	priorities := NewPriorityManager(config.PriorityWindow)
+	if config.MaxCacheSize > 0 {
+		go RunCacheProtector(ctx, db, priorities)
+	}
+
+	svc := &Services{
+		Adds:       adds,
+		Archives:   NewArchiveIndex(),
+		Blocklist:  blocklist,
+		DLNA:       dlna,
+		Disk:       disk,
+		Guard:      guard,
+		HLS:        hls,
+		Idle:       idle,
+		InfoCache:  infoCache,
+		Meta:       meta,
+		Limits:     limits,
+		Peers:      peers,
+		PortMapper: portMapper,
+		Priorities: priorities,
+		RSS:        rss,
+		Rates:      rates,
+		Readers:    NewReaderPool(),
+		Resumer:    resumer,
+		Scheduler:  scheduler,
+		Session:    session,
+		Settings:   settings,
+		Streams:    streams,
+		Users:      users,
+		Verifier:   NewVerifier(config),
+	}
+	svc.SeedLimits = NewSeedLimiter(c, config, svc)
+	go svc.SeedLimits.Run(ctx)
+
+	if config.MpvSocket != "" {
+		go NewMpvIPC(c, config, svc, cancel).Run(ctx)
+	}
+
+	if config.GRPCPort != 0 {
+		go func() {
+			if err := ServeGRPC(ctx, c, config, svc, tlsConfig); err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+
+	server := InitServer(c, config, svc, tlsConfig, cancel)
 	log.Printf("Listening on %s...", server.Addr)
 
 	<-ctx.Done()
 	log.Print("Shutdown signal received")
-	if err := gracefulShutdown(server); err != nil {
+	if err := gracefulShutdown(server, config, svc); err != nil {
 		return err
 	}
 
@@ -362,40 +1151,196 @@ func run(ctx context.Context, config *ClientConfig) error {
 }
 
 func main() {
+	AccessLog := flag.Bool("AccessLog", false, "Log every HTTP request with its status, bytes served and duration")
+	AdaptiveReadahead := flag.Duration("AdaptiveReadahead", 0, "Size each file stream's readahead to this much playback at the rate the player reads it, between 1 MB and 256 MB, instead of using Readahead. 0 disables.")
+	AllowedNetworks := flag.String("AllowedNetworks", "", "Comma separated CIDR ranges allowed in addition to private addresses when LanOnly is set")
+	ApiToken := flag.String("ApiToken", "", "Require this token, as an Authorization: Bearer header or ?token= parameter, on every request but GET /readyz. Open the web interface with ?token=. Grants admin access alongside UsersFile.")
+	BlocklistInterval := flag.Duration("BlocklistInterval", defaultBlocklistInterval, "How often to re-download the blocklist. 0 only downloads it on startup.")
+	BlocklistURL := flag.String("BlocklistURL", "", "URL of a P2P plaintext IP blocklist (optionally gzipped) used to reject peers")
+	CacheDir := flag.String("CacheDir", "", "Directory for the piece cache database. Defaults to DownloadDir.")
+	ConfigFile := flag.String("Config", "", "TOML file of options, defaulting to go_torrent_mpv/config.toml in the user config directory. Command line flags override GO_TORRENT_MPV_<OPTION> environment variables, which override the file.")
+	CorsOrigins := flag.String("CorsOrigins", "", "Comma separated origins, or *, allowed to call the API and play streams from a web page on another origin")
+	CreateDir := flag.String("CreateDir", "", "Directory POST /create may make torrents from, with paths relative to it. The endpoint is disabled when unset, or without UsersFile or ApiToken.")
+	DHT := flag.Bool("DHT", true, "Find peers through the DHT. Its routing table is saved to DownloadDir so the next start doesn't need to bootstrap from scratch.")
+	DHTBootstrap := flag.String("DHTBootstrap", "", "Comma separated host:port DHT nodes to bootstrap from instead of the default routers")
+	DLNA := flag.Bool("DLNA", false, "Announce the server as a DLNA media server so TVs on the network can browse and play torrents. Not available with UsersFile or ApiToken.")
 	DeleteDatabaseOnExit := flag.Bool("DeleteDatabaseOnExit", false, "Delete all downloaded files before exiting")
 	DeleteDataOnTorrentDrop := flag.Bool("DeleteDataOnTorrentDrop", false, "Delete a torrent's files after it is dropped")
+	DisableAggressiveUpload := flag.Bool("DisableAggressiveUpload", false, "While a torrent downloads, only upload to peers that have pieces it wants, and at most 100 KiB more than they sent. See MaxUploadSlots for the number of peers uploaded to.")
 	DisableUTP := flag.Bool("DisableUTP", true, "Disables UTP")
+	DropStaleTorrents := flag.Bool("DropStaleTorrents", false, "Drop resumed torrents that don't get their metadata within ResumeTimeout")
 	DownloadDir := flag.String("DownloadDir", os.TempDir(), "Directory where downloaded files are stored")
+	EnableUTP := flag.Bool("EnableUTP", false, "Accept and dial uTP peer connections on the peer port, overriding DisableUTP")
+	Encryption := flag.String("Encryption", "prefer", "Protocol encryption: disable, prefer (obfuscate when possible), require (obfuscated headers only) or require-rc4 (full stream encryption only)")
+	ExportDir := flag.String("ExportDir", "", "Directory POST /torrents/{infohash}/export copies files into, with ?dest= relative to it. The endpoint is disabled when unset, or without UsersFile or ApiToken.")
+	FFmpegPath := flag.String("FFmpegPath", "ffmpeg", "ffmpeg executable used to serve files as HLS")
+	GRPCPort := flag.Int("GRPCPort", 0, "Serve the gRPC control API in control.proto on this port, on HttpBind with the HTTP server's TLS and tokens. 0 disables.")
+	HttpBind := flag.String("HttpBind", "127.0.0.1", "Address the HTTP server listens on and puts in stream URLs. Empty listens on all interfaces and uses the first LAN address in URLs.")
+	IdleTimeout := flag.Duration("IdleTimeout", 0, "Exit after this long without requests or open streams. 0 never exits on its own.")
+	LanOnly := flag.Bool("LanOnly", false, "Reject HTTP requests from addresses outside the local network")
+	MaxCacheSize := flag.Int64("MaxCacheSize", 0, "Maximum bytes of the piece cache database. The least recently used pieces are evicted first, keeping those near open streams. 0 is unlimited.")
 	MaxConnsPerTorrent := flag.Int("MaxConnsPerTorrent", defaultMaxConns, "Maximum connections per torrent")
+	MaxDownloadRate := flag.Int64("MaxDownloadRate", 0, "Maximum bytes per second downloaded from peers across all torrents. 0 is unlimited.")
+	MaxUnverifiedBytes := flag.Int64("MaxUnverifiedBytes", defaultUnverified, "Maximum bytes of requested but not yet verified piece data across all torrents. 0 is unlimited.")
+	MaxUploadBufferPerConn := flag.Int64("MaxUploadBufferPerConn", defaultUploadBuf, "Maximum bytes of requested piece data buffered for upload per peer")
+	MaxUploadRate := flag.Int64("MaxUploadRate", 0, "Maximum bytes per second uploaded to peers across all torrents. 0 is unlimited.")
+	MaxUploadSlots := flag.Int("MaxUploadSlots", 0, "Maximum peers per torrent uploaded to at once. Past it, the peers giving the least back are disconnected. 0 is unlimited.")
+	MemoryLimit := flag.Int64("MemoryLimit", 0, "Soft limit in bytes for the process's memory, making the garbage collector work harder as it is approached. 0 is unlimited.")
+	MetadataTimeout := flag.Duration("MetadataTimeout", defaultMetadataTimeout, "How long requests wait for a torrent's metadata before failing with 504. Torrents added by a request that times out are dropped unless added with ?persist=true. 0 waits until the client hangs up.")
+	MinFreeSpace := flag.Int64("MinFreeSpace", 0, "Bytes that must stay free on the DownloadDir volume. Below it adds are refused with 507 and downloads pause until space is freed. 0 disables the check.")
+	MpvSocket := flag.String("MpvSocket", "", "mpv JSON IPC socket (mpv's --input-ipc-server) to follow: playback drives piece priority, torrents removed from the playlist are dropped and the server exits with mpv")
+	NoSeed := flag.Bool("NoSeed", false, "Stop uploading torrents once they finish downloading. Can be overridden per torrent with ?seed=true.")
+	NoUpload := flag.Bool("NoUpload", false, "Never upload to peers, for metered or asymmetric connections. Torrents can also be made leech-only one by one with PATCH /torrents/{infohash}.")
+	PeerPort := flag.Int("PeerPort", defaultPeerPort, "Port to listen on for peer connections")
+	PeerPortPolicy := flag.String("PeerPortPolicy", "fixed", "Peer port selection: fixed (use PeerPort), random (new port every start) or persist (random once, then reused)")
+	PieceHashers := flag.Int("PieceHashers", defaultHashers, "Number of pieces hashed concurrently per torrent when verifying data")
+	PlaylistTypes := flag.String("PlaylistTypes", "video", "Comma separated MIME classes or types of the files put in playlists, e.g. video,audio")
 	Port := flag.Int("Port", defaultHTTPPort, "HTTP Server port")
+	PortForwarding := flag.Bool("PortForwarding", true, "Forward the peer port on UPnP gateways, renewing the mapping while the server runs")
+	PortTestURL := flag.String("PortTestURL", "", "External service used by POST /porttest; {port} is replaced by the peer port and a 200 response means it is reachable")
+	PriorityWindow := flag.Int64("PriorityWindow", defaultPriorityWindow, "Bytes ahead of each stream's read position kept at high priority, followed by as many at normal priority. 0 leaves prioritization to Readahead alone.")
+	PublicIP := flag.String("PublicIP", "", "External IPv4 and/or IPv6 address (comma separated) to advertise to trackers and the DHT")
+	RSSInterval := flag.Duration("RSSInterval", defaultRSSInterval, "How often the RSS feeds added through /rss are checked for new torrents. 0 disables them.")
+	RateSchedule := flag.String("RateSchedule", "", "Comma separated start-end=download/upload rate limits by time of day, e.g. 09:00-17:00=1MB/256KB,23:00-07:00=0/0 (0 is unlimited). MaxDownloadRate and MaxUploadRate apply outside of them.")
 	Readahead := flag.Int64("Readahead", defaultReadahead, "Bytes ahead of read to prioritize. Set to a negative value to use the default readahead function.")
+	ReadaheadByType := flag.String("ReadaheadByType", "", "Comma separated MIME type or class readahead overrides, e.g. video=64MB,audio=4MB,text/plain=256KB")
 	Responsive := flag.Bool("Responsive", false, "Read calls return as soon as possible without waiting for pieces to be verified.")
+	ResumeTimeout := flag.Duration("ResumeTimeout", defaultResumeTimeout, "How long to wait for a resumed torrent's metadata before marking it stale. 0 waits forever.")
 	ResumeTorrents := flag.Bool("ResumeTorrents", true, "Resume previous torrents on startup")
+	ResumeWorkers := flag.Int("ResumeWorkers", defaultResumeWorkers, "Number of saved torrents brought up concurrently on startup")
+	Seed := flag.String("Seed", "", "Directory whose files and folders are continuously seeded as torrents")
+	SeedLimitAction := flag.String("SeedLimitAction", seedLimitStop, "What happens to a torrent reaching SeedRatioLimit or SeedTimeLimit: stop (stop uploading) or drop")
+	SeedRatioLimit := flag.Float64("SeedRatioLimit", 0, "Uploaded bytes, as a multiple of the torrent's size, after which a complete torrent stops seeding. 0 is unlimited. Can be overridden per torrent with PATCH /torrents/{infohash}.")
+	SeedTimeLimit := flag.Duration("SeedTimeLimit", 0, "How long a complete torrent is seeded, counted across restarts. 0 is unlimited. Can be overridden per torrent with PATCH /torrents/{infohash}.")
+	ShutdownTimeout := flag.Duration("ShutdownTimeout", defaultShutdownTimeout, "How long shutdown waits for open streams to finish before closing them")
+	StorageBackend := flag.String("StorageBackend", storageSqlite, "Storage for torrents added without ?storage=: sqlite (piece cache database), file (regular files under DownloadDir/files) or memory. Torrents keep the backend they were first opened with.")
+	StrmDir := flag.String("StrmDir", "", "Library directory kept in sync with .strm files for every video, for Jellyfin/Emby")
+	TLSCert := flag.String("TLSCert", "", "PEM certificate file to serve HTTPS with, together with TLSKey")
+	TLSKey := flag.String("TLSKey", "", "PEM private key file for TLSCert")
+	TLSSelfSigned := flag.Bool("TLSSelfSigned", false, "Serve HTTPS with a self-signed certificate generated into DownloadDir on first run. Ignored when TLSCert is set.")
+	TorznabAPIKey := flag.String("TorznabAPIKey", "", "API key for TorznabURL")
+	TorznabURL := flag.String("TorznabURL", "", "Torznab API URL of a Jackett or Prowlarr indexer searched by /search, e.g. http://localhost:9117/api/v2.0/indexers/all/results/torznab/api")
+	UsersFile := flag.String("UsersFile", "", "JSON file of users and API tokens. Enables per-user torrent namespaces when set.")
+	WatchDir := flag.String("WatchDir", "", "Directory watched for .torrent and .magnet files to add automatically")
+	WatchDirAction := flag.String("WatchDirAction", watchKeep, "What to do with a watched file once added: keep, delete or rename (appends .added)")
+	WriteBatchInterval := flag.Duration("WriteBatchInterval", defaultWriteBatchInterval, "Longest time downloaded chunks wait in memory before being written to the database")
+	WriteBatchSize := flag.Int64("WriteBatchSize", defaultWriteBatchSize, "Bytes of downloaded chunks buffered in memory so pieces are written in one transaction. 0 writes every chunk immediately.")
 	Profiling := flag.Bool("Profiling", false, "Add pprof handlers for profiling")
 	flag.Parse()
+	InitLogging()
+
+	if err := ApplyConfigSources(flag.CommandLine, *ConfigFile); err != nil {
+		log.Fatal(err)
+	}
+
+	if *MemoryLimit > 0 {
+		debug.SetMemoryLimit(*MemoryLimit)
+	}
+
+	readaheadByType, err := ParseReadaheadPresets(*ReadaheadByType)
+	if err != nil {
+		log.Fatal(err)
+	}
+	playlistTypes, err := ParsePlaylistTypes(*PlaylistTypes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rateSchedule, err := ParseRateSchedule(*RateSchedule)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ValidateSeedLimitAction(*SeedLimitAction); err != nil {
+		log.Fatal(err)
+	}
+
+	if *CacheDir == "" {
+		*CacheDir = *DownloadDir
+	}
 
 	config := ClientConfig{
+		AccessLog:               *AccessLog,
+		AdaptiveReadahead:       *AdaptiveReadahead,
+		AllowedNetworks:         *AllowedNetworks,
+		ApiToken:                *ApiToken,
+		BlocklistInterval:       *BlocklistInterval,
+		BlocklistURL:            *BlocklistURL,
+		CacheDir:                *CacheDir,
+		CorsOrigins:             *CorsOrigins,
+		CreateDir:               *CreateDir,
+		DHT:                     *DHT,
+		DHTBootstrap:            *DHTBootstrap,
+		DLNA:                    *DLNA,
 		DeleteDatabaseOnExit:    *DeleteDatabaseOnExit,
 		DeleteDataOnTorrentDrop: *DeleteDataOnTorrentDrop,
+		DisableAggressiveUpload: *DisableAggressiveUpload,
 		DisableUTP:              *DisableUTP,
 		DownloadDir:             *DownloadDir,
+		DropStaleTorrents:       *DropStaleTorrents,
+		EnableUTP:               *EnableUTP,
+		Encryption:              *Encryption,
+		ExportDir:               *ExportDir,
+		FFmpegPath:              *FFmpegPath,
+		GRPCPort:                *GRPCPort,
+		HttpBind:                *HttpBind,
+		IdleTimeout:             *IdleTimeout,
+		LanOnly:                 *LanOnly,
+		MaxCacheSize:            *MaxCacheSize,
 		MaxConnsPerTorrent:      *MaxConnsPerTorrent,
+		MaxDownloadRate:         *MaxDownloadRate,
+		MaxUnverifiedBytes:      *MaxUnverifiedBytes,
+		MaxUploadBufferPerConn:  *MaxUploadBufferPerConn,
+		MaxUploadRate:           *MaxUploadRate,
+		MaxUploadSlots:          *MaxUploadSlots,
+		MemoryLimit:             *MemoryLimit,
+		MetadataTimeout:         *MetadataTimeout,
+		MinFreeSpace:            *MinFreeSpace,
+		MpvSocket:               *MpvSocket,
+		NoSeed:                  *NoSeed,
+		NoUpload:                *NoUpload,
+		PeerPort:                *PeerPort,
+		PeerPortPolicy:          *PeerPortPolicy,
+		PieceHashers:            *PieceHashers,
+		PlaylistTypes:           playlistTypes,
 		Port:                    *Port,
+		PortForwarding:          *PortForwarding,
+		PortTestURL:             *PortTestURL,
+		PriorityWindow:          *PriorityWindow,
+		PublicIP:                *PublicIP,
+		RSSInterval:             *RSSInterval,
+		RateSchedule:            rateSchedule,
 		Readahead:               *Readahead,
+		ReadaheadByType:         readaheadByType,
 		Responsive:              *Responsive,
+		ResumeTimeout:           *ResumeTimeout,
 		ResumeTorrents:          *ResumeTorrents,
+		ResumeWorkers:           *ResumeWorkers,
+		Seed:                    *Seed,
+		SeedLimitAction:         *SeedLimitAction,
+		SeedRatioLimit:          *SeedRatioLimit,
+		SeedTimeLimit:           *SeedTimeLimit,
+		ShutdownTimeout:         *ShutdownTimeout,
+		StorageBackend:          *StorageBackend,
+		StrmDir:                 *StrmDir,
+		TLSCert:                 *TLSCert,
+		TLSKey:                  *TLSKey,
+		TLSSelfSigned:           *TLSSelfSigned,
+		TorznabAPIKey:           *TorznabAPIKey,
+		TorznabURL:              *TorznabURL,
+		UsersFile:               *UsersFile,
+		WatchDir:                *WatchDir,
+		WatchDirAction:          *WatchDirAction,
+		WriteBatchInterval:      *WriteBatchInterval,
+		WriteBatchSize:          *WriteBatchSize,
 
 		Profiling: *Profiling,
 	}
 
-	_, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/torrents", config.Port))
-
-	if err == nil {
-		log.Fatalf("server already listening on port %d", config.Port)
+	if config.HttpBind != "" && net.ParseIP(config.HttpBind) == nil {
+		log.Fatalf("invalid HttpBind address %q", config.HttpBind)
 	}
 
-	if err != nil && !errors.Is(err, windows.WSAECONNREFUSED) {
-		log.Fatalf("error checking if server already exists: %v", err)
+	if err := CheckRunningInstance(&config); err != nil {
+		log.Fatal(err)
 	}
 
 	ctx := context.Background()
@@ -7,48 +7,157 @@ local launched_by_us
 local torrents = {}
 local TORRENT_PATTERNS = { "%.torrent$", "^magnet:%?xt=urn:btih:", "^http[s]?://", "^" .. string.rep("%x", 40) .. "$" }
 local EXCLUDE_PATTERNS = { "127%.0%.0%.1", "192%.168%.%d+%.%d+", "/torrents/" }
+local IS_WINDOWS = package.config:sub(1, 1) == "\\"
+local CLIENT_BINARY = IS_WINDOWS and "go_torrent_mpv.exe" or "go_torrent_mpv"
 
 local opts = {
+  AccessLog = false,
+  AdaptiveReadahead = "0s",
+  AllowedNetworks = "",
+  ApiToken = "",
+  BlocklistInterval = "24h",
+  BlocklistURL = "",
+  CacheDir = "",
+  CorsOrigins = "",
+  CreateDir = "",
+  DHT = true,
+  DHTBootstrap = "",
+  DLNA = false,
   DeleteDatabaseOnExit = false,
   DeleteDataOnTorrentDrop = false,
+  DisableAggressiveUpload = false,
   DisableUTP = true,
-  DownloadDir = os.getenv("tmp"),
+  DownloadDir = os.getenv("tmp") or "",
+  DropStaleTorrents = false,
+  EnableUTP = false,
+  Encryption = "prefer",
+  ExportDir = "",
+  FFmpegPath = "ffmpeg",
+  GRPCPort = 0,
+  HttpBind = "127.0.0.1",
+  IdleTimeout = "0s",
+  LanOnly = false,
+  MaxCacheSize = 0,
   MaxConnsPerTorrent = 200,
+  MaxDownloadRate = 0,
+  MaxUnverifiedBytes = 64 * 1024 * 1024,
+  MaxUploadBufferPerConn = 1024 * 1024,
+  MaxUploadRate = 0,
+  MaxUploadSlots = 0,
+  MemoryLimit = 0,
+  MetadataTimeout = "2m",
+  MinFreeSpace = 0,
+  MpvSocket = "",
+  NoSeed = false,
+  NoUpload = false,
+  PeerPort = 42069,
+  PeerPortPolicy = "fixed",
+  PieceHashers = 2,
+  PlaylistTypes = "video",
   Port = 6969,
+  PortForwarding = true,
+  PortTestURL = "",
+  PriorityWindow = 64 * 1024 * 1024,
+  PublicIP = "",
+  RSSInterval = "15m",
+  RateSchedule = "",
   Readahead = 32 * 1024 * 1024,
+  ReadaheadByType = "",
   Responsive = false,
+  ResumeTimeout = "1m",
   ResumeTorrents = true,
+  ResumeWorkers = 4,
+  Seed = "",
+  SeedLimitAction = "stop",
+  SeedRatioLimit = 0,
+  SeedTimeLimit = "0s",
+  ShutdownTimeout = "30s",
+  StorageBackend = "sqlite",
+  StrmDir = "",
+  TLSCert = "",
+  TLSKey = "",
+  TLSSelfSigned = false,
+  TorznabAPIKey = "",
+  TorznabURL = "",
+  UsersFile = "",
+  WatchDir = "",
+  WatchDirAction = "keep",
+  WriteBatchInterval = "2s",
+  WriteBatchSize = 64 * 1024 * 1024,
 
   Profiling = false,
 
+  apiToken = "", -- sent as a bearer token when the server has UsersFile set, defaults to ApiToken
+
   startClientOnMpvLaunch = true,
   closeClientOnMpvExit = true,
   closeClientOnNoTorrentFiles = false, -- close torrent client when there are no files from torrents in mpv's playlist
   removeTorrentOnNoTorrentFiles = false
 }
+local defaults = {}
+for k, v in pairs(opts) do
+  defaults[k] = v
+end
 options.read_options(opts)
 
+-- Only options changed from their defaults are passed on, so the server's
+-- config file and environment variables can set the rest.
 local function load_options()
   local t = {}
   for i, v in pairs(opts) do
     local first_char = i:sub(1, 1)
-    if string.upper(first_char) == first_char then
+    if string.upper(first_char) == first_char and v ~= defaults[i] then
       t[#t + 1] = "--" .. i .. "=" .. tostring(v)
     end
   end
   return t
 end
 
+local function use_tls()
+  return opts.TLSCert ~= "" or opts.TLSSelfSigned
+end
+
+local function server_host()
+  if opts.HttpBind == "" or opts.HttpBind == "0.0.0.0" or opts.HttpBind == "::" then
+    return "localhost"
+  elseif opts.HttpBind:find(":") then
+    return "[" .. opts.HttpBind .. "]"
+  end
+  return opts.HttpBind
+end
+
+local function server_url(path)
+  return (use_tls() and "https" or "http") .. "://" .. server_host() .. ":" .. opts.Port .. path
+end
+
+local function curl_args(...)
+  -- No URL globbing, so IPv6 addresses in brackets work.
+  local args = { "curl", "-g" }
+  if use_tls() then
+    -- The server's certificate is usually self-signed.
+    args[#args + 1] = "-k"
+  end
+  local token = opts.apiToken ~= "" and opts.apiToken or opts.ApiToken
+  if token ~= "" then
+    args[#args + 1] = "-H"
+    args[#args + 1] = "Authorization: Bearer " .. token
+  end
+  for _, v in ipairs({ ... }) do
+    args[#args + 1] = v
+  end
+  return args
+end
+
 local function is_running()
   local cmd = mp.command_native({
     name = "subprocess",
     playback_only = false,
     capture_stdout = true,
     capture_stderr = true,
-    args = { "curl", "-s", "--connect-timeout", "0.25", "localhost:" .. opts.Port .. "/torrents" }
+    args = curl_args("-s", "--connect-timeout", "0.25", server_url("/id"))
   })
 
-  return cmd.status == 0
+  return cmd.status == 0 and cmd.stdout:find('"App":"go_torrent_mpv"', 1, true) ~= nil
 end
 
 local function start_torrent_client()
@@ -63,7 +172,7 @@ local function start_torrent_client()
       name = "subprocess",
       playback_only = false,
       capture_stderr = true,
-      args = { mp.get_script_directory() .. "/go_torrent_mpv.exe", table.unpack(load_options()) },
+      args = { mp.get_script_directory() .. "/" .. CLIENT_BINARY, table.unpack(load_options()) },
       detach = true
     })
 
@@ -87,7 +196,7 @@ local function close_torrent_client()
       name = "subprocess",
       playback_only = false,
       capture_stderr = true,
-      args = { "curl", "localhost:" .. opts.Port .. "/exit" }
+      args = curl_args(server_url("/exit"))
     })
     msg.debug("Closed torrent server")
     client_running = false
@@ -104,8 +213,8 @@ local function add_torrent(torrent_url)
   local playlist_req = mp.command_native({
     name = "subprocess",
     capture_stdout = true,
-    args = { "curl", "-s", "--retry", "10", "--retry-delay", "1", "--retry-connrefused", "-d",
-      torrent_url, "localhost:" .. opts.Port .. "/torrents" }
+    args = curl_args("-s", "--retry", "10", "--retry-delay", "1", "--retry-connrefused", "-d",
+      torrent_url, server_url("/torrents"))
   })
 
   local playlist = playlist_req.stdout
@@ -132,7 +241,7 @@ local function remove_torrent(info_hash)
   mp.command_native({
     name = "subprocess",
     playback_only = false,
-    args = { "curl", "-X", "DELETE", "localhost:" .. opts.Port .. "/torrents/" .. info_hash },
+    args = curl_args("-X", "DELETE", server_url("/torrents/" .. info_hash)),
     detach = true
   })
   torrents[info_hash] = nil
@@ -203,7 +312,37 @@ local function on_load(hook)
   end
 end
 
+-- script-message torrent-search <query> adds the best seeded search result
+-- from the server's Torznab indexer to the playlist.
+local function search(...)
+  local query = table.concat({ ... }, " ")
+  if query == "" then
+    msg.error("Usage: script-message torrent-search <query>")
+    return
+  end
+
+  start_torrent_client()
+  if not client_running then
+    return
+  end
+
+  local res = mp.command_native({
+    name = "subprocess",
+    capture_stdout = true,
+    args = curl_args("-s", "-f", "--retry", "10", "--retry-delay", "1", "--retry-connrefused",
+      "--data-urlencode", "q=" .. query, server_url("/search/add"))
+  })
+  if res.status ~= 0 or not res.stdout or #res.stdout == 0 then
+    msg.error("No torrent found for", query)
+    return
+  end
+
+  index_playlist(res.stdout)
+  mp.commandv("loadfile", "memory://" .. res.stdout, "append-play")
+end
+
 mp.add_hook("on_load", 50, on_load)
+mp.register_script_message("torrent-search", search)
 mp.observe_property("playlist", "native", playlist_changed)
 if opts.closeClientOnMpvExit then
   mp.register_event("shutdown", close_torrent_client)
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/anacrolix/squirrel"
+)
+
+// MetadataStore is a small key/value database for user state (ownership,
+// statistics, per-torrent settings). It lives apart from the piece cache so
+// that purging or moving the cache keeps this state intact.
+type MetadataStore struct {
+	db *squirrel.Cache
+}
+
+func OpenMetadataStore(config *ClientConfig) (*MetadataStore, error) {
+	if err := os.MkdirAll(config.DownloadDir, 0o777); err != nil {
+		return nil, fmt.Errorf("error creating download directory: %w", err)
+	}
+
+	opts := squirrel.NewCacheOpts{}
+	opts.Path = filepath.Join(config.DownloadDir, "metadata.db")
+	opts.SetJournalMode = "wal"
+	opts.Capacity = -1
+	db, err := squirrel.NewCache(opts)
+	if err != nil {
+		return nil, fmt.Errorf("error opening metadata database: %w", err)
+	}
+	return &MetadataStore{db: db}, nil
+}
+
+// Get decodes the JSON value stored under key into v, and reports whether
+// the key existed.
+func (m *MetadataStore) Get(key string, v any) (bool, error) {
+	data, err := m.db.ReadAll(key, nil)
+	if errors.Is(err, squirrel.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error reading %s: %w", key, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("error decoding %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func (m *MetadataStore) Put(key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %w", key, err)
+	}
+	if err := m.db.Put(key, data); err != nil {
+		return fmt.Errorf("error writing %s: %w", key, err)
+	}
+	return nil
+}
+
+func (m *MetadataStore) Delete(key string) error {
+	err := m.db.Tx(func(tx *squirrel.Tx) error {
+		return tx.Delete(key)
+	})
+	if err != nil && !errors.Is(err, squirrel.ErrNotFound) {
+		return fmt.Errorf("error deleting %s: %w", key, err)
+	}
+	return nil
+}
+
+func (m *MetadataStore) Close() error {
+	return m.db.Close()
+}
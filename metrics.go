@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+// Request latency buckets in seconds. Streams stay open for as long as the
+// player reads, so they land in the +Inf bucket.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// RequestMetrics records a latency histogram per route pattern.
+type RequestMetrics struct {
+	mu     sync.Mutex
+	routes map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+var requestMetrics = &RequestMetrics{routes: make(map[string]*histogram)}
+
+func init() {
+	RegisterHook(HookFunc(requestMetrics.Wrap))
+}
+
+func (m *RequestMetrics) Wrap(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		m.observe(pattern, time.Since(start).Seconds())
+	})
+}
+
+func (m *RequestMetrics) observe(pattern string, seconds float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.routes[pattern]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.routes[pattern] = h
+	}
+	if i, _ := slices.BinarySearch(latencyBuckets, seconds); i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (m *RequestMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	patterns := make([]string, 0, len(m.routes))
+	for pattern := range m.routes {
+		patterns = append(patterns, pattern)
+	}
+	slices.Sort(patterns)
+
+	fmt.Fprintln(w, "# HELP gotorrent_http_request_duration_seconds Time taken to serve HTTP requests.")
+	fmt.Fprintln(w, "# TYPE gotorrent_http_request_duration_seconds histogram")
+	for _, pattern := range patterns {
+		h := m.routes[pattern]
+		label := "route=" + strconv.Quote(pattern)
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "gotorrent_http_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", label, le, cumulative)
+		}
+		fmt.Fprintf(w, "gotorrent_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(w, "gotorrent_http_request_duration_seconds_sum{%s} %g\n", label, h.sum)
+		fmt.Fprintf(w, "gotorrent_http_request_duration_seconds_count{%s} %d\n", label, h.count)
+	}
+}
+
+// Stream reads that found their piece already downloaded count as cache hits,
+// reads that had to wait for peers as misses.
+var cacheHits, cacheMisses atomic.Int64
+
+// MeteredReader counts cache hits and misses for a file stream.
+type MeteredReader struct {
+	io.ReadSeeker
+	file *torrent.File
+	pos  int64
+}
+
+func NewMeteredReader(r io.ReadSeeker, file *torrent.File) *MeteredReader {
+	return &MeteredReader{ReadSeeker: r, file: file}
+}
+
+func (r *MeteredReader) Read(b []byte) (int, error) {
+	t := r.file.Torrent()
+	piece := int((r.file.Offset() + r.pos) / t.Info().PieceLength)
+	if piece < t.NumPieces() && t.PieceState(piece).Complete {
+		cacheHits.Add(1)
+	} else {
+		cacheMisses.Add(1)
+	}
+	n, err := r.ReadSeeker.Read(b)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *MeteredReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.ReadSeeker.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
+
+// HandleGetMetrics serves GET /metrics in the Prometheus text format. Byte
+// counts are exported as counters; graph rates with rate().
+func HandleGetMetrics(c *torrent.Client, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b strings.Builder
+		bw := bufio.NewWriter(&b)
+
+		stats := c.Stats()
+		writeMetric(bw, "gotorrent_downloaded_bytes_total", "counter", "Payload bytes downloaded from peers.", stats.BytesReadUsefulData.Int64())
+		writeMetric(bw, "gotorrent_uploaded_bytes_total", "counter", "Payload bytes uploaded to peers.", stats.BytesWrittenData.Int64())
+		writeMetric(bw, "gotorrent_read_bytes_total", "counter", "Bytes received from peers including protocol overhead.", stats.BytesRead.Int64())
+		writeMetric(bw, "gotorrent_written_bytes_total", "counter", "Bytes sent to peers including protocol overhead.", stats.BytesWritten.Int64())
+
+		var peers int
+		for _, t := range c.Torrents() {
+			peers += t.Stats().ActivePeers
+		}
+		writeMetric(bw, "gotorrent_peers", "gauge", "Connected peers across all torrents.", peers)
+		writeMetric(bw, "gotorrent_torrents", "gauge", "Loaded torrents.", len(c.Torrents()))
+		writeMetric(bw, "gotorrent_active_streams", "gauge", "Open file streams.", svc.Streams.Count())
+
+		hits, misses := cacheHits.Load(), cacheMisses.Load()
+		writeMetric(bw, "gotorrent_cache_hits_total", "counter", "Stream reads served from downloaded pieces.", hits)
+		writeMetric(bw, "gotorrent_cache_misses_total", "counter", "Stream reads that waited for pieces to download.", misses)
+		ratio := 0.0
+		if hits+misses > 0 {
+			ratio = float64(hits) / float64(hits+misses)
+		}
+		writeMetric(bw, "gotorrent_cache_hit_ratio", "gauge", "Share of stream reads served from downloaded pieces.", ratio)
+
+		fmt.Fprintln(bw, "# HELP gotorrent_torrent_progress_ratio Share of each torrent downloaded.")
+		fmt.Fprintln(bw, "# TYPE gotorrent_torrent_progress_ratio gauge")
+		for _, t := range c.Torrents() {
+			if t.Info() == nil {
+				continue
+			}
+			progress := 0.0
+			if t.Length() > 0 {
+				progress = float64(t.BytesCompleted()) / float64(t.Length())
+			}
+			fmt.Fprintf(bw, "gotorrent_torrent_progress_ratio{infohash=%q,name=%s} %g\n", t.InfoHash().String(), strconv.Quote(t.Name()), progress)
+		}
+
+		requestMetrics.write(bw)
+		bw.Flush()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+		if r.Method == http.MethodHead {
+			return
+		}
+		io.WriteString(w, b.String())
+	})
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value any) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+)
+
+// Middleware wraps a handler with extra behavior.
+type Middleware func(http.Handler) http.Handler
+
+// Hook wraps every route registered by RegisterRoutes. pattern is the
+// ServeMux pattern the handler is registered under, so hooks can single out
+// routes without patching the handlers themselves.
+type Hook interface {
+	Wrap(pattern string, next http.Handler) http.Handler
+}
+
+type HookFunc func(pattern string, next http.Handler) http.Handler
+
+func (f HookFunc) Wrap(pattern string, next http.Handler) http.Handler {
+	return f(pattern, next)
+}
+
+var hooks []Hook
+
+// RegisterHook adds a hook to all routes. It must be called before the server
+// starts, typically from an init function in a separate file.
+func RegisterHook(h Hook) {
+	hooks = append(hooks, h)
+}
+
+// RequireJSON rejects requests whose body isn't declared as JSON. Browsers
+// only send other content types cross-origin after a CORS preflight, so it
+// keeps pages from posting to the API behind the user's back.
+func RequireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isJSONRequest(r) {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// Chain applies middleware to h so that the first middleware is outermost.
+func Chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+type Router struct {
+	mux   *http.ServeMux
+	hooks []Hook
+	mws   []Middleware
+	ops   []apiOperation
+}
+
+// NewRouter returns a Router that applies mws, then the registered hooks, to
+// every route.
+func NewRouter(mux *http.ServeMux, mws ...Middleware) *Router {
+	return &Router{mux: mux, hooks: hooks, mws: mws}
+}
+
+// Handle registers h under pattern, documented by op in the OpenAPI document.
+// Route specific middleware runs inside the router wide middleware and hooks.
+// Like ServeMux.Handle, it panics on a route without a summary, so none goes
+// undocumented.
+func (rt *Router) Handle(pattern string, op apiOperation, h http.Handler, mws ...Middleware) {
+	if op.Summary == "" {
+		panic("route " + pattern + " has no summary")
+	}
+	op.pattern = pattern
+	rt.ops = append(rt.ops, op)
+
+	h = Chain(h, mws...)
+	for i := len(rt.hooks) - 1; i >= 0; i-- {
+		h = rt.hooks[i].Wrap(pattern, h)
+	}
+	rt.mux.Handle(pattern, Chain(h, rt.mws...))
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const mpvRetryInterval = time.Second
+
+// Properties observed over mpv's JSON IPC, by observe_property ID.
+var mpvProperties = []string{"path", "time-pos", "duration", "playlist"}
+
+type mpvPlaylistEntry struct {
+	Filename string `json:"filename"`
+}
+
+type mpvEvent struct {
+	Event string          `json:"event"`
+	Name  string          `json:"name"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// MpvIPC follows a player through its --input-ipc-server socket, so it
+// works without the script: the playing file's window is kept at the
+// playback position, torrents are dropped once none of their files are left
+// in the playlist, and the server exits with the player.
+type MpvIPC struct {
+	c      *torrent.Client
+	config *ClientConfig
+	svc    *Services
+	cancel context.CancelFunc
+
+	file     *torrent.File
+	head     *WindowReader
+	position float64 // seconds
+	duration float64
+	listed   map[metainfo.Hash]bool
+}
+
+func NewMpvIPC(c *torrent.Client, config *ClientConfig, svc *Services, cancel context.CancelFunc) *MpvIPC {
+	return &MpvIPC{c: c, config: config, svc: svc, cancel: cancel, listed: make(map[metainfo.Hash]bool)}
+}
+
+// Run waits for the socket to accept connections, as the server may start
+// before the player, then follows the player until it closes or ctx is
+// done.
+func (m *MpvIPC) Run(ctx context.Context) {
+	var conn io.ReadWriteCloser
+	for logged := false; ; logged = true {
+		var err error
+		if conn, err = dialMpv(m.config.MpvSocket); err == nil {
+			break
+		}
+		if !logged {
+			log.Printf("Waiting for mpv at %s: %v", m.config.MpvSocket, err)
+		}
+		select {
+		case <-time.After(mpvRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+	log.Printf("Connected to mpv at %s", m.config.MpvSocket)
+	defer m.setFile(nil)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	if err := m.follow(conn); err != nil && ctx.Err() == nil {
+		log.Printf("error reading from mpv: %v", err)
+	}
+	if ctx.Err() == nil {
+		log.Print("mpv closed, shutting down")
+		m.cancel()
+	}
+}
+
+func (m *MpvIPC) follow(conn io.ReadWriter) error {
+	for i, name := range mpvProperties {
+		cmd, err := json.Marshal(map[string]any{"command": []any{"observe_property", i + 1, name}})
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(append(cmd, '\n')); err != nil {
+			return fmt.Errorf("error observing %s: %w", name, err)
+		}
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var event mpvEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			log.Printf("error decoding mpv message: %v", err)
+			continue
+		}
+		switch event.Event {
+		case "shutdown":
+			return nil
+		case "property-change":
+			m.propertyChanged(event.Name, event.Data)
+		}
+	}
+}
+
+func (m *MpvIPC) propertyChanged(name string, data json.RawMessage) {
+	switch name {
+	case "path":
+		var path string
+		json.Unmarshal(data, &path)
+		m.setFile(m.resolve(path))
+	case "time-pos":
+		m.position = 0
+		json.Unmarshal(data, &m.position)
+		m.moveHead()
+	case "duration":
+		m.duration = 0
+		json.Unmarshal(data, &m.duration)
+		m.moveHead()
+	case "playlist":
+		var playlist []mpvPlaylistEntry
+		json.Unmarshal(data, &playlist)
+		m.playlistChanged(playlist)
+	}
+}
+
+// resolve returns the torrent file served at fileURL, if it is one of ours.
+func (m *MpvIPC) resolve(fileURL string) *torrent.File {
+	ih, filePath, ok := m.parseFileURL(fileURL)
+	if !ok {
+		return nil
+	}
+	t, ok := m.c.Torrent(ih)
+	if !ok || t.Info() == nil {
+		return nil
+	}
+	for _, f := range t.Files() {
+		if f.DisplayPath() == filePath {
+			return f
+		}
+	}
+	return nil
+}
+
+// parseFileURL splits a URL of this server's /torrents/{infohash}/{path}
+// into its parts. The path is empty for a torrent's playlist.
+func (m *MpvIPC) parseFileURL(fileURL string) (metainfo.Hash, string, bool) {
+	u, err := url.Parse(fileURL)
+	if err != nil || u.Port() != strconv.Itoa(m.config.Port) {
+		return metainfo.Hash{}, "", false
+	}
+	rest, ok := strings.CutPrefix(u.Path, "/torrents/")
+	if !ok {
+		return metainfo.Hash{}, "", false
+	}
+	hexHash, filePath, _ := strings.Cut(rest, "/")
+	b, err := hex.DecodeString(hexHash)
+	if err != nil || len(b) != 20 {
+		return metainfo.Hash{}, "", false
+	}
+	return metainfo.Hash(b), filePath, true
+}
+
+// setFile moves the playback window to f, or drops it when f is nil.
+func (m *MpvIPC) setFile(f *torrent.File) {
+	if m.head != nil {
+		m.head.Close()
+		m.head = nil
+	}
+	m.file = f
+	m.position, m.duration = 0, 0
+	if f == nil {
+		return
+	}
+	m.head = m.svc.Priorities.Track(&positionSeeker{}, f)
+}
+
+// moveHead puts the window where the playback position is in the file,
+// assuming a constant bitrate. mpv's own reads follow shortly, but a seek
+// moves the window before the player's request for the new position
+// arrives.
+func (m *MpvIPC) moveHead() {
+	if m.head == nil || m.duration <= 0 {
+		return
+	}
+	offset := int64(m.position / m.duration * float64(m.file.Length()))
+	m.head.Seek(min(max(offset, 0), m.file.Length()), io.SeekStart)
+}
+
+// playlistChanged drops the torrents that were in the playlist but have no
+// entries left in it.
+func (m *MpvIPC) playlistChanged(playlist []mpvPlaylistEntry) {
+	listed := make(map[metainfo.Hash]bool)
+	for _, entry := range playlist {
+		if ih, _, ok := m.parseFileURL(entry.Filename); ok {
+			listed[ih] = true
+		}
+	}
+
+	for ih := range m.listed {
+		if listed[ih] {
+			continue
+		}
+		if t, ok := m.c.Torrent(ih); ok {
+			log.Printf("Torrent %s was removed from mpv's playlist", t.Name())
+			DropTorrent(t, m.config, m.svc)
+		}
+	}
+	m.listed = listed
+}
+
+// positionSeeker is a stream that is only ever seeked, standing in for the
+// player's position in a PriorityManager window.
+type positionSeeker struct {
+	pos int64
+}
+
+func (s *positionSeeker) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (s *positionSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return s.pos, errors.New("positionSeeker only seeks from the start")
+	}
+	s.pos = offset
+	return s.pos, nil
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"net"
+)
+
+func dialMpv(path string) (io.ReadWriteCloser, error) {
+	return net.Dial("unix", path)
+}
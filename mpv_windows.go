@@ -0,0 +1,12 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// dialMpv opens mpv's named pipe, such as \\.\pipe\mpvsocket. The handle is
+// synchronous, which is fine as every command is written before reading.
+func dialMpv(path string) (io.ReadWriteCloser, error) {
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// apiOperation documents a route for the OpenAPI document. Request and
+// Response are zero values of the JSON bodies, their schemas are generated
+// from the types.
+type apiOperation struct {
+	Summary      string
+	Path         string   // documented path, when the pattern matches more than the route
+	Query        []string // query parameter names
+	Request      any
+	RequestType  string // content type of a request body that isn't JSON
+	Response     any
+	ResponseType string // content type of a response that isn't JSON
+
+	pattern string // set by Router.Handle
+}
+
+var (
+	addQuery      = []string{"async", "seed", "persist", "label", "storage", "readahead", "responsive", "relative", "player"}
+	playlistQuery = []string{"relative", "player"}
+)
+
+var pathParamPattern = regexp.MustCompile(`\{(\w+)(\.\.\.)?\}`)
+
+// BuildOpenAPI describes the routes registered with rt as an OpenAPI 3
+// document.
+func BuildOpenAPI(rt *Router) map[string]any {
+	schemas := newSchemaGenerator()
+	paths := make(map[string]map[string]any)
+	for _, doc := range rt.ops {
+		method, route, ok := strings.Cut(doc.pattern, " ")
+		if !ok {
+			continue
+		}
+		if doc.Path != "" {
+			route = doc.Path
+		}
+		route = strings.ReplaceAll(route, "{$}", "")
+		var params []map[string]any
+		for _, m := range pathParamPattern.FindAllStringSubmatch(route, -1) {
+			params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+		route = pathParamPattern.ReplaceAllString(route, "{$1}")
+
+		for _, name := range doc.Query {
+			params = append(params, map[string]any{"name": name, "in": "query", "schema": map[string]any{"type": "string"}})
+		}
+
+		op := map[string]any{
+			"operationId": operationID(method, route),
+			"summary":     doc.Summary,
+			"responses":   responsesFor(schemas, doc),
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if body := requestBodyFor(schemas, doc); body != nil {
+			op["requestBody"] = body
+		}
+
+		if paths[route] == nil {
+			paths[route] = make(map[string]any)
+		}
+		paths[route][strings.ToLower(method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]any{"title": appID, "version": "1"},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": schemas.components,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+		// The token is only needed when UsersFile or ApiToken is set.
+		"security": []map[string]any{{}, {"bearer": []string{}}},
+	}
+}
+
+func responsesFor(schemas *schemaGenerator, doc apiOperation) map[string]any {
+	ok := map[string]any{"description": "OK"}
+	content := make(map[string]any)
+	if doc.Response != nil {
+		content["application/json"] = map[string]any{"schema": schemas.schema(reflect.TypeOf(doc.Response))}
+	}
+	if doc.ResponseType != "" {
+		content[doc.ResponseType] = map[string]any{"schema": map[string]any{"type": "string"}}
+	}
+	if len(content) > 0 {
+		ok["content"] = content
+	}
+	return map[string]any{
+		"200": ok,
+		"default": map[string]any{
+			"description": "Error",
+			"content":     map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}},
+		},
+	}
+}
+
+func requestBodyFor(schemas *schemaGenerator, doc apiOperation) map[string]any {
+	content := make(map[string]any)
+	if doc.Request != nil {
+		content["application/json"] = map[string]any{"schema": schemas.schema(reflect.TypeOf(doc.Request))}
+	}
+	if doc.RequestType != "" {
+		content[doc.RequestType] = map[string]any{"schema": map[string]any{"type": "string"}}
+	}
+	if len(content) == 0 {
+		return nil
+	}
+	return map[string]any{"required": true, "content": content}
+}
+
+// operationID names an operation after its method and path, such as
+// getTorrentsInfohashStatus for GET /torrents/{infohash}/status.
+func operationID(method, route string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	upper := true
+	for _, r := range route {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	if route == "/" {
+		b.WriteString("Root")
+	}
+	return b.String()
+}
+
+type schemaGenerator struct {
+	components map[string]any
+}
+
+func newSchemaGenerator() *schemaGenerator {
+	return &schemaGenerator{components: make(map[string]any)}
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// schema describes how encoding/json marshals values of type t. Named
+// structs become components referenced by name.
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]any{"type": "integer", "format": "int64", "description": "nanoseconds"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := g.schema(t.Elem())
+		if _, isRef := s["$ref"]; !isRef {
+			s["nullable"] = true
+		}
+		return s
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.components[t.Name()]; !ok {
+			// Claimed before recursing so self-referencing types terminate.
+			g.components[t.Name()] = nil
+			g.components[t.Name()] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+func (g *schemaGenerator) object(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	var required []string
+	g.addFields(t, properties, &required)
+	s := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
+
+func (g *schemaGenerator) addFields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			g.addFields(f.Type, properties, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// HandleGetOpenAPI serves the OpenAPI document of the routes registered with
+// rt.
+func HandleGetOpenAPI(rt *Router) http.Handler {
+	var (
+		once   sync.Once
+		parsed []byte
+		err    error
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Built on first use, when all routes are registered.
+		once.Do(func() { parsed, err = json.Marshal(BuildOpenAPI(rt)) })
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(parsed)
+	})
+}
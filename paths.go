@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// resolveUnder joins the relative path name to root and fails unless the
+// result, with symlinks followed, exists and stays inside root.
+func resolveUnder(root, name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if name != "." && !filepath.IsLocal(name) {
+		return "", fmt.Errorf("path %q is outside %s", name, root)
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", fmt.Errorf("error resolving path: %w", err)
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return "", fmt.Errorf("error resolving path: %w", err)
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(root, name))
+	if err != nil {
+		return "", fmt.Errorf("error resolving path: %w", err)
+	}
+	if !isUnder(root, path) {
+		return "", fmt.Errorf("path %q is outside %s", name, root)
+	}
+	return path, nil
+}
+
+// isUnder reports whether path is root or inside it. Both must be clean and
+// absolute.
+func isUnder(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && (rel == "." || filepath.IsLocal(rel))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/anacrolix/torrent"
+)
+
+// HandlePauseTorrent stops (or with paused false, restarts) downloading a
+// torrent's data without dropping it. Uploads are unaffected. The state is
+// remembered across restarts.
+func HandlePauseTorrent(c *torrent.Client, svc *Services, paused bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ih, ok := ParseInfoHashParam(w, r)
+		if !ok {
+			return
+		}
+		t, ok := c.Torrent(ih)
+		if !ok || !svc.Users.CanAccess(UserFromContext(r.Context()), ih.String()) {
+			http.Error(w, "Torrent not found", http.StatusNotFound)
+			return
+		}
+
+		if paused {
+			t.DisallowDataDownload()
+			log.Printf("Paused torrent: %s", t.Name())
+		} else {
+			t.AllowDataDownload()
+			log.Printf("Resumed torrent: %s", t.Name())
+		}
+		if err := svc.Settings.SetPaused(ih.String(), paused); err != nil {
+			log.Print(err)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
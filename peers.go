@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	pp "github.com/anacrolix/torrent/peer_protocol"
+)
+
+// PeerMeter counts the bytes exchanged with every peer connection, which
+// the client doesn't expose, and samples them like RateSampler does for
+// torrents. Uploads are counted from the blocks peers request, as the client
+// has no hook for the blocks it sends.
+type PeerMeter struct {
+	mu    sync.Mutex
+	conns map[*torrent.PeerConn]*peerCounters
+}
+
+type peerCounters struct {
+	downloaded int64
+	requested  int64
+	samples    []rateSample
+}
+
+func NewPeerMeter() *PeerMeter {
+	return &PeerMeter{conns: make(map[*torrent.PeerConn]*peerCounters)}
+}
+
+// Install hooks the meter into the client's callbacks.
+func (m *PeerMeter) Install(cb *torrent.Callbacks) {
+	cb.PeerConnAdded = append(cb.PeerConnAdded, func(pc *torrent.PeerConn) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.conns[pc] = &peerCounters{}
+	})
+	cb.ReadMessage = func(pc *torrent.PeerConn, msg *pp.Message) {
+		if msg.Type != pp.Piece && msg.Type != pp.Request {
+			return
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		counters, ok := m.conns[pc]
+		if !ok {
+			return
+		}
+		if msg.Type == pp.Piece {
+			counters.downloaded += int64(len(msg.Piece))
+		} else {
+			counters.requested += int64(msg.Length)
+		}
+	}
+	cb.PeerConnClosed = func(pc *torrent.PeerConn) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.conns, pc)
+	}
+}
+
+func (m *PeerMeter) Run(ctx context.Context) {
+	ticker := time.NewTicker(rateSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			m.mu.Lock()
+			for _, counters := range m.conns {
+				counters.samples = append(counters.samples, rateSample{
+					at:         now,
+					downloaded: counters.downloaded,
+					uploaded:   counters.requested,
+				})
+				if len(counters.samples) > rateSamples+1 {
+					counters.samples = counters.samples[len(counters.samples)-rateSamples-1:]
+				}
+			}
+			m.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Rates returns the connection's download and upload speeds in bytes per
+// second, zero until two samples were taken.
+func (m *PeerMeter) Rates(pc *torrent.PeerConn) (download, upload float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counters, ok := m.conns[pc]
+	if !ok || len(counters.samples) < 2 {
+		return 0, 0
+	}
+	first, last := counters.samples[0], counters.samples[len(counters.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	return float64(last.downloaded-first.downloaded) / elapsed, float64(last.uploaded-first.uploaded) / elapsed
+}
+
+type PeerInfo struct {
+	Address      string
+	Network      string
+	Source       string // how the peer was found, see torrent.PeerSource
+	Client       string `json:",omitempty"`
+	DownloadRate float64
+	UploadRate   float64
+	Progress     float64 // 0 until the torrent's info is known
+}
+
+func GetPeers(t *torrent.Torrent, meter *PeerMeter) []PeerInfo {
+	peers := []PeerInfo{}
+	for _, pc := range t.PeerConns() {
+		info := PeerInfo{
+			Network: pc.Network,
+			Source:  string(pc.Discovery),
+			Client:  peerClient(pc),
+		}
+		if pc.RemoteAddr != nil {
+			info.Address = pc.RemoteAddr.String()
+		}
+		info.DownloadRate, info.UploadRate = meter.Rates(pc)
+		if t.Info() != nil && t.NumPieces() > 0 {
+			have := min(int(pc.PeerPieces().GetCardinality()), t.NumPieces())
+			info.Progress = float64(have) / float64(t.NumPieces())
+		}
+		peers = append(peers, info)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].DownloadRate > peers[j].DownloadRate
+	})
+	return peers
+}
+
+// peerClient names the peer's client from its extended handshake, or failing
+// that from an Azureus-style peer ID such as -TR4050-.
+func peerClient(pc *torrent.PeerConn) string {
+	if name, ok := pc.PeerClientName.Load().(string); ok && name != "" {
+		return name
+	}
+	id := pc.PeerID
+	if id[0] == '-' && id[7] == '-' {
+		return string(id[1:7])
+	}
+	return ""
+}
+
+// HandleGetPeers lists a torrent's connected peers, fastest first.
+func HandleGetPeers(c *torrent.Client, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ih, ok := ParseInfoHashParam(w, r)
+		if !ok {
+			return
+		}
+		t, ok := c.Torrent(ih)
+		if !ok || !svc.Users.CanAccess(UserFromContext(r.Context()), ih.String()) {
+			http.Error(w, "Torrent not found", http.StatusNotFound)
+			return
+		}
+
+		parsed, err := json.Marshal(GetPeers(t, svc.Peers))
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(parsed)
+	})
+}
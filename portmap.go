@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/upnp"
+)
+
+const (
+	portMapLease    = time.Hour
+	portMapRenew    = portMapLease / 2
+	portMapDiscover = 2 * time.Second
+)
+
+// PortMapper forwards the peer port on UPnP gateways, renewing the leases
+// until the server shuts down. NAT-PMP gateways are not supported.
+type PortMapper struct {
+	port int
+
+	mu       sync.Mutex
+	devices  []upnp.Device
+	mappings []PortMapping
+	updated  time.Time
+	err      string
+}
+
+type PortMapping struct {
+	Gateway      string
+	Protocol     string
+	InternalPort int
+	ExternalPort int
+	ExternalIP   string `json:",omitempty"`
+}
+
+type PortMapStatus struct {
+	Mappings []PortMapping
+	Updated  time.Time
+	Error    string `json:",omitempty"`
+}
+
+func NewPortMapper(c *torrent.Client) *PortMapper {
+	return &PortMapper{port: c.LocalPort()}
+}
+
+// Run maps the port right away and renews it every portMapRenew until ctx is
+// done. Gateways are rediscovered on every renewal so a rebooted router picks
+// the mapping up again.
+func (m *PortMapper) Run(ctx context.Context) {
+	ticker := time.NewTicker(portMapRenew)
+	defer ticker.Stop()
+
+	for {
+		m.refresh()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *PortMapper) refresh() {
+	devices := upnp.Discover(0, portMapDiscover, newTorrentLogger())
+
+	var mappings []PortMapping
+	var lastErr error
+	for _, d := range devices {
+		for _, proto := range []upnp.Protocol{upnp.TCP, upnp.UDP} {
+			external, err := d.AddPortMapping(proto, m.port, m.port, "go_torrent_mpv", portMapLease)
+			if err != nil {
+				lastErr = fmt.Errorf("error mapping %s port on %s: %w", proto, d.ID(), err)
+				log.Print(lastErr)
+				continue
+			}
+			mapping := PortMapping{
+				Gateway:      d.ID(),
+				Protocol:     string(proto),
+				InternalPort: m.port,
+				ExternalPort: external,
+			}
+			if ip, err := d.GetExternalIPAddress(); err == nil {
+				mapping.ExternalIP = ip.String()
+			}
+			mappings = append(mappings, mapping)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(mappings) > 0 && len(m.mappings) == 0 {
+		log.Printf("Forwarded peer port %d on %d gateway(s)", m.port, len(devices))
+	}
+	m.devices, m.mappings, m.updated = devices, mappings, time.Now()
+	m.err = ""
+	switch {
+	case len(devices) == 0:
+		m.err = "no UPnP gateway found"
+	case lastErr != nil:
+		m.err = lastErr.Error()
+	}
+}
+
+// Unmap removes the port mappings from the gateways.
+func (m *PortMapper) Unmap() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range m.devices {
+		for _, mapping := range m.mappings {
+			if mapping.Gateway != d.ID() {
+				continue
+			}
+			if err := d.DeletePortMapping(upnp.Protocol(mapping.Protocol), mapping.ExternalPort); err != nil {
+				log.Printf("error removing port mapping on %s: %v", d.ID(), err)
+			}
+		}
+	}
+	m.mappings = nil
+}
+
+func (m *PortMapper) Status() *PortMapStatus {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &PortMapStatus{Mappings: m.mappings, Updated: m.updated, Error: m.err}
+}
+
+type ServerStatus struct {
+	ListenPort  int
+	PortMapping *PortMapStatus `json:",omitempty"`
+}
+
+func HandleGetStatus(c *torrent.Client, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := ServerStatus{
+			ListenPort:  c.LocalPort(),
+			PortMapping: svc.PortMapper.Status(),
+		}
+
+		parsed, err := json.Marshal(status)
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(parsed)
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+)
+
+// PortTestResult reports whether peers can reach the listen port. Status is
+// "open", "closed", or "unknown" when there was no incoming connection and no
+// external check is configured.
+type PortTestResult struct {
+	Port          int
+	Status        string
+	IncomingPeers int
+	External      string `json:",omitempty"` // external check verdict
+	ExternalError string `json:",omitempty"`
+}
+
+// HandlePostPortTest checks the peer port. Peers that connected to us prove
+// the port is open; otherwise PortTestURL, with {port} replaced by the listen
+// port, is asked and must answer 200 when the port is reachable.
+func HandlePostPortTest(c *torrent.Client, config *ClientConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := PortTestResult{Port: c.LocalPort(), Status: "unknown"}
+		for _, t := range c.Torrents() {
+			for _, pc := range t.PeerConns() {
+				if pc.Discovery == torrent.PeerSourceIncoming {
+					result.IncomingPeers++
+				}
+			}
+		}
+		if result.IncomingPeers > 0 {
+			result.Status = "open"
+		}
+
+		if config.PortTestURL != "" {
+			open, err := externalPortTest(r, config.PortTestURL, result.Port)
+			switch {
+			case err != nil:
+				result.ExternalError = err.Error()
+			case open:
+				result.External = "open"
+				result.Status = "open"
+			default:
+				result.External = "closed"
+				if result.IncomingPeers == 0 {
+					result.Status = "closed"
+				}
+			}
+		}
+
+		parsed, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		w.Write(parsed)
+	})
+}
+
+func externalPortTest(r *http.Request, testURL string, port int) (bool, error) {
+	testURL = strings.ReplaceAll(testURL, "{port}", strconv.Itoa(port))
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, testURL, nil)
+	if err != nil {
+		return false, fmt.Errorf("error creating port test request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("error running port test: %w", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+const (
+	defaultPrefetchTimeout = 30 * time.Second
+	maxPrefetchTimeout     = 5 * time.Minute
+)
+
+type PrefetchResult struct {
+	Start        int64
+	End          int64
+	Complete     bool
+	BytesMissing int64
+}
+
+// HandlePostPrefetch serves POST /torrents/{infohash}/{file}/prefetch. It
+// prioritizes a region of the file ahead of playback, given in bytes with
+// ?start=&end= or in seconds with ?time=&duration=&total= (total being the
+// file's play time, used to estimate the byte offsets), and returns once the
+// region is downloaded or ?timeout= passes.
+func HandlePostPrefetch(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ih, ok := ParseInfoHashParam(w, r)
+		if !ok {
+			return
+		}
+		name, ok := strings.CutSuffix(r.PathValue("query"), "/prefetch")
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		t, ok := c.Torrent(ih)
+		if !ok || !svc.Users.CanAccess(UserFromContext(r.Context()), ih.String()) {
+			http.Error(w, "Torrent not found", http.StatusNotFound)
+			return
+		}
+		if !awaitInfo(w, r, t, config) {
+			return
+		}
+
+		var file *torrent.File
+		for _, f := range t.Files() {
+			if f.DisplayPath() == name {
+				file = f
+				break
+			}
+		}
+		if file == nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		start, end, err := parsePrefetchRange(r.URL.Query(), file.Length())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		timeout := defaultPrefetchTimeout
+		if v := r.URL.Query().Get("timeout"); v != "" {
+			if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+				http.Error(w, "Invalid timeout parameter", http.StatusBadRequest)
+				return
+			}
+			timeout = min(timeout, maxPrefetchTimeout)
+		}
+
+		// A reader positioned at the start with the range as readahead gets
+		// the same priority as a stream about to play it.
+		reader := file.NewReader()
+		defer reader.Close()
+		reader.SetReadahead(end - start)
+		if _, err := reader.Seek(start, io.SeekStart); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sub := t.SubscribePieceStateChanges()
+		defer sub.Close()
+		deadline := time.NewTimer(timeout)
+		defer deadline.Stop()
+
+		pieceLength := t.Info().PieceLength
+		first := int((file.Offset() + start) / pieceLength)
+		last := int((file.Offset() + end - 1) / pieceLength)
+	wait:
+		for !piecesComplete(t, first, last) {
+			select {
+			case <-sub.Values:
+			case <-deadline.C:
+				break wait
+			case <-t.Closed():
+				http.Error(w, "Torrent dropped", http.StatusGone)
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		result := PrefetchResult{Start: start, End: end}
+		for i := first; i <= last; i++ {
+			result.BytesMissing += t.PieceBytesMissing(i)
+		}
+		result.Complete = result.BytesMissing == 0
+
+		parsed, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		w.Write(parsed)
+	})
+}
+
+func piecesComplete(t *torrent.Torrent, first, last int) bool {
+	for i := first; i <= last; i++ {
+		if !t.PieceState(i).Complete {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePrefetchRange returns the requested byte range [start, end) within a
+// file of the given length.
+func parsePrefetchRange(query url.Values, length int64) (int64, int64, error) {
+	var start, end int64
+	if query.Has("time") {
+		at, err1 := strconv.ParseFloat(query.Get("time"), 64)
+		duration, err2 := strconv.ParseFloat(query.Get("duration"), 64)
+		total, err3 := strconv.ParseFloat(query.Get("total"), 64)
+		if err := errors.Join(err1, err2, err3); err != nil || total <= 0 || duration <= 0 {
+			return 0, 0, errors.New("time ranges need numeric time, duration and total parameters")
+		}
+		bytesPerSecond := float64(length) / total
+		start = int64(at * bytesPerSecond)
+		end = int64((at + duration) * bytesPerSecond)
+	} else {
+		var err error
+		if start, err = strconv.ParseInt(query.Get("start"), 10, 64); err != nil {
+			return 0, 0, errors.New("invalid start parameter")
+		}
+		end = length
+		if v := query.Get("end"); v != "" {
+			if end, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return 0, 0, errors.New("invalid end parameter")
+			}
+		}
+	}
+
+	start, end = max(start, 0), min(end, length)
+	if start >= end {
+		return 0, 0, errors.New("empty prefetch range")
+	}
+	return start, end, nil
+}
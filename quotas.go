@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/anacrolix/torrent"
+	"golang.org/x/time/rate"
+)
+
+var (
+	errStorageQuota   = errors.New("storage quota exceeded")
+	errBandwidthQuota = errors.New("bandwidth quota exceeded")
+)
+
+// CachedBytes sums the completed bytes of every torrent owned by u.
+func (s *UserStore) CachedBytes(c *torrent.Client, u *User) int64 {
+	var total int64
+	for _, t := range c.Torrents() {
+		if s.isOwner(u, t.InfoHash().String()) {
+			total += t.BytesCompleted()
+		}
+	}
+	return total
+}
+
+func (s *UserStore) isOwner(u *User, infoHash string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.owners[infoHash][u.Name]
+}
+
+func (s *UserStore) CheckStorageQuota(c *torrent.Client, u *User) error {
+	if s == nil || u == nil || u.MaxCacheBytes <= 0 {
+		return nil
+	}
+	if used := s.CachedBytes(c, u); used >= u.MaxCacheBytes {
+		return fmt.Errorf("%w: %d of %d bytes used", errStorageQuota, used, u.MaxCacheBytes)
+	}
+	return nil
+}
+
+// limiter returns the shared stream limiter for u, or nil when u has no
+// serve rate cap.
+func (s *UserStore) limiter(u *User) *rate.Limiter {
+	if s == nil || u == nil || u.MaxServeRate <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lim, ok := s.limiters[u.Name]
+	if !ok {
+		lim = rate.NewLimiter(rate.Limit(u.MaxServeRate), u.MaxServeRate)
+		s.limiters[u.Name] = lim
+	}
+	return lim
+}
+
+// ThrottleWriter wraps w so that writes are paced by u's MaxServeRate, which
+// all of the user's streams share. While the rate is used up, that is while
+// the user's other streams are waiting on it, new streams fail with
+// errBandwidthQuota and a Retry-After for when it frees up.
+func (s *UserStore) ThrottleWriter(ctx context.Context, w http.ResponseWriter, u *User) (http.ResponseWriter, error) {
+	lim := s.limiter(u)
+	if lim == nil {
+		return w, nil
+	}
+
+	r := lim.Reserve()
+	delay := r.Delay()
+	r.Cancel()
+	if delay > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+		return nil, errBandwidthQuota
+	}
+
+	return &throttledWriter{ResponseWriter: w, ctx: ctx, lim: lim}, nil
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+	lim *rate.Limiter
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := min(len(p), tw.lim.Burst())
+		if err := tw.lim.WaitN(tw.ctx, n); err != nil {
+			return written, err
+		}
+		n, err := tw.ResponseWriter.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThrottleWriter(t *testing.T) {
+	s, _ := newTestUsers(t)
+	ctx := context.Background()
+
+	unlimited := &User{Name: "alice"}
+	w := httptest.NewRecorder()
+	if tw, err := s.ThrottleWriter(ctx, w, unlimited); err != nil || tw != w {
+		t.Errorf("ThrottleWriter without MaxServeRate = %v, %v, want the writer itself", tw, err)
+	}
+	if tw, err := (*UserStore)(nil).ThrottleWriter(ctx, w, nil); err != nil || tw != w {
+		t.Errorf("ThrottleWriter without users = %v, %v, want the writer itself", tw, err)
+	}
+
+	// While a stream waits on the rate, further streams are refused.
+	u := &User{Name: "bob", MaxServeRate: 1000}
+	w = httptest.NewRecorder()
+	streamCtx, cancel := context.WithCancel(ctx)
+	tw, err := s.ThrottleWriter(streamCtx, w, u)
+	if err != nil {
+		t.Fatalf("first stream refused: %v", err)
+	}
+	data := bytes.Repeat([]byte("x"), 1500)
+	if n, err := tw.Write(data); n != len(data) || err != nil {
+		t.Fatalf("Write = %d, %v, want %d, nil", n, err, len(data))
+	}
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Error("the throttled writer changed the data")
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tw.Write(data)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	w = httptest.NewRecorder()
+	if _, err := s.ThrottleWriter(ctx, w, u); !errors.Is(err, errBandwidthQuota) {
+		t.Fatalf("second stream while the rate is used up: %v, want errBandwidthQuota", err)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("refused stream has no Retry-After")
+	}
+
+	// Other users have limiters of their own.
+	if _, err := s.ThrottleWriter(ctx, httptest.NewRecorder(), &User{Name: "carol", MaxServeRate: 1000}); err != nil {
+		t.Errorf("another user's stream was refused: %v", err)
+	}
+}
+
+func TestThrottleWriterCancel(t *testing.T) {
+	s, _ := newTestUsers(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	tw, err := s.ThrottleWriter(ctx, httptest.NewRecorder(), &User{Name: "bob", MaxServeRate: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	// A stream whose client hung up stops instead of waiting for the rate.
+	if n, err := tw.Write(make([]byte, 1000)); n != 0 || !errors.Is(err, context.Canceled) {
+		t.Errorf("Write after cancel = %d, %v, want 0, context.Canceled", n, err)
+	}
+}
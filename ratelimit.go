@@ -0,0 +1,40 @@
+package main
+
+import (
+	"golang.org/x/time/rate"
+)
+
+// Peer data is requested in 16 KiB chunks, so a smaller burst would stall
+// uploads entirely.
+const minRateBurst = 16 << 10
+
+// RateLimits holds the client wide peer transfer limiters so they can be
+// changed while the client runs.
+type RateLimits struct {
+	Download *rate.Limiter
+	Upload   *rate.Limiter
+}
+
+func NewRateLimits(config *ClientConfig) *RateLimits {
+	l := &RateLimits{
+		Download: rate.NewLimiter(rate.Inf, 0),
+		Upload:   rate.NewLimiter(rate.Inf, 0),
+	}
+	l.Set(config.MaxDownloadRate, config.MaxUploadRate)
+	return l
+}
+
+// Set changes the limits in bytes per second, zero or less being unlimited.
+func (l *RateLimits) Set(download, upload int64) {
+	setRate(l.Download, download)
+	setRate(l.Upload, upload)
+}
+
+func setRate(l *rate.Limiter, bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	l.SetBurst(max(int(bytesPerSecond), minRateBurst))
+	l.SetLimit(rate.Limit(bytesPerSecond))
+}
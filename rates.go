@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+const (
+	rateSampleInterval = time.Second
+	rateSamples        = 10 // speeds are averaged over this many intervals
+)
+
+// RateSampler records each torrent's transfer counters once per
+// rateSampleInterval so speeds can be averaged over a short window instead
+// of the whole session.
+type RateSampler struct {
+	mu      sync.Mutex
+	samples map[string][]rateSample
+}
+
+type rateSample struct {
+	at         time.Time
+	downloaded int64
+	uploaded   int64
+}
+
+func NewRateSampler() *RateSampler {
+	return &RateSampler{samples: make(map[string][]rateSample)}
+}
+
+func (s *RateSampler) Run(ctx context.Context, c *torrent.Client) {
+	ticker := time.NewTicker(rateSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sample(c)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *RateSampler) sample(c *torrent.Client) {
+	now := time.Now()
+	current := make(map[string]bool, len(c.Torrents()))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range c.Torrents() {
+		ih := t.InfoHash().String()
+		current[ih] = true
+		stats := t.Stats()
+		samples := append(s.samples[ih], rateSample{
+			at:         now,
+			downloaded: stats.BytesReadUsefulData.Int64(),
+			uploaded:   stats.BytesWrittenData.Int64(),
+		})
+		if len(samples) > rateSamples+1 {
+			samples = samples[len(samples)-rateSamples-1:]
+		}
+		s.samples[ih] = samples
+	}
+	for ih := range s.samples {
+		if !current[ih] {
+			delete(s.samples, ih)
+		}
+	}
+}
+
+// Rates returns the torrent's download and upload speeds in bytes per
+// second, zero until two samples were taken.
+func (s *RateSampler) Rates(infoHash string) (download, upload float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	samples := s.samples[infoHash]
+	if len(samples) < 2 {
+		return 0, 0
+	}
+	first, last := samples[0], samples[len(samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	return float64(last.downloaded-first.downloaded) / elapsed, float64(last.uploaded-first.uploaded) / elapsed
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+const (
+	adaptiveSampleInterval = 2 * time.Second
+	adaptiveSmoothing      = 0.3 // weight of the newest sample
+	minAdaptiveReadahead   = 1 << 20
+	maxAdaptiveReadahead   = 256 << 20
+)
+
+// AdaptiveReader sets its reader's readahead to AdaptiveReadahead worth of
+// the rate the player consumes the stream at. Time spent blocked in Read
+// waiting for pieces isn't counted, so a stall doesn't shrink the readahead
+// when it is needed most. Until the first sample the configured readahead
+// applies.
+type AdaptiveReader struct {
+	io.ReadSeeker
+	reader torrent.Reader
+	ahead  time.Duration
+
+	sampleStart time.Time
+	blocked     time.Duration
+	bytes       int64
+	rate        float64 // bytes per second
+}
+
+func NewAdaptiveReader(r io.ReadSeeker, reader torrent.Reader, ahead time.Duration) *AdaptiveReader {
+	return &AdaptiveReader{ReadSeeker: r, reader: reader, ahead: ahead, sampleStart: time.Now()}
+}
+
+func (r *AdaptiveReader) Read(b []byte) (int, error) {
+	start := time.Now()
+	n, err := r.ReadSeeker.Read(b)
+	now := time.Now()
+	r.blocked += now.Sub(start)
+	r.bytes += int64(n)
+
+	if elapsed := now.Sub(r.sampleStart); elapsed >= adaptiveSampleInterval {
+		if active := elapsed - r.blocked; active > 10*time.Millisecond {
+			r.sample(float64(r.bytes) / active.Seconds())
+		}
+		r.sampleStart, r.blocked, r.bytes = now, 0, 0
+	}
+	return n, err
+}
+
+func (r *AdaptiveReader) sample(rate float64) {
+	if r.rate == 0 {
+		r.rate = rate
+	} else {
+		r.rate = adaptiveSmoothing*rate + (1-adaptiveSmoothing)*r.rate
+	}
+
+	// Set on every sample so the adaptive value wins over a PATCH /config
+	// reapplying the configured readahead.
+	r.reader.SetReadahead(min(max(int64(r.rate*r.ahead.Seconds()), minAdaptiveReadahead), maxAdaptiveReadahead))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+const (
+	// How long a reader is kept after its request ends. Players seeking or
+	// reconnecting come back well within it.
+	readerPoolIdle = 10 * time.Second
+	// Idle readers kept per client and file, one per region a player is
+	// likely to return to.
+	readerPoolSize = 2
+)
+
+// ReaderPool keeps the readers of finished file requests for a while, so a
+// player's next range request reuses one whose readahead is already warm
+// instead of starting over. Readers are handed to one request at a time.
+type ReaderPool struct {
+	mu     sync.Mutex
+	idle   map[readerPoolKey][]*idleReader
+	closed bool
+}
+
+type readerPoolKey struct {
+	client string
+	file   *torrent.File
+}
+
+type idleReader struct {
+	reader torrent.Reader
+	pos    int64
+	timer  *time.Timer
+}
+
+func NewReaderPool() *ReaderPool {
+	return &ReaderPool{idle: make(map[readerPoolKey][]*idleReader)}
+}
+
+// readerPoolClient tells players apart by address and user agent.
+func readerPoolClient(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host + " " + r.UserAgent()
+}
+
+// rangeStart returns the first byte asked for by the request's Range header,
+// or 0.
+func rangeStart(r *http.Request) int64 {
+	spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ok {
+		return 0
+	}
+	start, _, _ := strings.Cut(spec, "-")
+	n, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// Get returns the client's idle reader of file that stopped nearest to
+// offset, or a new reader. An idle reader gets its readahead back from Put,
+// readahead or the client's default when it is negative.
+func (p *ReaderPool) Get(client string, file *torrent.File, offset, readahead int64) torrent.Reader {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := readerPoolKey{client, file}
+	readers := p.idle[key]
+	best := -1
+	for i, ir := range readers {
+		if best < 0 || abs(ir.pos-offset) < abs(readers[best].pos-offset) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return file.NewReader()
+	}
+
+	ir := readers[best]
+	ir.timer.Stop()
+	p.idle[key] = append(readers[:best], readers[best+1:]...)
+	if len(p.idle[key]) == 0 {
+		delete(p.idle, key)
+	}
+	if readahead >= 0 {
+		ir.reader.SetReadahead(readahead)
+	} else {
+		ir.reader.SetReadaheadFunc(clientReadahead)
+	}
+	return ir.reader
+}
+
+// clientReadahead is the client's readahead for new readers: as much as
+// was read since the last seek.
+func clientReadahead(rc torrent.ReadaheadContext) int64 {
+	return rc.CurrentPos - rc.ContiguousReadStartPos
+}
+
+// Put keeps reader, last read up to pos, for the client's next request. Its
+// readahead is dropped right away so the pieces it was fetching lose their
+// priority while nobody is playing. The oldest reader is closed if the client
+// already has readerPoolSize.
+func (p *ReaderPool) Put(client string, file *torrent.File, reader torrent.Reader, pos int64) {
+	reader.SetReadahead(0)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		reader.Close()
+		return
+	}
+	key := readerPoolKey{client, file}
+	ir := &idleReader{reader: reader, pos: pos}
+	ir.timer = time.AfterFunc(readerPoolIdle, func() { p.expire(key, ir) })
+	p.idle[key] = append(p.idle[key], ir)
+	if readers := p.idle[key]; len(readers) > readerPoolSize {
+		readers[0].timer.Stop()
+		readers[0].reader.Close()
+		p.idle[key] = readers[1:]
+	}
+}
+
+func (p *ReaderPool) expire(key readerPoolKey, ir *idleReader) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	readers := p.idle[key]
+	for i := range readers {
+		if readers[i] == ir {
+			ir.reader.Close()
+			p.idle[key] = append(readers[:i], readers[i+1:]...)
+			break
+		}
+	}
+	if len(p.idle[key]) == 0 {
+		delete(p.idle, key)
+	}
+}
+
+// DropTorrent closes the idle readers of t's files.
+func (p *ReaderPool) DropTorrent(t *torrent.Torrent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, readers := range p.idle {
+		if key.file.Torrent() != t {
+			continue
+		}
+		for _, ir := range readers {
+			ir.timer.Stop()
+			ir.reader.Close()
+		}
+		delete(p.idle, key)
+	}
+}
+
+// Close closes every idle reader and the readers of requests still running
+// once they end.
+func (p *ReaderPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for key, readers := range p.idle {
+		for _, ir := range readers {
+			ir.timer.Stop()
+			ir.reader.Close()
+		}
+		delete(p.idle, key)
+	}
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
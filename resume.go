@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+// Resumer restores saved torrents on startup and remembers which of them
+// failed to get their metadata in time.
+type Resumer struct {
+	mu       sync.Mutex
+	stale    map[string]bool
+	total    int
+	done     int
+	settings *SettingsStore
+}
+
+type ResumeProgress struct {
+	Ready bool
+	Total int
+	Done  int
+}
+
+// ResumeTorrents adds the saved torrents in the background. Only
+// config.ResumeWorkers torrents are brought up at a time, each worker waiting
+// for metadata (up to ResumeTimeout) before moving on, so that hundreds of
+// saved torrents don't all hit trackers and the DHT at once.
+func ResumeTorrents(c *torrent.Client, config *ClientConfig, settings *SettingsStore) *Resumer {
+	r := &Resumer{stale: make(map[string]bool), settings: settings}
+	migrateTorrentFiles(config)
+	if !config.ResumeTorrents {
+		return r
+	}
+
+	dir := torrentsDir(config)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("error retrieving saved torrents: %v", err)
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && filepath.Ext(e.Name()) == ".torrent" {
+			files = append(files, e.Name())
+		}
+	}
+	r.total = len(files)
+	if r.total == 0 {
+		return r
+	}
+
+	paths := make(chan string)
+	go func() {
+		for _, name := range files {
+			paths <- filepath.Join(dir, name)
+		}
+		close(paths)
+	}()
+
+	for range max(config.ResumeWorkers, 1) {
+		go func() {
+			for path := range paths {
+				r.resume(c, config, path)
+				done, total := r.finishOne()
+				log.Printf("Resumed %d/%d torrents", done, total)
+			}
+		}()
+	}
+
+	return r
+}
+
+func (r *Resumer) resume(c *torrent.Client, config *ClientConfig, path string) {
+	t, err := AddTorrent(c, path)
+	if err != nil {
+		log.Printf(
+			"error resuming torrent %s: %v",
+			filepath.Base(path),
+			err,
+		)
+		return
+	}
+	settings := r.settings.Get(t.InfoHash().String())
+	if !Seeds(config, settings) {
+		StopSeeding(t)
+	}
+	if settings.Paused {
+		t.DisallowDataDownload()
+	}
+	if settings.NoUpload != nil && *settings.NoUpload {
+		t.DisallowDataUpload()
+	}
+	if config.ResumeTimeout <= 0 {
+		return
+	}
+
+	select {
+	case <-t.GotInfo():
+		return
+	case <-t.Closed():
+		return
+	case <-time.After(config.ResumeTimeout):
+	}
+
+	ih := t.InfoHash().String()
+	if config.DropStaleTorrents {
+		t.Drop()
+		if err := removeTorrentFile(config, t.InfoHash()); err != nil {
+			log.Print(err)
+		}
+		log.Printf("Dropped stale torrent: %s", ih)
+		return
+	}
+
+	log.Printf("Torrent %s is stale, no metadata after %v", ih, config.ResumeTimeout)
+	r.setStale(ih, true)
+	go func() {
+		select {
+		case <-t.GotInfo():
+		case <-t.Closed():
+		}
+		r.setStale(ih, false)
+	}()
+}
+
+func (r *Resumer) finishOne() (int, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done++
+	return r.done, r.total
+}
+
+func (r *Resumer) setStale(infoHash string, stale bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if stale {
+		r.stale[infoHash] = true
+	} else {
+		delete(r.stale, infoHash)
+	}
+}
+
+// IsStale reports whether a resumed torrent is still waiting for metadata
+// past the resume timeout.
+func (r *Resumer) IsStale(infoHash string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stale[infoHash]
+}
+
+func (r *Resumer) Progress() ResumeProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return ResumeProgress{Ready: r.done == r.total, Total: r.total, Done: r.done}
+}
+
+// HandleReadyz reports 200 once all saved torrents have been resumed and 503
+// before that.
+func HandleReadyz(resumer *Resumer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		progress := resumer.Progress()
+		w.Header().Set("Content-Type", "application/json")
+		if !progress.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(progress)
+	})
+}
@@ -8,22 +8,153 @@ import (
 	"github.com/anacrolix/torrent"
 )
 
-func RegisterRoutes(mux *http.ServeMux, c *torrent.Client, config *ClientConfig, cancel context.CancelFunc) {
-	mux.Handle("GET /torrents", HandleGetTorrents(c, config))
-	mux.Handle("POST /torrents", HandlePostTorrents(c, config))
-	mux.Handle("GET /torrents/{infohash}", HandleGetInfoHash(c, config))
-	mux.Handle("DELETE /torrents/{infohash}", HandleDeleteInfoHash(c, config))
-	mux.Handle("GET /torrents/{infohash}/{query...}", HandleGetInfoHashFile(c, config))
-	mux.Handle("GET /exit", HandleExit(cancel))
+func RegisterRoutes(mux *http.ServeMux, c *torrent.Client, config *ClientConfig, svc *Services, cancel context.CancelFunc) {
+	users := svc.Users
+	rt := NewRouter(mux, svc.Guard.Middleware, svc.Idle.Middleware)
+	user := users.RequireUser
+	admin := users.RequireAdmin
+
+	rt.Handle("GET /{$}", apiOperation{Summary: "The web interface", ResponseType: "text/html"}, HandleGetUI(), user)
+	rt.Handle("GET /torrents", apiOperation{
+		Summary:  "List torrents",
+		Query:    []string{"label", "state", "sort", "order", "limit", "offset"},
+		Response: []TorrentInfo{},
+	}, HandleGetTorrents(c, config, svc), user)
+	rt.Handle("POST /torrents", apiOperation{
+		Summary:      "Add a torrent from a magnet link, URL, infohash or .torrent file and return its playlist, or its TorrentInfo with Accept: application/json",
+		Query:        addQuery,
+		RequestType:  "text/plain",
+		Response:     AddedTorrent{},
+		ResponseType: "application/vnd.apple.mpegurl",
+	}, HandlePostTorrents(c, config, svc), user)
+	rt.Handle("POST /torrents/batch", apiOperation{
+		Summary:  "Add several torrents without waiting for their metadata",
+		Query:    addQuery,
+		Request:  []string{},
+		Response: []BatchResult{},
+	}, HandlePostBatch(c, config, svc), user)
+	rt.Handle("POST /torrents/import", apiOperation{
+		Summary:  "Import .torrent files from a server directory or a zip archive",
+		Request:  ImportRequest{},
+		Response: []ImportResult{},
+	}, HandleImportTorrents(c, config, svc), user)
+	rt.Handle("GET /add", apiOperation{
+		Summary: "Add a torrent from a link and redirect to its playlist",
+		Query:   append([]string{"uri", "format"}, addQuery...),
+	}, HandleGetAdd(c, config, svc), user)
+	rt.Handle("GET /torrents/{infohash}", apiOperation{
+		Summary:      "Get a torrent's playlist",
+		Query:        playlistQuery,
+		ResponseType: "application/vnd.apple.mpegurl",
+	}, HandleGetInfoHash(c, config, svc), user)
+	rt.Handle("DELETE /torrents/{infohash}", apiOperation{
+		Summary: "Drop a torrent",
+		Query:   []string{"drain", "timeout"},
+	}, HandleDeleteInfoHash(c, config, svc), user)
+	rt.Handle("PATCH /torrents/{infohash}", apiOperation{
+		Summary:  "Change a torrent's settings",
+		Request:  TorrentSettings{},
+		Response: TorrentSettings{},
+	}, HandlePatchInfoHash(c, config, svc), user)
+	rt.Handle("GET /torrents/{infohash}/{query...}", apiOperation{
+		Summary:      "Stream a file of a torrent",
+		Path:         "/torrents/{infohash}/{file}",
+		ResponseType: "application/octet-stream",
+	}, HandleGetInfoHashFile(c, config, svc), user)
+	rt.Handle("GET /hls/{infohash}/{query...}", apiOperation{
+		Summary:      "Get an HLS playlist of a file transcoded by ffmpeg, whose segments are served next to it",
+		Path:         "/hls/{infohash}/{file}/index.m3u8",
+		Query:        []string{"remux"},
+		ResponseType: "application/vnd.apple.mpegurl",
+	}, HandleGetHLS(c, config, svc), user)
+	rt.Handle("GET /torrents/{infohash}/status", apiOperation{Summary: "Get a torrent's download state", Response: TorrentStatus{}}, HandleGetTorrentStatus(c, svc), user)
+	rt.Handle("GET /torrents/{infohash}/stats", apiOperation{Summary: "Get a torrent's transfer statistics", Response: TorrentStats{}}, HandleGetTorrentStats(c, svc), user)
+	rt.Handle("GET /torrents/{infohash}/peers", apiOperation{Summary: "List a torrent's connected peers", Response: []PeerInfo{}}, HandleGetPeers(c, svc), user)
+	rt.Handle("GET /torrents/{infohash}/trackers", apiOperation{Summary: "List a torrent's trackers", Response: []TrackerInfo{}}, HandleGetTrackers(c, svc), user)
+	rt.Handle("GET /torrents/{infohash}/verify", apiOperation{Summary: "Get the progress of a torrent's verification", Response: VerifyProgress{}}, HandleGetVerify(c, svc), user)
+	rt.Handle("POST /torrents/{infohash}/{query...}", apiOperation{
+		Summary:  "Prefetch part of a file",
+		Path:     "/torrents/{infohash}/{file}/prefetch",
+		Query:    []string{"start", "end", "time", "duration", "total", "timeout"},
+		Response: PrefetchResult{},
+	}, HandlePostPrefetch(c, config, svc), user)
+	rt.Handle("POST /torrents/{infohash}/pause", apiOperation{Summary: "Stop downloading a torrent's data"}, HandlePauseTorrent(c, svc, true), user)
+	rt.Handle("POST /torrents/{infohash}/resume", apiOperation{Summary: "Start downloading a paused torrent's data again"}, HandlePauseTorrent(c, svc, false), user)
+	rt.Handle("POST /torrents/{infohash}/files", apiOperation{Summary: "Set file priorities", Request: []FileSelection{}, Response: []FileSelection{}}, HandlePostFiles(c, config, svc), user)
+	rt.Handle("POST /torrents/{infohash}/export", apiOperation{
+		Summary:  "Copy completed files to a directory",
+		Query:    []string{"dest", "file"},
+		Response: ExportResult{},
+	}, HandlePostExport(c, config), users.RequireAuthenticatedAdmin)
+	rt.Handle("POST /torrents/{infohash}/trackers", apiOperation{Summary: "Add trackers", Request: []string{}, Response: []TrackerInfo{}}, HandlePostTrackers(c, config, svc), user)
+	rt.Handle("POST /torrents/{infohash}/verify", apiOperation{Summary: "Start verifying a torrent's data", Response: VerifyProgress{}}, HandlePostVerify(c, config, svc), user)
+	rt.Handle("DELETE /torrents/{infohash}/trackers", apiOperation{
+		Summary:  "Remove a tracker",
+		Query:    []string{"url"},
+		Response: []TrackerInfo{},
+	}, HandleDeleteTrackers(c, config, svc), user)
+	rt.Handle("GET /browse/{$}", apiOperation{Summary: "Browse the torrents as a directory listing", ResponseType: "text/html"}, HandleBrowseTorrents(c, users), user)
+	rt.Handle("GET /browse/{infohash}/{$}", apiOperation{Summary: "Browse a torrent's files as a directory listing", ResponseType: "text/html"}, HandleBrowseTorrent(c, users), user)
+	rt.Handle("GET /concat/{infohash}", apiOperation{
+		Summary:      "Stream several files of a torrent as one",
+		Query:        []string{"file"},
+		ResponseType: "application/octet-stream",
+	}, HandleGetConcat(c, config, svc), user)
+	rt.Handle("GET /dht", apiOperation{Summary: "Get DHT server statistics", Response: []DHTServerStats{}}, HandleGetDHT(c), user)
+	rt.Handle("POST /dht/nodes", apiOperation{Summary: "Add DHT bootstrap nodes", Request: []string{}, Response: []DHTNodeResult{}}, HandlePostDHTNodes(c), admin)
+	rt.Handle("POST /check", apiOperation{
+		Summary:     "Probe whether a torrent can be streamed",
+		Query:       []string{"timeout"},
+		RequestType: "text/plain",
+		Response:    CheckResult{},
+	}, HandlePostCheck(c), user)
+	rt.Handle("GET /search", apiOperation{Summary: "Search the Torznab indexer", Query: []string{"q", "cat"}, Response: []SearchResult{}}, HandleGetSearch(config), user)
+	rt.Handle("POST /search/add", apiOperation{
+		Summary:      "Add the best seeded search result and return its playlist",
+		Query:        []string{"q", "cat"},
+		ResponseType: "application/vnd.apple.mpegurl",
+	}, HandlePostSearchAdd(c, config, svc), user)
+	rt.Handle("GET /rss", apiOperation{Summary: "List RSS feeds", Response: []RSSFeed{}}, HandleGetRSS(svc.RSS), admin)
+	rt.Handle("POST /rss", apiOperation{Summary: "Add an RSS feed", Request: RSSFeed{}, Response: RSSFeed{}}, HandlePostRSS(svc.RSS), admin)
+	rt.Handle("DELETE /rss/{id}", apiOperation{Summary: "Remove an RSS feed"}, HandleDeleteRSS(svc.RSS), admin)
+	rt.Handle("GET /rss/history", apiOperation{Summary: "List torrents added from RSS feeds", Response: []RSSHistoryEntry{}}, HandleGetRSSHistory(svc.RSS), admin)
+	rt.Handle("POST /porttest", apiOperation{Summary: "Test whether the peer port is reachable", Response: PortTestResult{}}, HandlePostPortTest(c, config), user)
+	rt.Handle("POST /create", apiOperation{
+		Summary:  "Create a torrent from a local file or directory",
+		Request:  CreateRequest{},
+		Response: CreateResponse{},
+	}, HandleCreateTorrent(c, config, users), users.RequireAuthenticatedAdmin, RequireJSON)
+	rt.Handle("GET /config", apiOperation{Summary: "Get the configuration", Response: ClientConfig{}}, HandleGetConfig(config), admin)
+	rt.Handle("PATCH /config", apiOperation{
+		Summary:  "Change settings that apply without a restart",
+		Request:  ConfigUpdate{},
+		Response: ClientConfig{},
+	}, HandlePatchConfig(c, config, svc), admin)
+	rt.Handle("GET /status", apiOperation{Summary: "Get the server's network status", Response: ServerStatus{}}, HandleGetStatus(c, svc), user)
+	rt.Handle("GET /stats", apiOperation{Summary: "Get client statistics", Response: ClientStats{}}, HandleGetStats(c, svc), user)
+	rt.Handle("GET /storage", apiOperation{Summary: "Get storage usage", Response: StorageUsage{}}, HandleGetStorage(c, config, svc), user)
+	rt.Handle("GET /metrics", apiOperation{Summary: "Prometheus metrics", ResponseType: "text/plain"}, HandleGetMetrics(c, svc), admin)
+	rt.Handle("GET /readyz", apiOperation{Summary: "Report whether saved torrents have been resumed", Response: ResumeProgress{}}, HandleReadyz(svc.Resumer))
+	rt.Handle("GET /id", apiOperation{Summary: "Identify the server", Response: InstanceID{}}, HandleGetID(), user)
+	rt.Handle("GET /openapi.json", apiOperation{Summary: "This document"}, HandleGetOpenAPI(rt), user)
+	if dlna := svc.DLNA; dlna != nil {
+		rt.Handle("GET /dlna/device.xml", apiOperation{Summary: "DLNA device description", ResponseType: "text/xml"}, dlna.HandleDeviceDescription())
+		rt.Handle("GET /dlna/ContentDirectory.xml", apiOperation{Summary: "DLNA ContentDirectory service description", ResponseType: "text/xml"}, dlna.HandleSCPD(contentDirectorySCPD))
+		rt.Handle("GET /dlna/ConnectionManager.xml", apiOperation{Summary: "DLNA ConnectionManager service description", ResponseType: "text/xml"}, dlna.HandleSCPD(connectionManagerSCPD))
+		rt.Handle("POST /dlna/control/ContentDirectory", apiOperation{Summary: "DLNA ContentDirectory SOAP actions", RequestType: "text/xml", ResponseType: "text/xml"}, dlna.HandleContentDirectory())
+		rt.Handle("POST /dlna/control/ConnectionManager", apiOperation{Summary: "DLNA ConnectionManager SOAP actions", RequestType: "text/xml", ResponseType: "text/xml"}, dlna.HandleConnectionManager())
+	}
+	rt.Handle("GET /exit", apiOperation{Summary: "Shut the server down", ResponseType: "text/plain"}, HandleExit(cancel), admin)
 
 	if !config.Profiling {
 		return
 	}
 
-	mux.Handle("GET /goroutine", pprof.Handler("goroutine"))
-	mux.Handle("GET /heap", pprof.Handler("heap"))
-	mux.Handle("GET /allocs", pprof.Handler("allocs"))
-	mux.Handle("GET /threadcreate", pprof.Handler("threadcreate"))
-	mux.Handle("GET /block", pprof.Handler("block"))
-	mux.Handle("GET /mutex", pprof.Handler("mutex"))
+	rt.Handle("GET /goroutine", apiOperation{Summary: "Goroutine profile", ResponseType: "application/octet-stream"}, pprof.Handler("goroutine"), admin)
+	rt.Handle("GET /heap", apiOperation{Summary: "Heap profile", ResponseType: "application/octet-stream"}, pprof.Handler("heap"), admin)
+	rt.Handle("GET /allocs", apiOperation{Summary: "Allocation profile", ResponseType: "application/octet-stream"}, pprof.Handler("allocs"), admin)
+	rt.Handle("GET /threadcreate", apiOperation{Summary: "Thread creation profile", ResponseType: "application/octet-stream"}, pprof.Handler("threadcreate"), admin)
+	rt.Handle("GET /block", apiOperation{Summary: "Blocking profile", ResponseType: "application/octet-stream"}, pprof.Handler("block"), admin)
+	rt.Handle("GET /mutex", apiOperation{Summary: "Mutex contention profile", ResponseType: "application/octet-stream"}, pprof.Handler("mutex"), admin)
+	rt.Handle("GET /dht/table", apiOperation{Summary: "Dump the DHT routing tables", ResponseType: "text/plain"}, HandleGetDHTTable(c), admin)
 }
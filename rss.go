@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+const (
+	defaultRSSInterval = 15 * time.Minute
+	rssTimeout         = 30 * time.Second
+	rssHistorySize     = 1000
+	rssKey             = "rss"
+)
+
+// RSSFeed is a feed polled for torrents to add. Items whose title matches
+// Match and not Exclude, both regular expressions, are added once.
+type RSSFeed struct {
+	ID      string
+	URL     string
+	Match   string `json:",omitempty"`
+	Exclude string `json:",omitempty"`
+
+	LastCheck time.Time
+	LastError string `json:",omitempty"`
+}
+
+// RSSHistoryEntry records an item that was added, keyed by its GUID or link
+// so it isn't added again.
+type RSSHistoryEntry struct {
+	Feed     string
+	Title    string
+	InfoHash string
+	Added    time.Time
+}
+
+type savedRSS struct {
+	Feeds   []RSSFeed
+	History map[string]RSSHistoryEntry
+}
+
+// RSS polls the configured feeds every RSSInterval and adds the items
+// matching their filters, like the watch directory does for files.
+type RSS struct {
+	mu    sync.Mutex
+	state savedRSS
+	wake  chan struct{}
+
+	c         *torrent.Client
+	config    *ClientConfig
+	meta      *MetadataStore
+	adds      *AddGate
+	infoCache *InfoCache
+}
+
+func LoadRSS(c *torrent.Client, config *ClientConfig, meta *MetadataStore, adds *AddGate, infoCache *InfoCache) *RSS {
+	r := &RSS{
+		state:     savedRSS{History: make(map[string]RSSHistoryEntry)},
+		wake:      make(chan struct{}, 1),
+		c:         c,
+		config:    config,
+		meta:      meta,
+		adds:      adds,
+		infoCache: infoCache,
+	}
+	if _, err := meta.Get(rssKey, &r.state); err != nil {
+		log.Printf("error loading RSS feeds: %v", err)
+	}
+	if r.state.History == nil {
+		r.state.History = make(map[string]RSSHistoryEntry)
+	}
+	return r
+}
+
+// save must be called with mu held.
+func (r *RSS) save() error {
+	return r.meta.Put(rssKey, r.state)
+}
+
+func (r *RSS) Feeds() []RSSFeed {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RSSFeed{}, r.state.Feeds...)
+}
+
+// History returns the added items, newest first.
+func (r *RSS) History() []RSSHistoryEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	history := make([]RSSHistoryEntry, 0, len(r.state.History))
+	for _, entry := range r.state.History {
+		history = append(history, entry)
+	}
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Added.After(history[j].Added)
+	})
+	return history
+}
+
+// AddFeed validates and saves feed under a new ID, then polls it right away.
+func (r *RSS) AddFeed(feed RSSFeed) (RSSFeed, error) {
+	if u, err := url.Parse(feed.URL); err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return feed, errors.New("URL must be an http or https URL")
+	}
+	if _, err := regexp.Compile(feed.Match); err != nil {
+		return feed, fmt.Errorf("invalid Match: %w", err)
+	}
+	if _, err := regexp.Compile(feed.Exclude); err != nil {
+		return feed, fmt.Errorf("invalid Exclude: %w", err)
+	}
+
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return feed, fmt.Errorf("error generating feed ID: %w", err)
+	}
+	feed = RSSFeed{ID: hex.EncodeToString(id[:]), URL: feed.URL, Match: feed.Match, Exclude: feed.Exclude}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state.Feeds = append(r.state.Feeds, feed)
+	if err := r.save(); err != nil {
+		return feed, err
+	}
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return feed, nil
+}
+
+// DeleteFeed removes a feed, keeping the history of what it added.
+func (r *RSS) DeleteFeed(id string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, feed := range r.state.Feeds {
+		if feed.ID == id {
+			r.state.Feeds = append(r.state.Feeds[:i], r.state.Feeds[i+1:]...)
+			return true, r.save()
+		}
+	}
+	return false, nil
+}
+
+// Run polls the feeds every RSSInterval until ctx is done, and right away
+// when a feed is added.
+func (r *RSS) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.RSSInterval)
+	defer ticker.Stop()
+
+	for {
+		r.Poll(ctx)
+		select {
+		case <-ticker.C:
+		case <-r.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Poll checks every feed once.
+func (r *RSS) Poll(ctx context.Context) {
+	for _, feed := range r.Feeds() {
+		err := r.poll(ctx, feed)
+		if err != nil {
+			log.Printf("error polling RSS feed %s: %v", feed.URL, err)
+		}
+
+		r.mu.Lock()
+		for i := range r.state.Feeds {
+			if r.state.Feeds[i].ID != feed.ID {
+				continue
+			}
+			r.state.Feeds[i].LastCheck = time.Now()
+			r.state.Feeds[i].LastError = ""
+			if err != nil {
+				r.state.Feeds[i].LastError = err.Error()
+			}
+		}
+		if err := r.save(); err != nil {
+			log.Print(err)
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *RSS) poll(ctx context.Context, feed RSSFeed) error {
+	// Checked when the feed was added.
+	match := regexp.MustCompile(feed.Match)
+	var exclude *regexp.Regexp
+	if feed.Exclude != "" {
+		exclude = regexp.MustCompile(feed.Exclude)
+	}
+
+	items, err := fetchRSS(ctx, feed.URL)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if !match.MatchString(item.Title) || exclude != nil && exclude.MatchString(item.Title) {
+			continue
+		}
+		res := item.result()
+		id := res.Magnet
+		if id == "" {
+			id = res.Link
+		}
+		key := item.GUID
+		if key == "" {
+			key = id
+		}
+		if id == "" || r.seen(key) {
+			continue
+		}
+
+		spec, err := ParseTorrentSpec(id)
+		if err != nil {
+			log.Printf("error adding %s from RSS: %v", item.Title, err)
+			continue
+		}
+		if _, ok := r.c.Torrent(spec.InfoHash); !ok {
+			if _, err := addBackgroundTorrent(r.c, r.config, r.adds, r.infoCache, spec, id); err != nil {
+				log.Printf("error adding %s from RSS: %v", item.Title, err)
+				continue
+			}
+		}
+		r.record(key, RSSHistoryEntry{Feed: feed.ID, Title: item.Title, InfoHash: spec.InfoHash.HexString(), Added: time.Now()})
+	}
+	return nil
+}
+
+func (r *RSS) seen(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.state.History[key]
+	return ok
+}
+
+// record adds an entry to the history, dropping the oldest once it holds
+// rssHistorySize entries. Items dropped that are still in a feed would be
+// added again, so the limit is well above a feed's usual length.
+func (r *RSS) record(key string, entry RSSHistoryEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state.History[key] = entry
+	for len(r.state.History) > rssHistorySize {
+		oldest := key
+		for k, e := range r.state.History {
+			if e.Added.Before(r.state.History[oldest].Added) {
+				oldest = k
+			}
+		}
+		delete(r.state.History, oldest)
+	}
+	if err := r.save(); err != nil {
+		log.Print(err)
+	}
+}
+
+// fetchRSS reads an RSS 2.0 feed. Torznab attributes, used by Jackett and
+// Prowlarr feeds, are read for magnet links and infohashes.
+func fetchRSS(ctx context.Context, feedURL string) ([]torznabItem, error) {
+	ctx, cancel := context.WithTimeout(ctx, rssTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating feed request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading feed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error downloading feed: %s", resp.Status)
+	}
+
+	var feed torznabFeed
+	if err := xml.NewDecoder(resp.Body).Decode(&feed); err != nil {
+		return nil, fmt.Errorf("error reading feed: %w", err)
+	}
+	return feed.Items, nil
+}
+
+// HandleGetRSS lists the feeds with the result of their last poll.
+func HandleGetRSS(rss *RSS) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeRSSJSON(w, r, rss.Feeds(), http.StatusOK)
+	})
+}
+
+// HandlePostRSS adds the feed in the JSON body, of which URL, Match and
+// Exclude are used.
+func HandlePostRSS(rss *RSS) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var feed RSSFeed
+		if err := json.NewDecoder(r.Body).Decode(&feed); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		feed, err := rss.AddFeed(feed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Added RSS feed: %s", feed.URL)
+		writeRSSJSON(w, r, feed, http.StatusCreated)
+	})
+}
+
+func HandleDeleteRSS(rss *RSS) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, err := rss.DeleteFeed(r.PathValue("id"))
+		if err != nil {
+			log.Print(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Feed not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// HandleGetRSSHistory lists what the feeds added, newest first.
+func HandleGetRSSHistory(rss *RSS) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeRSSJSON(w, r, rss.History(), http.StatusOK)
+	})
+}
+
+func writeRSSJSON(w http.ResponseWriter, r *http.Request, v any, status int) {
+	parsed, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error encoding JSON response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(parsed)
+}
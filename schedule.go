@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const scheduleInterval = 30 * time.Second
+
+// ScheduleRule sets the rate limits between two times of day, in bytes per
+// second with 0 being unlimited. A rule ending before it starts runs past
+// midnight.
+type ScheduleRule struct {
+	Start           string // 15:04
+	End             string
+	MaxDownloadRate int64
+	MaxUploadRate   int64
+}
+
+// ParseRateSchedule parses the RateSchedule flag, a comma separated list of
+// start-end=download/upload rules such as 09:00-17:00=1MB/256KB.
+func ParseRateSchedule(s string) ([]ScheduleRule, error) {
+	var rules []ScheduleRule
+	if s == "" {
+		return rules, nil
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		window, rates, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule rule %q", entry)
+		}
+		var rule ScheduleRule
+		if rule.Start, rule.End, ok = strings.Cut(window, "-"); !ok {
+			return nil, fmt.Errorf("invalid schedule rule %q", entry)
+		}
+		download, upload, ok := strings.Cut(rates, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule rule %q", entry)
+		}
+		var err error
+		if rule.MaxDownloadRate, err = parseByteSize(download); err != nil {
+			return nil, fmt.Errorf("invalid schedule rule %q: %w", entry, err)
+		}
+		if rule.MaxUploadRate, err = parseByteSize(upload); err != nil {
+			return nil, fmt.Errorf("invalid schedule rule %q: %w", entry, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, ValidateRateSchedule(rules)
+}
+
+func ValidateRateSchedule(rules []ScheduleRule) error {
+	for _, rule := range rules {
+		start, err := parseClock(rule.Start)
+		if err != nil {
+			return err
+		}
+		end, err := parseClock(rule.End)
+		if err != nil {
+			return err
+		}
+		if start == end {
+			return fmt.Errorf("schedule rule %s-%s is empty", rule.Start, rule.End)
+		}
+	}
+	return nil
+}
+
+// parseClock returns the minutes since midnight of a 15:04 time.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// activeRule returns the first rule covering now, or nil.
+func activeRule(rules []ScheduleRule, now time.Time) *ScheduleRule {
+	minute := now.Hour()*60 + now.Minute()
+	for i, rule := range rules {
+		// Rules are validated when set.
+		start, _ := parseClock(rule.Start)
+		end, _ := parseClock(rule.End)
+		if start < end && minute >= start && minute < end ||
+			start > end && (minute >= start || minute < end) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// Scheduler applies the RateSchedule rule for the time of day to the client's
+// rate limiters, falling back to MaxDownloadRate and MaxUploadRate outside
+// of every rule.
+type Scheduler struct {
+	config *ClientConfig
+	limits *RateLimits
+
+	mu     sync.Mutex
+	active *ScheduleRule
+}
+
+func NewScheduler(config *ClientConfig, limits *RateLimits) *Scheduler {
+	s := &Scheduler{config: config, limits: limits}
+	s.Apply()
+	return s
+}
+
+// Apply sets the limits for the current time. It must be called after the
+// schedule or the base limits change.
+func (s *Scheduler) Apply() {
+	configMu.RLock()
+	download, upload := s.config.MaxDownloadRate, s.config.MaxUploadRate
+	rule := activeRule(s.config.RateSchedule, time.Now())
+	if rule != nil {
+		download, upload = rule.MaxDownloadRate, rule.MaxUploadRate
+	}
+	configMu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits.Set(download, upload)
+	if (rule == nil) != (s.active == nil) || rule != nil && *rule != *s.active {
+		if rule != nil {
+			log.Printf("Rate schedule %s-%s active: download %d B/s, upload %d B/s", rule.Start, rule.End, download, upload)
+		} else {
+			log.Printf("Rate schedule inactive: download %d B/s, upload %d B/s", download, upload)
+		}
+	}
+	if rule != nil {
+		copied := *rule
+		rule = &copied
+	}
+	s.active = rule
+}
+
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Apply()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRateSchedule(t *testing.T) {
+	rules, err := ParseRateSchedule("09:00-17:00=1MB/256KB, 23:00-07:00=0/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ScheduleRule{
+		{Start: "09:00", End: "17:00", MaxDownloadRate: 1 << 20, MaxUploadRate: 256 << 10},
+		{Start: "23:00", End: "07:00"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("ParseRateSchedule = %+v, want %+v", rules, want)
+	}
+
+	if rules, err := ParseRateSchedule(""); err != nil || len(rules) != 0 {
+		t.Errorf("ParseRateSchedule(\"\") = %v, %v, want no rules", rules, err)
+	}
+
+	for _, s := range []string{
+		"09:00-17:00",
+		"09:00=1MB/1MB",
+		"09:00-17:00=1MB",
+		"09:00-17:00=lots/1MB",
+		"09:00-25:00=1MB/1MB",
+		"9am-5pm=1MB/1MB",
+		"09:00-09:00=1MB/1MB",
+	} {
+		if _, err := ParseRateSchedule(s); err == nil {
+			t.Errorf("ParseRateSchedule(%q) succeeded", s)
+		}
+	}
+}
+
+func TestActiveRule(t *testing.T) {
+	rules := []ScheduleRule{
+		{Start: "09:00", End: "17:00", MaxDownloadRate: 1},
+		{Start: "23:00", End: "07:00", MaxDownloadRate: 2},
+		{Start: "12:00", End: "13:00", MaxDownloadRate: 3}, // shadowed by the first
+	}
+	for clock, want := range map[string]int64{
+		"08:59": 0,
+		"09:00": 1,
+		"12:30": 1,
+		"16:59": 1,
+		"17:00": 0,
+		"23:00": 2,
+		"00:00": 2,
+		"06:59": 2,
+		"07:00": 0,
+	} {
+		now, err := time.Parse("15:04", clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got int64
+		if rule := activeRule(rules, now); rule != nil {
+			got = rule.MaxDownloadRate
+		}
+		if got != want {
+			t.Errorf("at %s the active rule has rate %d, want %d", clock, got, want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const torznabTimeout = 30 * time.Second
+
+// SearchResult is a Torznab item reduced to what is needed to pick and add
+// a torrent. Magnet is empty when the indexer only offers a download Link.
+type SearchResult struct {
+	Title     string
+	Indexer   string `json:",omitempty"`
+	Size      int64
+	Seeders   int
+	Peers     int
+	InfoHash  string `json:",omitempty"`
+	Magnet    string `json:",omitempty"`
+	Link      string `json:",omitempty"`
+	Published string `json:",omitempty"`
+}
+
+type torznabFeed struct {
+	Items []torznabItem `xml:"channel>item"`
+}
+
+type torznabItem struct {
+	Title     string `xml:"title"`
+	GUID      string `xml:"guid"`
+	Link      string `xml:"link"`
+	Size      int64  `xml:"size"`
+	PubDate   string `xml:"pubDate"`
+	Jackett   string `xml:"jackettindexer"`
+	Prowlarr  string `xml:"prowlarrindexer"`
+	Enclosure struct {
+		URL string `xml:"url,attr"`
+	} `xml:"enclosure"`
+	Attrs []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value,attr"`
+	} `xml:"attr"`
+}
+
+type torznabError struct {
+	Code        string `xml:"code,attr"`
+	Description string `xml:"description,attr"`
+}
+
+// Search queries the TorznabURL endpoint, a Jackett or Prowlarr indexer's
+// .../api URL, and returns the results with the most seeders first. cat
+// limits the search to comma separated Torznab categories.
+func Search(ctx context.Context, config *ClientConfig, q, cat string) ([]SearchResult, error) {
+	if config.TorznabURL == "" {
+		return nil, errors.New("no TorznabURL configured")
+	}
+	u, err := url.Parse(config.TorznabURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TorznabURL: %w", err)
+	}
+	query := u.Query()
+	query.Set("t", "search")
+	query.Set("q", q)
+	if cat != "" {
+		query.Set("cat", cat)
+	}
+	if config.TorznabAPIKey != "" {
+		query.Set("apikey", config.TorznabAPIKey)
+	}
+	u.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, torznabTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating search request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// The error holds the URL and with it the API key.
+		return nil, errors.New("error querying indexer: request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error querying indexer: %s", resp.Status)
+	}
+
+	dec := xml.NewDecoder(resp.Body)
+	var feed torznabFeed
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("error reading search results: %w", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		// Torznab reports failures as an <error> document.
+		if start.Name.Local == "error" {
+			var e torznabError
+			if err := dec.DecodeElement(&e, &start); err != nil {
+				return nil, fmt.Errorf("error reading search results: %w", err)
+			}
+			return nil, fmt.Errorf("indexer error %s: %s", e.Code, e.Description)
+		}
+		if err := dec.DecodeElement(&feed, &start); err != nil {
+			return nil, fmt.Errorf("error reading search results: %w", err)
+		}
+		break
+	}
+
+	results := make([]SearchResult, 0, len(feed.Items))
+	for _, item := range feed.Items {
+		results = append(results, item.result())
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Seeders > results[j].Seeders
+	})
+	return results, nil
+}
+
+func (item torznabItem) result() SearchResult {
+	res := SearchResult{Title: item.Title, Indexer: item.Jackett, Size: item.Size, Published: item.PubDate}
+	if res.Indexer == "" {
+		res.Indexer = item.Prowlarr
+	}
+	for _, attr := range item.Attrs {
+		switch attr.Name {
+		case "seeders":
+			res.Seeders, _ = strconv.Atoi(attr.Value)
+		case "peers":
+			res.Peers, _ = strconv.Atoi(attr.Value)
+		case "infohash":
+			res.InfoHash = strings.ToLower(attr.Value)
+		case "magneturl":
+			res.Magnet = attr.Value
+		case "size":
+			if res.Size == 0 {
+				res.Size, _ = strconv.ParseInt(attr.Value, 10, 64)
+			}
+		}
+	}
+
+	link := item.Link
+	if link == "" {
+		link = item.Enclosure.URL
+	}
+	if !isMatched(magnetPattern, link) {
+		res.Link = link
+	} else if res.Magnet == "" {
+		res.Magnet = link
+	}
+	if res.Magnet == "" && isMatched(infoHashPattern, res.InfoHash) {
+		m := metainfo.Magnet{InfoHash: metainfo.NewHashFromHex(res.InfoHash), DisplayName: res.Title}
+		res.Magnet = m.String()
+	}
+	return res
+}
+
+// HandleGetSearch serves GET /search?q=[&cat=] from the configured indexer.
+func HandleGetSearch(config *ClientConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.TorznabURL == "" {
+			http.Error(w, "Search is not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		q := r.URL.Query().Get("q")
+		if q == "" {
+			http.Error(w, "Missing q parameter", http.StatusBadRequest)
+			return
+		}
+
+		results, err := Search(r.Context(), config, q, r.URL.Query().Get("cat"))
+		if err != nil {
+			log.Printf("error searching: %v", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		parsed, err := json.Marshal(results)
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(parsed)
+	})
+}
+
+// HandlePostSearchAdd serves POST /search/add with q and optionally cat as
+// query or form values. It adds the search's best seeded result like POST
+// /torrents does and returns its playlist.
+func HandlePostSearchAdd(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.TorznabURL == "" {
+			http.Error(w, "Search is not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		q := r.FormValue("q")
+		if q == "" {
+			http.Error(w, "Missing q parameter", http.StatusBadRequest)
+			return
+		}
+
+		opts, err := ParsePlaylistOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		results, err := Search(r.Context(), config, q, r.FormValue("cat"))
+		if err != nil {
+			log.Printf("error searching: %v", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		id := ""
+		for _, res := range results {
+			if id = res.Magnet; id == "" {
+				id = res.Link
+			}
+			if id != "" {
+				break
+			}
+		}
+		if id == "" {
+			http.Error(w, "No results", http.StatusNotFound)
+			return
+		}
+
+		t, ok := AddFromRequest(c, config, svc, w, r, id, false)
+		if !ok {
+			return
+		}
+		WritePlaylist(w, t, config, UserFromContext(r.Context()), opts, svc.Archives.Get(t))
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// SeedDirectory seeds every top-level file and folder in config.Seed as its
+// own torrent. Generated .torrent files are kept in DownloadDir, and which
+// pieces were verified in completion, so the data is only hashed again when
+// the files change.
+func SeedDirectory(c *torrent.Client, config *ClientConfig, completion storage.PieceCompletion) error {
+	entries, err := os.ReadDir(config.Seed)
+	if err != nil {
+		return fmt.Errorf("error reading seed directory: %w", err)
+	}
+
+	cacheDir := seededDir(config)
+
+	for _, e := range entries {
+		root, err := filepath.Abs(filepath.Join(config.Seed, e.Name()))
+		if err != nil {
+			log.Printf("error resolving %s: %v", e.Name(), err)
+			continue
+		}
+
+		mi, err := loadOrBuildMetainfo(root, filepath.Join(cacheDir, e.Name()+".torrent"))
+		if err != nil {
+			log.Printf("error preparing %s for seeding: %v", e.Name(), err)
+			continue
+		}
+
+		t, err := SeedLocal(c, mi, root, completion)
+		if err != nil {
+			log.Printf("error seeding %s: %v", e.Name(), err)
+			continue
+		}
+		log.Printf("Seeding: %s", t.Name())
+	}
+
+	return nil
+}
+
+func seededDir(config *ClientConfig) string {
+	return filepath.Join(config.DownloadDir, "seeded")
+}
+
+// OpenSeedCompletion opens the database of verified pieces of the seeded
+// files.
+func OpenSeedCompletion(config *ClientConfig) (storage.PieceCompletion, error) {
+	if err := os.MkdirAll(seededDir(config), 0o777); err != nil {
+		return nil, fmt.Errorf("error creating seeded torrents directory: %w", err)
+	}
+	completion, err := storage.NewDefaultPieceCompletionForDir(seededDir(config))
+	if err != nil {
+		return nil, fmt.Errorf("error opening piece completion: %w", err)
+	}
+	return completion, nil
+}
+
+// loadOrBuildMetainfo returns the cached metainfo of root, or hashes root
+// again if its files were added, removed, resized or modified since.
+func loadOrBuildMetainfo(root, cachePath string) (*metainfo.MetaInfo, error) {
+	if fi, err := os.Stat(cachePath); err == nil {
+		mi, err := metainfo.LoadFromFile(cachePath)
+		if err == nil && metainfoCurrent(root, mi, fi.ModTime()) {
+			return mi, nil
+		}
+		log.Printf("Files of %s changed, hashing them again", filepath.Base(root))
+	}
+
+	mi, err := BuildMetainfo(root, CreateRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(cachePath)
+	if err != nil {
+		return nil, fmt.Errorf("error creating torrent file: %w", err)
+	}
+	defer f.Close()
+
+	if err := mi.Write(f); err != nil {
+		return nil, fmt.Errorf("error writing torrent file: %w", err)
+	}
+	return mi, nil
+}
+
+var errStaleMetainfo = errors.New("files changed")
+
+// metainfoCurrent reports whether the files under root are the ones mi was
+// built from, with the same paths and sizes and none modified after builtAt.
+func metainfoCurrent(root string, mi *metainfo.MetaInfo, builtAt time.Time) bool {
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return false
+	}
+	lengths := make(map[string]int64)
+	for _, f := range info.UpvertedFiles() {
+		lengths[filepath.Join(f.BestPath()...)] = f.Length
+	}
+
+	var found int
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if path == root {
+			rel = ""
+		}
+		length, ok := lengths[rel]
+		if !ok || length != fi.Size() || fi.ModTime().After(builtAt) {
+			return errStaleMetainfo
+		}
+		found++
+		return nil
+	})
+	return err == nil && found == len(lengths)
+}
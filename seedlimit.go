@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const seedLimitInterval = 30 * time.Second
+
+// What happens to a torrent that reached its seed limits.
+const (
+	seedLimitStop = "stop" // keeps it loaded without uploading
+	seedLimitDrop = "drop" // drops it and its saved torrent file
+)
+
+// SeedLimiter enforces SeedRatioLimit and SeedTimeLimit, or the torrent's
+// own limits, on complete torrents. The ratio counts uploads across
+// restarts against the torrent's length, and the seed time adds up the time
+// spent complete across restarts.
+type SeedLimiter struct {
+	c      *torrent.Client
+	config *ClientConfig
+	svc    *Services
+
+	lastChecked map[metainfo.Hash]time.Time // complete torrents only
+
+	mu      sync.Mutex
+	stopped map[metainfo.Hash]bool
+}
+
+func NewSeedLimiter(c *torrent.Client, config *ClientConfig, svc *Services) *SeedLimiter {
+	return &SeedLimiter{
+		c:           c,
+		config:      config,
+		svc:         svc,
+		lastChecked: make(map[metainfo.Hash]time.Time),
+		stopped:     make(map[metainfo.Hash]bool),
+	}
+}
+
+// ValidateSeedLimitAction checks the SeedLimitAction flag.
+func ValidateSeedLimitAction(action string) error {
+	if action != seedLimitStop && action != seedLimitDrop {
+		return fmt.Errorf("invalid seed limit action %q", action)
+	}
+	return nil
+}
+
+// Stopped reports whether the torrent's uploads were stopped for reaching
+// its seed limits.
+func (l *SeedLimiter) Stopped(ih metainfo.Hash) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopped[ih]
+}
+
+// Run checks the torrents every seedLimitInterval until ctx is done.
+func (l *SeedLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(seedLimitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.check()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *SeedLimiter) check() {
+	_, totals := l.svc.Session.Totals(l.c)
+	now := time.Now()
+	for _, t := range l.c.Torrents() {
+		ih := t.InfoHash()
+		if l.Stopped(ih) || t.Info() == nil || !t.Complete().Bool() {
+			delete(l.lastChecked, ih)
+			continue
+		}
+		var elapsed time.Duration
+		if last, ok := l.lastChecked[ih]; ok {
+			elapsed = now.Sub(last)
+		}
+		l.lastChecked[ih] = now
+		seeded := l.svc.Session.AddSeedTime(ih.String(), elapsed)
+
+		ratioLimit, timeLimit := l.config.SeedRatioLimit, l.config.SeedTimeLimit
+		settings := l.svc.Settings.Get(ih.String())
+		if settings.SeedRatioLimit != nil {
+			ratioLimit = *settings.SeedRatioLimit
+		}
+		if settings.SeedTimeLimit != nil {
+			timeLimit = time.Duration(*settings.SeedTimeLimit) * time.Second
+		}
+
+		var reason string
+		ratio := float64(totals[ih.String()].Uploaded) / float64(max(t.Length(), 1))
+		switch {
+		case ratioLimit > 0 && ratio >= ratioLimit:
+			reason = fmt.Sprintf("ratio %.2f", ratio)
+		case timeLimit > 0 && seeded >= timeLimit:
+			reason = fmt.Sprintf("seeded for %s", seeded.Round(time.Second))
+		default:
+			continue
+		}
+
+		if l.config.SeedLimitAction == seedLimitDrop {
+			// Like a drained delete, the torrent stays until its streams
+			// end; it's checked again next time.
+			if l.svc.Streams.Active(ih.String()) > 0 {
+				continue
+			}
+			log.Printf("Torrent %s reached its seed limit (%s), dropping it", t.Name(), reason)
+			if err := removeTorrentFile(l.config, ih); err != nil {
+				log.Print(err)
+			}
+			if err := l.svc.Users.RemoveOwners(ih.String()); err != nil {
+				log.Print(err)
+			}
+			DropTorrent(t, l.config, l.svc)
+			delete(l.lastChecked, ih)
+			continue
+		}
+		log.Printf("Torrent %s reached its seed limit (%s), stopping uploads", t.Name(), reason)
+		t.DisallowDataUpload()
+		l.mu.Lock()
+		l.stopped[ih] = true
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/anacrolix/torrent"
+)
+
+// TorrentSettings override the global streaming options for every stream of
+// one torrent. Nil fields fall back to the configuration.
+type TorrentSettings struct {
+	Responsive *bool  `json:",omitempty"`
+	Readahead  *int64 `json:",omitempty"`
+	// Groups torrents in GET /torrents?label=. Set to "" to remove it.
+	Label *string `json:",omitempty"`
+	// Override SeedRatioLimit and SeedTimeLimit (in seconds), 0 disables.
+	SeedRatioLimit *float64 `json:",omitempty"`
+	SeedTimeLimit  *int64   `json:",omitempty"`
+	// Stops all uploads of the torrent, seeding or not. false can't
+	// override the NoUpload flag.
+	NoUpload *bool `json:",omitempty"`
+	// Whether to keep uploading once complete, overriding NoSeed. Only
+	// chosen when the torrent is added, with ?seed=.
+	Seed *bool `json:",omitempty"`
+
+	// Storage backend, only chosen when the torrent is added.
+	Storage string `json:",omitempty"`
+	// Set through the pause and resume endpoints.
+	Paused bool `json:",omitempty"`
+}
+
+// SettingsStore keeps per-torrent settings in the metadata database, and
+// labels in the torrents directory too.
+type SettingsStore struct {
+	mu       sync.RWMutex
+	config   *ClientConfig
+	meta     *MetadataStore
+	torrents map[string]TorrentSettings
+}
+
+const settingsKey = "torrent-settings"
+
+func LoadSettings(config *ClientConfig, meta *MetadataStore) *SettingsStore {
+	s := &SettingsStore{config: config, meta: meta, torrents: make(map[string]TorrentSettings)}
+	if _, err := meta.Get(settingsKey, &s.torrents); err != nil {
+		log.Printf("error loading torrent settings: %v", err)
+	}
+
+	// Restore the labels missing from the database, as when it was deleted.
+	labels, err := loadTorrentLabels(config)
+	if err != nil {
+		log.Print(err)
+	}
+	var restored bool
+	for ih, label := range labels {
+		settings := s.torrents[ih]
+		if settings.Label == nil {
+			settings.Label = &label
+			s.torrents[ih] = settings
+			restored = true
+		}
+	}
+	if restored {
+		if err := meta.Put(settingsKey, s.torrents); err != nil {
+			log.Print(err)
+		}
+	}
+	return s
+}
+
+func (s *SettingsStore) Get(infoHash string) TorrentSettings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.torrents[infoHash]
+}
+
+// Update applies the non-nil (non-empty) fields of update to the torrent's
+// settings and returns the result.
+func (s *SettingsStore) Update(infoHash string, update TorrentSettings) (TorrentSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	settings := s.torrents[infoHash]
+	if update.Responsive != nil {
+		settings.Responsive = update.Responsive
+	}
+	if update.Readahead != nil {
+		settings.Readahead = update.Readahead
+	}
+	if update.SeedRatioLimit != nil {
+		settings.SeedRatioLimit = update.SeedRatioLimit
+	}
+	if update.SeedTimeLimit != nil {
+		settings.SeedTimeLimit = update.SeedTimeLimit
+	}
+	if update.NoUpload != nil {
+		settings.NoUpload = update.NoUpload
+	}
+	if update.Seed != nil {
+		settings.Seed = update.Seed
+	}
+	if update.Label != nil {
+		settings.Label = update.Label
+		if *update.Label == "" {
+			settings.Label = nil
+		}
+		if err := saveTorrentLabel(s.config, infoHash, *update.Label); err != nil {
+			return settings, err
+		}
+	}
+	if update.Storage != "" {
+		settings.Storage = update.Storage
+	}
+	if settings == (TorrentSettings{}) {
+		if _, ok := s.torrents[infoHash]; !ok {
+			return settings, nil
+		}
+		delete(s.torrents, infoHash)
+	} else {
+		s.torrents[infoHash] = settings
+	}
+	return settings, s.meta.Put(settingsKey, s.torrents)
+}
+
+func (s *SettingsStore) SetPaused(infoHash string, paused bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	settings := s.torrents[infoHash]
+	settings.Paused = paused
+	if settings == (TorrentSettings{}) {
+		delete(s.torrents, infoHash)
+	} else {
+		s.torrents[infoHash] = settings
+	}
+	return s.meta.Put(settingsKey, s.torrents)
+}
+
+func (s *SettingsStore) Delete(infoHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	settings, ok := s.torrents[infoHash]
+	if !ok {
+		return nil
+	}
+	if settings.Label != nil {
+		if err := saveTorrentLabel(s.config, infoHash, ""); err != nil {
+			return err
+		}
+	}
+	delete(s.torrents, infoHash)
+	return s.meta.Put(settingsKey, s.torrents)
+}
+
+// Seeds reports whether the torrent keeps uploading once complete.
+func Seeds(config *ClientConfig, settings TorrentSettings) bool {
+	if settings.Seed != nil {
+		return *settings.Seed
+	}
+	return !config.NoSeed
+}
+
+// ApplyNoUpload disallows or allows the torrent's uploads as its NoUpload
+// setting says, if set. Uploads aren't allowed again for a complete torrent
+// that isn't seeding, because of NoSeed or its seed limits.
+func ApplyNoUpload(t *torrent.Torrent, config *ClientConfig, svc *Services, settings TorrentSettings) {
+	if settings.NoUpload == nil {
+		return
+	}
+	if *settings.NoUpload {
+		t.DisallowDataUpload()
+		return
+	}
+	if t.Complete().Bool() && (!Seeds(config, settings) || svc.SeedLimits.Stopped(t.InfoHash())) {
+		return
+	}
+	t.AllowDataUpload()
+}
+
+// ParseTorrentSettings reads the ?responsive=, ?readahead=, ?storage=,
+// ?label= and ?seed= add-time options. Readahead accepts the same sizes as the ReadaheadByType
+// flag.
+func ParseTorrentSettings(query url.Values) (TorrentSettings, error) {
+	var settings TorrentSettings
+	if v := query.Get("responsive"); v != "" {
+		responsive, err := strconv.ParseBool(v)
+		if err != nil {
+			return settings, fmt.Errorf("invalid responsive parameter")
+		}
+		settings.Responsive = &responsive
+	}
+	if v := query.Get("readahead"); v != "" {
+		readahead, err := parseByteSize(v)
+		if err != nil {
+			return settings, fmt.Errorf("invalid readahead parameter")
+		}
+		settings.Readahead = &readahead
+	}
+	if v := query.Get("storage"); v != "" {
+		if !isStorageBackend(v) {
+			return settings, fmt.Errorf("invalid storage parameter")
+		}
+		settings.Storage = v
+	}
+	if v := query.Get("label"); v != "" {
+		settings.Label = &v
+	}
+	if v := query.Get("seed"); v != "" {
+		seed, err := strconv.ParseBool(v)
+		if err != nil {
+			return settings, fmt.Errorf("invalid seed parameter")
+		}
+		settings.Seed = &seed
+	}
+	return settings, nil
+}
+
+func HandlePatchInfoHash(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ih, ok := ParseInfoHashParam(w, r)
+		if !ok {
+			return
+		}
+		t, ok := c.Torrent(ih)
+		if !ok || !svc.Users.CanAccess(UserFromContext(r.Context()), ih.String()) {
+			http.Error(w, "Torrent not found", http.StatusNotFound)
+			return
+		}
+
+		var update TorrentSettings
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if update.Storage != "" {
+			http.Error(w, "Storage can only be chosen when adding a torrent", http.StatusBadRequest)
+			return
+		}
+		if update.Seed != nil {
+			http.Error(w, "Seed can only be chosen when adding a torrent", http.StatusBadRequest)
+			return
+		}
+		if update.Paused {
+			http.Error(w, "Use the pause and resume endpoints", http.StatusBadRequest)
+			return
+		}
+		if update.SeedRatioLimit != nil && *update.SeedRatioLimit < 0 || update.SeedTimeLimit != nil && *update.SeedTimeLimit < 0 {
+			http.Error(w, "Seed limits can't be negative", http.StatusBadRequest)
+			return
+		}
+		settings, err := svc.Settings.Update(ih.String(), update)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if update.NoUpload != nil {
+			ApplyNoUpload(t, config, svc, settings)
+		}
+
+		parsed, err := json.Marshal(settings)
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		w.Write(parsed)
+	})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+type ClientStats struct {
+	ListenPort       int
+	Torrents         int
+	ActivePeers      int
+	BytesRead        int64
+	BytesWritten     int64
+	BytesReadData    int64
+	BytesWrittenData int64
+	Blocklist        *BlocklistStatus
+	Memory           MemoryStats
+
+	// Totals across restarts.
+	Total        TransferTotals
+	TorrentTotal map[string]TransferTotals
+}
+
+// MemoryStats is a subset of runtime.MemStats, in bytes.
+type MemoryStats struct {
+	HeapAlloc    uint64
+	HeapInuse    uint64
+	HeapReleased uint64
+	StackInuse   uint64
+	Sys          uint64
+	NumGC        uint32
+	Limit        int64 // soft limit, math.MaxInt64 when unset
+}
+
+// TransferTotals counts payload bytes, excluding protocol overhead.
+type TransferTotals struct {
+	Downloaded int64
+	Uploaded   int64
+}
+
+// SessionStats keeps transfer counters from previous sessions in the database
+// so totals survive restarts.
+type SessionStats struct {
+	mu      sync.Mutex
+	meta    *MetadataStore
+	saved   savedStats
+	started time.Time
+}
+
+type savedStats struct {
+	Global   TransferTotals
+	Torrents map[string]TransferTotals
+	Added    map[string]time.Time
+	Seeded   map[string]time.Duration // time spent complete, for SeedTimeLimit
+}
+
+func LoadSessionStats(meta *MetadataStore) *SessionStats {
+	s := &SessionStats{meta: meta, started: time.Now()}
+	if _, err := meta.Get(sessionStatsKey, &s.saved); err != nil {
+		log.Printf("error loading session stats, starting from zero: %v", err)
+	}
+	if s.saved.Added == nil {
+		s.saved.Added = make(map[string]time.Time)
+	}
+	if s.saved.Seeded == nil {
+		s.saved.Seeded = make(map[string]time.Duration)
+	}
+	return s
+}
+
+// Added returns when the torrent was first seen by the server, which is
+// when it was added unless that was before added times were recorded.
+func (s *SessionStats) Added(infoHash string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	added, ok := s.saved.Added[infoHash]
+	if !ok {
+		added = time.Now()
+		s.saved.Added[infoHash] = added
+	}
+	return added
+}
+
+// AddSeedTime adds d to the time the torrent has spent complete and returns
+// the total across restarts.
+func (s *SessionStats) AddSeedTime(infoHash string, d time.Duration) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saved.Seeded[infoHash] += d
+	return s.saved.Seeded[infoHash]
+}
+
+const (
+	sessionStatsKey      = "session-stats"
+	sessionStatsInterval = time.Minute
+)
+
+// Totals returns the saved counters plus what has been transferred this
+// session.
+func (s *SessionStats) Totals(c *torrent.Client) (TransferTotals, map[string]TransferTotals) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := c.Stats()
+	global := TransferTotals{
+		Downloaded: s.saved.Global.Downloaded + stats.BytesReadUsefulData.Int64(),
+		Uploaded:   s.saved.Global.Uploaded + stats.BytesWrittenData.Int64(),
+	}
+
+	torrents := make(map[string]TransferTotals, len(c.Torrents()))
+	for _, t := range c.Torrents() {
+		ih := t.InfoHash().String()
+		stats := t.Stats()
+		torrents[ih] = TransferTotals{
+			Downloaded: s.saved.Torrents[ih].Downloaded + stats.BytesReadUsefulData.Int64(),
+			Uploaded:   s.saved.Torrents[ih].Uploaded + stats.BytesWrittenData.Int64(),
+		}
+	}
+	return global, torrents
+}
+
+// Save writes the totals to the database. Torrents that aren't loaded, such
+// as ones still being resumed or that failed to resume, keep their saved
+// counters until they're removed with Forget.
+func (s *SessionStats) Save(c *torrent.Client) error {
+	global, live := s.Totals(c)
+	for ih := range live {
+		s.Added(ih)
+	}
+
+	s.mu.Lock()
+	torrents := make(map[string]TransferTotals, len(s.saved.Torrents)+len(live))
+	for ih, totals := range s.saved.Torrents {
+		torrents[ih] = totals
+	}
+	for ih, totals := range live {
+		torrents[ih] = totals
+	}
+	added := make(map[string]time.Time, len(s.saved.Added))
+	for ih, t := range s.saved.Added {
+		added[ih] = t
+	}
+	seeded := make(map[string]time.Duration, len(s.saved.Seeded))
+	for ih, d := range s.saved.Seeded {
+		seeded[ih] = d
+	}
+	s.mu.Unlock()
+
+	return s.meta.Put(sessionStatsKey, savedStats{Global: global, Torrents: torrents, Added: added, Seeded: seeded})
+}
+
+// Forget removes the counters, added time and seed time of a torrent that
+// was removed on purpose, so adding it again starts from zero.
+func (s *SessionStats) Forget(infoHash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.saved.Torrents, infoHash)
+	delete(s.saved.Added, infoHash)
+	delete(s.saved.Seeded, infoHash)
+}
+
+// Run saves the counters periodically until ctx is done.
+func (s *SessionStats) Run(ctx context.Context, c *torrent.Client) {
+	ticker := time.NewTicker(sessionStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Save(c); err != nil {
+				log.Print(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// SessionSummary is written to DownloadDir/sessions when the server shuts
+// down.
+type SessionSummary struct {
+	Started       time.Time
+	Ended         time.Time
+	Duration      string
+	Session       TransferTotals // this session only
+	Total         TransferTotals
+	CachedBytes   int64 // completed bytes of the torrents still loaded
+	DatabaseBytes int64 // size of the piece cache database on disk
+	Torrents      map[string]TorrentSummary
+}
+
+type TorrentSummary struct {
+	Name    string
+	Session TransferTotals
+	Total   TransferTotals
+}
+
+func (s *SessionStats) Summary(c *torrent.Client, config *ClientConfig) SessionSummary {
+	stats := c.Stats()
+	summary := SessionSummary{
+		Started: s.started,
+		Ended:   time.Now(),
+		Session: TransferTotals{
+			Downloaded: stats.BytesReadUsefulData.Int64(),
+			Uploaded:   stats.BytesWrittenData.Int64(),
+		},
+		Torrents: make(map[string]TorrentSummary, len(c.Torrents())),
+	}
+	summary.Duration = summary.Ended.Sub(summary.Started).Round(time.Second).String()
+
+	var totals map[string]TransferTotals
+	summary.Total, totals = s.Totals(c)
+	for _, t := range c.Torrents() {
+		ih := t.InfoHash().String()
+		stats := t.Stats()
+		summary.CachedBytes += t.BytesCompleted()
+		summary.Torrents[ih] = TorrentSummary{
+			Name: t.Name(),
+			Session: TransferTotals{
+				Downloaded: stats.BytesReadUsefulData.Int64(),
+				Uploaded:   stats.BytesWrittenData.Int64(),
+			},
+			Total: totals[ih],
+		}
+	}
+
+	summary.DatabaseBytes = databaseSize(config)
+	return summary
+}
+
+// WriteSummary saves the session summary as JSON and logs the headline
+// numbers.
+func (s *SessionStats) WriteSummary(c *torrent.Client, config *ClientConfig) error {
+	summary := s.Summary(c, config)
+	log.Printf(
+		"Session lasted %s: downloaded %d bytes, uploaded %d bytes across %d torrents, %d bytes cached",
+		summary.Duration,
+		summary.Session.Downloaded,
+		summary.Session.Uploaded,
+		len(summary.Torrents),
+		summary.CachedBytes,
+	)
+
+	dir := filepath.Join(config.DownloadDir, "sessions")
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return fmt.Errorf("error creating sessions directory: %w", err)
+	}
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding session summary: %w", err)
+	}
+	name := summary.Ended.Format("2006-01-02T15-04-05") + ".json"
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0o666); err != nil {
+		return fmt.Errorf("error writing session summary: %w", err)
+	}
+	return nil
+}
+
+func GetClientStats(c *torrent.Client, svc *Services, u *User) ClientStats {
+	stats := c.Stats()
+	clientStats := ClientStats{
+		ListenPort:       c.LocalPort(),
+		Torrents:         len(c.Torrents()),
+		BytesRead:        stats.BytesRead.Int64(),
+		BytesWritten:     stats.BytesWritten.Int64(),
+		BytesReadData:    stats.BytesReadData.Int64(),
+		BytesWrittenData: stats.BytesWrittenData.Int64(),
+		Blocklist:        svc.Blocklist.Status(),
+		Memory:           GetMemoryStats(),
+	}
+	for _, t := range c.Torrents() {
+		clientStats.ActivePeers += t.Stats().ActivePeers
+	}
+
+	var torrents map[string]TransferTotals
+	clientStats.Total, torrents = svc.Session.Totals(c)
+	clientStats.TorrentTotal = make(map[string]TransferTotals, len(torrents))
+	for ih, totals := range torrents {
+		if svc.Users.CanAccess(u, ih) {
+			clientStats.TorrentTotal[ih] = totals
+		}
+	}
+	return clientStats
+}
+
+func GetMemoryStats() MemoryStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return MemoryStats{
+		HeapAlloc:    m.HeapAlloc,
+		HeapInuse:    m.HeapInuse,
+		HeapReleased: m.HeapReleased,
+		StackInuse:   m.StackInuse,
+		Sys:          m.Sys,
+		NumGC:        m.NumGC,
+		Limit:        debug.SetMemoryLimit(-1),
+	}
+}
+
+func HandleGetStats(c *torrent.Client, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parsed, err := json.Marshal(GetClientStats(c, svc, UserFromContext(r.Context())))
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(parsed)
+	})
+}
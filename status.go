@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/anacrolix/torrent"
+)
+
+// Torrent states reported by the status endpoint.
+const (
+	stateFetchingMetadata = "fetching-metadata"
+	stateDownloading      = "downloading"
+	statePaused           = "paused"
+	stateComplete         = "complete"
+	stateVerifying        = "verifying"
+)
+
+type TorrentStatus struct {
+	InfoHash       string
+	Name           string
+	State          string
+	HasInfo        bool
+	Peers          int // connected
+	KnownPeers     int // including those not connected
+	Seeders        int
+	Length         int64 `json:",omitempty"`
+	BytesCompleted int64 `json:",omitempty"`
+	Progress       float64
+}
+
+func GetTorrentStatus(t *torrent.Torrent, svc *Services) TorrentStatus {
+	stats := t.Stats()
+	status := TorrentStatus{
+		InfoHash:   t.InfoHash().String(),
+		Name:       t.Name(),
+		State:      stateFetchingMetadata,
+		Peers:      stats.ActivePeers,
+		KnownPeers: stats.TotalPeers,
+		Seeders:    stats.ConnectedSeeders,
+	}
+	if t.Info() == nil {
+		return status
+	}
+
+	status.HasInfo = true
+	status.Length = t.Length()
+	status.BytesCompleted = t.BytesCompleted()
+	if status.Length > 0 {
+		status.Progress = float64(status.BytesCompleted) / float64(status.Length)
+	}
+	switch {
+	case svc.Verifier.Running(status.InfoHash):
+		status.State = stateVerifying
+	case t.Complete().Bool():
+		status.State = stateComplete
+	case svc.Settings.Get(status.InfoHash).Paused:
+		status.State = statePaused
+	default:
+		status.State = stateDownloading
+	}
+	return status
+}
+
+// HandleGetTorrentStatus serves GET /torrents/{infohash}/status without waiting for
+// the metadata, so clients that added a torrent with ?async=true can poll it.
+func HandleGetTorrentStatus(c *torrent.Client, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ih, ok := ParseInfoHashParam(w, r)
+		if !ok {
+			return
+		}
+		t, ok := c.Torrent(ih)
+		if !ok || !svc.Users.CanAccess(UserFromContext(r.Context()), ih.String()) {
+			http.Error(w, "Torrent not found", http.StatusNotFound)
+			return
+		}
+
+		parsed, err := json.Marshal(GetTorrentStatus(t, svc))
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(parsed)
+	})
+}
+
+type AddAccepted struct {
+	InfoHash string
+	Status   string // URL to poll
+}
+
+// WriteAddAccepted answers an asynchronous add with 202 and where to poll.
+func WriteAddAccepted(w http.ResponseWriter, t *torrent.Torrent) {
+	accepted := AddAccepted{
+		InfoHash: t.InfoHash().String(),
+		Status:   "/torrents/" + t.InfoHash().String() + "/status",
+	}
+	parsed, err := json.Marshal(accepted)
+	if err != nil {
+		log.Printf("error encoding JSON response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+	w.Header().Set("Location", accepted.Status)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(parsed)
+}
+
+type TorrentStats struct {
+	InfoHash       string
+	Length         int64
+	BytesCompleted int64
+	DownloadRate   float64 // bytes per second over the last few seconds
+	UploadRate     float64
+	Downloaded     int64 // payload bytes this session
+	Uploaded       int64
+	Peers          int // connected
+	KnownPeers     int
+	Seeders        int
+	PiecesComplete int
+	Pieces         int
+	// Distributed copies among connected peers: the integer part is how
+	// many peers have the rarest piece, the fraction is the share of pieces
+	// held by more peers than that.
+	Availability float64
+	// Pieces still missing that no connected peer has.
+	UnavailablePieces int
+	// Seconds until the download completes at the current rate, -1 when
+	// unknown.
+	ETA int64
+}
+
+func GetTorrentStats(t *torrent.Torrent, svc *Services) TorrentStats {
+	stats := t.Stats()
+	ts := TorrentStats{
+		InfoHash:       t.InfoHash().String(),
+		Downloaded:     stats.BytesReadUsefulData.Int64(),
+		Uploaded:       stats.BytesWrittenData.Int64(),
+		Peers:          stats.ActivePeers,
+		KnownPeers:     stats.TotalPeers,
+		Seeders:        stats.ConnectedSeeders,
+		PiecesComplete: stats.PiecesComplete,
+		ETA:            -1,
+	}
+	ts.DownloadRate, ts.UploadRate = svc.Rates.Rates(ts.InfoHash)
+	if t.Info() == nil {
+		return ts
+	}
+
+	ts.Length = t.Length()
+	ts.BytesCompleted = t.BytesCompleted()
+	ts.Pieces = t.NumPieces()
+	if remaining := ts.Length - ts.BytesCompleted; remaining == 0 {
+		ts.ETA = 0
+	} else if ts.DownloadRate > 0 {
+		ts.ETA = int64(float64(remaining) / ts.DownloadRate)
+	}
+
+	counts := make([]int, ts.Pieces)
+	for _, pc := range t.PeerConns() {
+		pc.PeerPieces().Iterate(func(i uint32) bool {
+			if int(i) >= len(counts) {
+				return false
+			}
+			counts[i]++
+			return true
+		})
+	}
+	if len(counts) > 0 {
+		rarest := counts[0]
+		for _, n := range counts {
+			rarest = min(rarest, n)
+		}
+		var above int
+		for i, n := range counts {
+			if n > rarest {
+				above++
+			}
+			if n == 0 && !t.PieceState(i).Complete {
+				ts.UnavailablePieces++
+			}
+		}
+		ts.Availability = float64(rarest) + float64(above)/float64(len(counts))
+	}
+	return ts
+}
+
+func HandleGetTorrentStats(c *torrent.Client, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ih, ok := ParseInfoHashParam(w, r)
+		if !ok {
+			return
+		}
+		t, ok := c.Torrent(ih)
+		if !ok || !svc.Users.CanAccess(UserFromContext(r.Context()), ih.String()) {
+			http.Error(w, "Torrent not found", http.StatusNotFound)
+			return
+		}
+
+		parsed, err := json.Marshal(GetTorrentStats(t, svc))
+		if err != nil {
+			log.Printf("error encoding JSON response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(parsed)
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// Storage backends that can be picked per torrent with ?storage=.
+const (
+	storageSqlite = "sqlite" // piece cache database
+	storageFile   = "file"   // regular files under DownloadDir/files
+	storageMemory = "memory" // RAM only, gone when the torrent is dropped
+)
+
+func isStorageBackend(name string) bool {
+	return name == storageSqlite || name == storageFile || name == storageMemory
+}
+
+// StorageRouter opens each torrent in the backend chosen for it when it was
+// added, falling back to the configured StorageBackend. The choice is kept
+// with the torrent's settings so resumed torrents find their data again even
+// if the default changes.
+type StorageRouter struct {
+	backends map[string]storage.ClientImplCloser
+	fallback string
+	settings *SettingsStore
+}
+
+func NewStorageRouter(config *ClientConfig, sqlite storage.ClientImplCloser, settings *SettingsStore) *StorageRouter {
+	return &StorageRouter{
+		backends: map[string]storage.ClientImplCloser{
+			storageSqlite: sqlite,
+			storageFile:   storage.NewFile(fileStorageDir(config)),
+			storageMemory: &memoryStorage{},
+		},
+		fallback: config.StorageBackend,
+		settings: settings,
+	}
+}
+
+func fileStorageDir(config *ClientConfig) string {
+	return filepath.Join(config.DownloadDir, "files")
+}
+
+// deleteTorrentFiles removes a torrent's files from the file storage, building
+// each path the way the storage does, then the directories that leave empty.
+// Nothing is removed recursively, so a bad name can't reach other torrents'
+// data or the storage dir itself.
+func deleteTorrentFiles(config *ClientConfig, info *metainfo.Info) error {
+	base := fileStorageDir(config)
+	var prefix []string
+	if name := info.BestName(); name != metainfo.NoName {
+		prefix = append(prefix, name)
+	}
+	dirs := map[string]bool{}
+	var errs []error
+	for _, f := range info.UpvertedFiles() {
+		rel, err := storage.ToSafeFilePath(append(slices.Clone(prefix), f.BestPath()...)...)
+		if err == nil && !filepath.IsLocal(rel) {
+			err = fmt.Errorf("file path %q is outside the storage dir", rel)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := os.Remove(filepath.Join(base, rel)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+		for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	// Deepest first, so parents are empty by the time they're tried. Dirs
+	// still holding other files stay.
+	sorted := slices.Collect(maps.Keys(dirs))
+	slices.SortFunc(sorted, func(a, b string) int { return len(b) - len(a) })
+	for _, dir := range sorted {
+		os.Remove(filepath.Join(base, dir))
+	}
+	return errors.Join(errs...)
+}
+
+func (r *StorageRouter) OpenTorrent(ctx context.Context, info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	name := r.settings.Get(infoHash.String()).Storage
+	if name == "" {
+		name = r.fallback
+		if _, err := r.settings.Update(infoHash.String(), TorrentSettings{Storage: name}); err != nil {
+			log.Printf("error saving storage backend: %v", err)
+		}
+	}
+	backend, ok := r.backends[name]
+	if !ok {
+		return storage.TorrentImpl{}, fmt.Errorf("unknown storage backend %q", name)
+	}
+	return backend.OpenTorrent(ctx, info, infoHash)
+}
+
+func (r *StorageRouter) Close() error {
+	var errs []error
+	for _, backend := range r.backends {
+		errs = append(errs, backend.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// memoryStorage keeps pieces in RAM, allocating each piece on its first
+// write. Everything is released when the torrent is closed.
+type memoryStorage struct{}
+
+type memoryPiece struct {
+	mu       sync.RWMutex
+	length   int64
+	data     []byte
+	complete bool
+}
+
+func (*memoryStorage) OpenTorrent(_ context.Context, info *metainfo.Info, _ metainfo.Hash) (storage.TorrentImpl, error) {
+	pieces := make([]*memoryPiece, info.NumPieces())
+	for i := range pieces {
+		pieces[i] = &memoryPiece{length: info.Piece(i).Length()}
+	}
+	return storage.TorrentImpl{
+		Piece: func(p metainfo.Piece) storage.PieceImpl {
+			return pieces[p.Index()]
+		},
+		Close: func() error {
+			for _, p := range pieces {
+				p.mu.Lock()
+				p.data = nil
+				p.complete = false
+				p.mu.Unlock()
+			}
+			return nil
+		},
+	}, nil
+}
+
+func (*memoryStorage) Close() error {
+	return nil
+}
+
+func (p *memoryPiece) ReadAt(b []byte, off int64) (int, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if off >= p.length {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(b)), p.length-off))
+	if p.data == nil {
+		clear(b[:n])
+	} else {
+		copy(b, p.data[off:off+int64(n)])
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (p *memoryPiece) WriteAt(b []byte, off int64) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.data == nil {
+		p.data = make([]byte, p.length)
+	}
+	return copy(p.data[off:], b), nil
+}
+
+func (p *memoryPiece) MarkComplete() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.complete = true
+	return nil
+}
+
+func (p *memoryPiece) MarkNotComplete() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.complete = false
+	return nil
+}
+
+func (p *memoryPiece) Completion() storage.Completion {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return storage.Completion{Complete: p.complete, Ok: true}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func newTestRouter(t *testing.T, fallback string) (*StorageRouter, *recordingStorage, *SettingsStore) {
+	t.Helper()
+	config := &ClientConfig{DownloadDir: t.TempDir(), StorageBackend: fallback}
+	settings := LoadSettings(config, newTestMetadataStore(t, config))
+	sqlite := &recordingStorage{}
+	r := NewStorageRouter(config, sqlite, settings)
+	t.Cleanup(func() { r.Close() })
+	return r, sqlite, settings
+}
+
+func TestStorageRouter(t *testing.T) {
+	r, sqlite, settings := newTestRouter(t, storageSqlite)
+	ctx := context.Background()
+
+	// Torrents without a backend get the fallback, which is kept for them.
+	fallback := metainfo.Hash{1}
+	if _, err := r.OpenTorrent(ctx, testInfo(), fallback); err != nil {
+		t.Fatal(err)
+	}
+	if got := settings.Get(fallback.String()).Storage; got != storageSqlite {
+		t.Errorf("saved storage = %q, want %q", got, storageSqlite)
+	}
+	r.fallback = storageMemory
+	if _, err := r.OpenTorrent(ctx, testInfo(), fallback); err != nil {
+		t.Fatal(err)
+	}
+	if want := []metainfo.Hash{fallback, fallback}; !reflect.DeepEqual(sqlite.opened, want) {
+		t.Errorf("sqlite opened %v, want %v after the fallback changed", sqlite.opened, want)
+	}
+
+	memory := metainfo.Hash{2}
+	if _, err := settings.Update(memory.String(), TorrentSettings{Storage: storageMemory}); err != nil {
+		t.Fatal(err)
+	}
+	impl, err := r.OpenTorrent(ctx, testInfo(), memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sqlite.opened) != 2 {
+		t.Error("a memory torrent was opened in sqlite")
+	}
+	p := impl.Piece(testInfo().Piece(0))
+	p.WriteAt(chunk(7), 16)
+	got := make([]byte, 16)
+	if _, err := p.ReadAt(got, 16); err != nil || !reflect.DeepEqual(got, chunk(7)) {
+		t.Errorf("memory piece read %v, %v, want the written chunk", got, err)
+	}
+
+	unknown := metainfo.Hash{3}
+	if _, err := settings.Update(unknown.String(), TorrentSettings{Storage: "tape"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.OpenTorrent(ctx, testInfo(), unknown); err == nil {
+		t.Error("an unknown backend was opened")
+	}
+}
+
+func TestDeleteTorrentFiles(t *testing.T) {
+	config := &ClientConfig{DownloadDir: t.TempDir()}
+	base := fileStorageDir(config)
+	create := func(names ...string) {
+		for _, name := range names {
+			path := filepath.Join(base, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, nil, 0o666); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(base, filepath.FromSlash(name)))
+		return err == nil
+	}
+
+	create("show/s1/e1.mkv", "show/s1/e2.mkv", "show/extra.txt", "other/file.mkv", "single.mkv")
+	show := &metainfo.Info{Name: "show", Files: []metainfo.FileInfo{
+		{Path: []string{"s1", "e1.mkv"}},
+		{Path: []string{"s1", "e2.mkv"}},
+		{Path: []string{"missing.mkv"}},
+	}}
+	if err := deleteTorrentFiles(config, show); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"show/s1/e1.mkv", "show/s1"} {
+		if exists(name) {
+			t.Errorf("%s wasn't deleted", name)
+		}
+	}
+	// Files the torrent doesn't list stay, and so do their directories.
+	for _, name := range []string{"show/extra.txt", "other/file.mkv", "single.mkv"} {
+		if !exists(name) {
+			t.Errorf("%s was deleted", name)
+		}
+	}
+
+	// Names that would reach the storage dir or past it delete nothing.
+	for _, name := range []string{"", ".", ".."} {
+		info := &metainfo.Info{Name: name, Files: []metainfo.FileInfo{{Path: []string{"other"}}}}
+		deleteTorrentFiles(config, info)
+		if !exists("other/file.mkv") {
+			t.Fatalf("a torrent named %q deleted another torrent's data", name)
+		}
+	}
+	if !exists("") {
+		t.Fatal("the storage dir was deleted")
+	}
+
+	if err := deleteTorrentFiles(config, &metainfo.Info{Name: "single.mkv", Length: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if exists("single.mkv") {
+		t.Error("single file torrent wasn't deleted")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const defaultDrainTimeout = 30 * time.Minute
+
+// StreamTracker counts the open streams of each torrent so a drop can wait
+// for them to finish.
+type StreamTracker struct {
+	mu          sync.Mutex
+	active      map[string]int
+	changed     chan struct{} // closed and replaced whenever a stream ends
+	reconfigure map[*streamHandle]func()
+	draining    bool
+}
+
+type streamHandle struct{}
+
+func NewStreamTracker() *StreamTracker {
+	return &StreamTracker{
+		active:      make(map[string]int),
+		changed:     make(chan struct{}),
+		reconfigure: make(map[*streamHandle]func()),
+	}
+}
+
+// Start records a new stream for the torrent and returns the function ending
+// it. reconfigure, if not nil, is called when the streaming options change
+// while the stream is open.
+func (s *StreamTracker) Start(infoHash string, reconfigure func()) func() {
+	h := new(streamHandle)
+	s.mu.Lock()
+	s.active[infoHash]++
+	if reconfigure != nil {
+		s.reconfigure[h] = reconfigure
+	}
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.active[infoHash]--; s.active[infoHash] == 0 {
+				delete(s.active, infoHash)
+			}
+			delete(s.reconfigure, h)
+			close(s.changed)
+			s.changed = make(chan struct{})
+		})
+	}
+}
+
+// Reconfigure reapplies the streaming options to every open stream.
+func (s *StreamTracker) Reconfigure() {
+	s.mu.Lock()
+	fns := make([]func(), 0, len(s.reconfigure))
+	for _, fn := range s.reconfigure {
+		fns = append(fns, fn)
+	}
+	s.mu.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// Drain marks the server as shutting down, after which no torrents are added.
+func (s *StreamTracker) Drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+}
+
+func (s *StreamTracker) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// Count returns the number of open streams across all torrents.
+func (s *StreamTracker) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for _, active := range s.active {
+		n += active
+	}
+	return n
+}
+
+// Active returns the number of open streams of the torrent.
+func (s *StreamTracker) Active(infoHash string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active[infoHash]
+}
+
+// Wait blocks until the torrent has no open streams or ctx is done.
+func (s *StreamTracker) Wait(ctx context.Context, infoHash string) error {
+	for {
+		s.mu.Lock()
+		active, changed := s.active[infoHash], s.changed
+		s.mu.Unlock()
+		if active == 0 {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
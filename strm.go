@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+const (
+	strmSyncInterval = 15 * time.Second
+	strmDirsKey      = "strm-dirs"
+)
+
+var invalidPathChars = strings.NewReplacer(
+	"<", "_", ">", "_", ":", "_", `"`, "_", "/", "_", `\`, "_", "|", "_", "?", "_", "*", "_",
+)
+
+// RunStrmExporter mirrors the video files of every torrent into
+// config.StrmDir as .strm files, one folder per torrent, until ctx is done.
+// Folders of dropped torrents are removed; folders it didn't create are
+// never touched.
+func RunStrmExporter(ctx context.Context, c *torrent.Client, config *ClientConfig, meta *MetadataStore) {
+	// Maps infohashes to the folder created for them.
+	managed := make(map[string]string)
+	if _, err := meta.Get(strmDirsKey, &managed); err != nil {
+		log.Print(err)
+	}
+
+	ticker := time.NewTicker(strmSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := syncStrmFiles(c, config, managed); err != nil {
+			log.Printf("error syncing .strm files: %v", err)
+		}
+		if err := meta.Put(strmDirsKey, managed); err != nil {
+			log.Print(err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func syncStrmFiles(c *torrent.Client, config *ClientConfig, managed map[string]string) error {
+	localIP, err := URLHost(config)
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]bool)
+	for _, t := range c.Torrents() {
+		ih := t.InfoHash().String()
+		current[ih] = true
+		if t.Info() == nil {
+			continue
+		}
+		dir := invalidPathChars.Replace(t.Name())
+		managed[ih] = dir
+
+		for _, f := range t.Files() {
+			if !isVideo(f.DisplayPath()) {
+				continue
+			}
+			if err := writeStrm(filepath.Join(config.StrmDir, dir), f, BuildUrl(f, localIP, config.Port, nil)); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+
+	for ih, dir := range managed {
+		if current[ih] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(config.StrmDir, dir)); err != nil {
+			log.Printf("error removing .strm files for %s: %v", dir, err)
+			continue
+		}
+		delete(managed, ih)
+	}
+	return nil
+}
+
+func writeStrm(dir string, f *torrent.File, url string) error {
+	parts := strings.Split(f.DisplayPath(), "/")
+	for i := range parts {
+		parts[i] = invalidPathChars.Replace(parts[i])
+	}
+	rel := filepath.Join(parts...)
+	path := filepath.Join(dir, strings.TrimSuffix(rel, filepath.Ext(rel))+".strm")
+
+	if existing, err := os.ReadFile(path); err == nil && string(existing) == url {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return fmt.Errorf("error creating .strm directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(url), 0o666); err != nil {
+		return fmt.Errorf("error writing .strm file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+var subtitleExts = map[string]bool{
+	".srt": true,
+	".ass": true,
+	".ssa": true,
+	".vtt": true,
+}
+
+func isSubtitle(name string) bool {
+	return subtitleExts[strings.ToLower(filepath.Ext(name))]
+}
+
+// AttachSubtitles fills in Subtitles for every video with the URLs of the
+// subtitle files sharing its base name, such as "Show.S01E01.srt" or
+// "Show.S01E01.en.ass" for "Show.S01E01.mkv". Subtitles are matched by file
+// name alone so a separate Subs folder works too.
+func AttachSubtitles(files []FileInfo) {
+	for i := range files {
+		if !isVideo(files[i].Name) {
+			continue
+		}
+		stem := strings.TrimSuffix(files[i].Name, filepath.Ext(files[i].Name))
+		for _, f := range files {
+			if !isSubtitle(f.Name) {
+				continue
+			}
+			subStem := strings.TrimSuffix(f.Name, filepath.Ext(f.Name))
+			if subStem == stem || strings.HasPrefix(subStem, stem+".") {
+				files[i].Subtitles = append(files[i].Subtitles, f.URL)
+			}
+		}
+	}
+}
+
+// edlURL builds an mpv EDL playlist entry playing url with the subtitle URLs
+// as extra tracks.
+func edlURL(url string, subtitles []string) string {
+	parts := []string{edlEscape(url)}
+	for _, sub := range subtitles {
+		parts = append(parts, "!new_stream", "!no_clip", edlEscape(sub))
+	}
+	return "edl://" + strings.Join(parts, ";")
+}
+
+// edlEscape length-prefixes s so separators inside URLs are taken literally.
+func edlEscape(s string) string {
+	return fmt.Sprintf("%%%d%%%s", len(s), s)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ReleaseInfo is what can be recovered from a scene-style release name such
+// as "Show.Name.S02E05.Episode.Title.1080p.WEB-DL.x264-GRP.mkv".
+type ReleaseInfo struct {
+	Title        string // show or movie title
+	Season       int
+	Episode      int
+	EpisodeTitle string
+	Year         int
+	Quality      string
+}
+
+var (
+	episodePattern = regexp.MustCompile(`(?i)\b(?:S(\d{1,2})[ .]?E(\d{1,3})|(\d{1,2})x(\d{2,3}))\b`)
+	yearPattern    = regexp.MustCompile(`\b(19\d\d|20\d\d)\b`)
+	qualityPattern = regexp.MustCompile(`(?i)\b(2160p|1080[pi]|720p|576p|480p|4k)\b`)
+
+	// Tokens that end the human readable part of a release name.
+	releaseTagPattern = regexp.MustCompile(`(?i)\b(2160p|1080[pi]|720p|576p|480p|4k|web-?dl|webrip|web|bluray|blu-ray|bdrip|brrip|dvdrip|hdtv|hdrip|remux|x26[45]|h ?26[45]|hevc|avc|xvid|aac|ac3|dts|ddp?5\.1|ddp|dd|proper|repack|internal|multi|complete)\b`)
+)
+
+func ParseReleaseName(name string) ReleaseInfo {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	clean := spaceSeparators(base)
+
+	var info ReleaseInfo
+	if m := qualityPattern.FindString(clean); m != "" {
+		info.Quality = strings.ToLower(m)
+	}
+
+	rest := clean
+	if loc := episodePattern.FindStringSubmatchIndex(clean); loc != nil {
+		m := episodePattern.FindStringSubmatch(clean)
+		season, episode := m[1], m[2]
+		if season == "" {
+			season, episode = m[3], m[4]
+		}
+		info.Season, _ = strconv.Atoi(season)
+		info.Episode, _ = strconv.Atoi(episode)
+		info.Title = tidyTitle(clean[:loc[0]])
+		rest = clean[loc[1]:]
+		if tag := releaseTagPattern.FindStringIndex(rest); tag != nil {
+			rest = rest[:tag[0]]
+		}
+		info.EpisodeTitle = tidyTitle(rest)
+		return info
+	}
+
+	if tag := releaseTagPattern.FindStringIndex(rest); tag != nil {
+		rest = rest[:tag[0]]
+	}
+	if loc := yearPattern.FindAllStringSubmatchIndex(rest, -1); len(loc) > 0 {
+		// The last year is the release year, earlier ones can be part of the
+		// title ("2001 A Space Odyssey 1968").
+		last := loc[len(loc)-1]
+		if last[0] > 0 {
+			info.Year, _ = strconv.Atoi(rest[last[2]:last[3]])
+			rest = rest[:last[0]]
+		}
+	}
+	info.Title = tidyTitle(rest)
+	return info
+}
+
+// spaceSeparators turns the dots and underscores standing in for spaces back
+// into spaces, keeping dots between digits ("5.1", "2.0").
+func spaceSeparators(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c == '_' {
+			b[i] = ' '
+		}
+		if c == '.' && !(i > 0 && i < len(b)-1 && isDigit(b[i-1]) && isDigit(b[i+1])) {
+			b[i] = ' '
+		}
+	}
+	return string(b)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func tidyTitle(s string) string {
+	s = strings.Trim(s, " .-[]()")
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// DisplayTitle is a clean title for playlists, like "Show S02E05 — Title" or
+// "Movie (2010)". It returns "" when nothing useful was parsed.
+func (r ReleaseInfo) DisplayTitle() string {
+	if r.Title == "" {
+		return ""
+	}
+	switch {
+	case r.Episode > 0 && r.EpisodeTitle != "":
+		return fmt.Sprintf("%s S%02dE%02d — %s", r.Title, r.Season, r.Episode, r.EpisodeTitle)
+	case r.Episode > 0:
+		return fmt.Sprintf("%s S%02dE%02d", r.Title, r.Season, r.Episode)
+	case r.Year > 0:
+		return fmt.Sprintf("%s (%d)", r.Title, r.Year)
+	default:
+		return r.Title
+	}
+}
+
+// SortFiles orders files for playback: episodes of a show by season and
+// episode, whatever their file names look like, and everything else in
+// natural order so "Episode 2" comes before "Episode 10".
+func SortFiles(files []FileInfo) {
+	type sortKey struct {
+		primary         string // show title for episodes, else the name
+		season, episode int
+	}
+	keys := make(map[string]sortKey, len(files))
+	for _, f := range files {
+		key := sortKey{primary: f.Name}
+		if info := ParseReleaseName(f.Name); info.Episode > 0 && info.Title != "" {
+			key = sortKey{primary: info.Title, season: info.Season, episode: info.Episode}
+		}
+		keys[f.Name] = key
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := keys[files[i].Name], keys[files[j].Name]
+		if c := naturalCompare(a.primary, b.primary); c != 0 {
+			return c < 0
+		}
+		if a.season != b.season {
+			return a.season < b.season
+		}
+		if a.episode != b.episode {
+			return a.episode < b.episode
+		}
+		return naturalCompare(files[i].Name, files[j].Name) < 0
+	})
+}
+
+// naturalCompare compares strings case-insensitively with runs of digits
+// compared by their value.
+func naturalCompare(a, b string) int {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			var numA, numB string
+			numA, a = splitDigits(a)
+			numB, b = splitDigits(b)
+			trimmedA, trimmedB := strings.TrimLeft(numA, "0"), strings.TrimLeft(numB, "0")
+			if len(trimmedA) != len(trimmedB) {
+				return cmp.Compare(len(trimmedA), len(trimmedB))
+			}
+			if c := strings.Compare(trimmedA, trimmedB); c != 0 {
+				return c
+			}
+			// "01" after "1"
+			if len(numA) != len(numB) {
+				return cmp.Compare(len(numA), len(numB))
+			}
+			continue
+		}
+
+		ra, sizeA := utf8.DecodeRuneInString(a)
+		rb, sizeB := utf8.DecodeRuneInString(b)
+		if la, lb := unicode.ToLower(ra), unicode.ToLower(rb); la != lb {
+			return cmp.Compare(la, lb)
+		}
+		a, b = a[sizeA:], b[sizeB:]
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+func splitDigits(s string) (digits, rest string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	selfSignedCertFile = "tls_cert.pem"
+	selfSignedKeyFile  = "tls_key.pem"
+	selfSignedValidity = 10 * 365 * 24 * time.Hour
+)
+
+// urlScheme is the scheme of the URLs handed out in playlists. run switches
+// it to https before the server starts when TLS is enabled.
+var urlScheme = "http"
+
+func TLSEnabled(config *ClientConfig) bool {
+	return config.TLSCert != "" || config.TLSSelfSigned
+}
+
+// LoadTLSConfig loads TLSCert and TLSKey, or with TLSSelfSigned a certificate
+// generated into DownloadDir on first run. It returns nil when TLS is off.
+func LoadTLSConfig(config *ClientConfig) (*tls.Config, error) {
+	certFile, keyFile := config.TLSCert, config.TLSKey
+	switch {
+	case (certFile == "") != (keyFile == ""):
+		return nil, errors.New("TLSCert and TLSKey must be set together")
+	case certFile == "" && !config.TLSSelfSigned:
+		return nil, nil
+	case certFile == "":
+		certFile = filepath.Join(config.DownloadDir, selfSignedCertFile)
+		keyFile = filepath.Join(config.DownloadDir, selfSignedKeyFile)
+		if _, err := os.Stat(certFile); errors.Is(err, fs.ErrNotExist) {
+			if err := generateSelfSigned(certFile, keyFile); err != nil {
+				return nil, err
+			}
+			log.Printf("Generated self-signed certificate %s", certFile)
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading TLS certificate: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// generateSelfSigned writes a certificate for localhost, the host name and
+// the current local addresses. Players don't verify it, but browsers will ask
+// for an exception.
+func generateSelfSigned(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("error generating TLS key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("error generating certificate serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: appID},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if ips, err := GetLocalIPs(); err == nil {
+		template.IPAddresses = append(template.IPAddresses, ips...)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("error creating certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("error encoding TLS key: %w", err)
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return fmt.Errorf("error writing TLS key: %w", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return fmt.Errorf("error writing certificate: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Saved torrents are named by infohash, as names aren't unique. The index
+// maps the infohashes back to names for whoever browses the directory.
+const torrentIndexFile = "index.json"
+
+var torrentIndexMu sync.Mutex
+
+func torrentsDir(config *ClientConfig) string {
+	return filepath.Join(config.DownloadDir, "torrents")
+}
+
+func torrentFilePath(config *ClientConfig, ih metainfo.Hash) string {
+	return filepath.Join(torrentsDir(config), ih.HexString()+".torrent")
+}
+
+// Labels are kept next to the torrent files as well as in the metadata
+// database, so they survive the database being deleted.
+const torrentLabelsFile = "labels.json"
+
+// updateTorrentIndex sets the name of ih in the index, or removes it when
+// name is empty.
+func updateTorrentIndex(config *ClientConfig, ih metainfo.Hash, name string) error {
+	return updateTorrentMap(filepath.Join(torrentsDir(config), torrentIndexFile), "torrent index", ih.HexString(), name)
+}
+
+// saveTorrentLabel sets the label of the torrent in the labels file, or
+// removes it when label is empty.
+func saveTorrentLabel(config *ClientConfig, infoHash, label string) error {
+	if err := os.MkdirAll(torrentsDir(config), 0o777); err != nil {
+		return fmt.Errorf("error creating torrents directory: %w", err)
+	}
+	return updateTorrentMap(filepath.Join(torrentsDir(config), torrentLabelsFile), "torrent labels", infoHash, label)
+}
+
+// loadTorrentLabels returns the labels file's labels by infohash.
+func loadTorrentLabels(config *ClientConfig) (map[string]string, error) {
+	labels := make(map[string]string)
+	data, err := os.ReadFile(filepath.Join(torrentsDir(config), torrentLabelsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return labels, nil
+		}
+		return labels, fmt.Errorf("error reading torrent labels: %w", err)
+	}
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return labels, fmt.Errorf("error decoding torrent labels: %w", err)
+	}
+	return labels, nil
+}
+
+// updateTorrentMap sets key to value in the JSON object at path, or removes
+// it when value is empty.
+func updateTorrentMap(path, what, key, value string) error {
+	torrentIndexMu.Lock()
+	defer torrentIndexMu.Unlock()
+
+	m := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading %s: %w", what, err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &m); err != nil {
+			log.Printf("error decoding %s, rebuilding it: %v", what, err)
+		}
+	}
+
+	if value == "" {
+		if _, ok := m[key]; !ok {
+			return nil
+		}
+		delete(m, key)
+	} else {
+		m[key] = value
+	}
+	data, err = json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %w", what, err)
+	}
+	if err := os.WriteFile(path, data, 0o666); err != nil {
+		return fmt.Errorf("error writing %s: %w", what, err)
+	}
+	return nil
+}
+
+// removeTorrentFile deletes the saved torrent file of ih, if any.
+func removeTorrentFile(config *ClientConfig, ih metainfo.Hash) error {
+	if err := os.Remove(torrentFilePath(config, ih)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error deleting torrent file: %w", err)
+	}
+	return updateTorrentIndex(config, ih, "")
+}
+
+// migrateTorrentFiles renames torrent files saved under the torrent's name
+// by earlier versions to their infohash.
+func migrateTorrentFiles(config *ClientConfig) {
+	entries, err := os.ReadDir(torrentsDir(config))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("error retrieving saved torrents: %v", err)
+		}
+		return
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		base, ok := strings.CutSuffix(name, ".torrent")
+		if e.IsDir() || !ok || isMatched(infoHashPattern, base) {
+			continue
+		}
+		path := filepath.Join(torrentsDir(config), name)
+		mi, err := metainfo.LoadFromFile(path)
+		if err != nil {
+			log.Printf("error migrating torrent file %s: %v", name, err)
+			continue
+		}
+		ih := mi.HashInfoBytes()
+		if err := os.Rename(path, torrentFilePath(config, ih)); err != nil {
+			log.Printf("error migrating torrent file %s: %v", name, err)
+			continue
+		}
+		if err := updateTorrentIndex(config, ih, base); err != nil {
+			log.Print(err)
+		}
+		log.Printf("Renamed torrent file %s to %s.torrent", name, ih.HexString())
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+)
+
+// TrackerInfo describes one of a torrent's trackers. UDP trackers are
+// announced to over IPv4 and IPv6 separately, the results are merged here.
+type TrackerInfo struct {
+	URL          string
+	Tier         int
+	Announced    bool     // at least one announce completed
+	Peers        int      // returned by the last announces
+	NextAnnounce string   `json:",omitempty"`
+	Errors       []string `json:",omitempty"` // from the last announces
+}
+
+// trackerStatus is one announcer's line of the client status page.
+type trackerStatus struct {
+	next string
+	last string
+}
+
+// HandleGetTrackers lists a torrent's trackers with their announce status.
+func HandleGetTrackers(c *torrent.Client, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, ok := trackerTorrent(w, r, c, svc)
+		if !ok {
+			return
+		}
+		writeTrackers(w, r, c, t)
+	})
+}
+
+// HandlePostTrackers adds a JSON array of tracker URLs to a torrent, for
+// example public trackers for a magnet that is slow to find peers.
+func HandlePostTrackers(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, ok := trackerTorrent(w, r, c, svc)
+		if !ok {
+			return
+		}
+
+		var urls []string
+		if err := json.NewDecoder(r.Body).Decode(&urls); err != nil || len(urls) == 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		for _, u := range urls {
+			if err := validateTrackerURL(u); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		t.AddTrackers([][]string{urls})
+		log.Printf("Added %d trackers to torrent: %s", len(urls), t.Name())
+		saveTrackers(config, t)
+
+		writeTrackers(w, r, c, t)
+	})
+}
+
+// HandleDeleteTrackers removes the tracker given by ?url= from a torrent.
+// The client stops every announcer when a torrent's tracker list is replaced
+// and won't restart the ones it already knows, so the remaining trackers are
+// only announced to again after the torrent is reloaded. The change is saved
+// with the torrent file so it survives that.
+func HandleDeleteTrackers(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, ok := trackerTorrent(w, r, c, svc)
+		if !ok {
+			return
+		}
+
+		target := r.URL.Query().Get("url")
+		var found bool
+		var trackers [][]string
+		for _, tier := range announceList(t) {
+			kept := slices.DeleteFunc(slices.Clone(tier), func(u string) bool { return u == target })
+			found = found || len(kept) < len(tier)
+			if len(kept) > 0 {
+				trackers = append(trackers, kept)
+			}
+		}
+		if !found {
+			http.Error(w, "Tracker not found", http.StatusNotFound)
+			return
+		}
+
+		t.ModifyTrackers(trackers)
+		log.Printf("Removed tracker %s from torrent: %s", target, t.Name())
+		saveTrackers(config, t)
+
+		writeTrackers(w, r, c, t)
+	})
+}
+
+func trackerTorrent(w http.ResponseWriter, r *http.Request, c *torrent.Client, svc *Services) (*torrent.Torrent, bool) {
+	ih, ok := ParseInfoHashParam(w, r)
+	if !ok {
+		return nil, false
+	}
+	t, ok := c.Torrent(ih)
+	if !ok || !svc.Users.CanAccess(UserFromContext(r.Context()), ih.String()) {
+		http.Error(w, "Torrent not found", http.StatusNotFound)
+		return nil, false
+	}
+	return t, true
+}
+
+func announceList(t *torrent.Torrent) [][]string {
+	mi := t.Metainfo()
+	if len(mi.AnnounceList) > 0 {
+		return mi.AnnounceList
+	}
+	if mi.Announce != "" {
+		return [][]string{{mi.Announce}}
+	}
+	return nil
+}
+
+func validateTrackerURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid tracker URL %q: %w", s, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "udp", "ws", "wss":
+	default:
+		return fmt.Errorf("unsupported tracker URL %q", s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("tracker URL %q has no host", s)
+	}
+	return nil
+}
+
+// saveTrackers rewrites the saved torrent file so a resumed torrent keeps the
+// modified tracker list.
+func saveTrackers(config *ClientConfig, t *torrent.Torrent) {
+	if !config.ResumeTorrents || t.Info() == nil {
+		return
+	}
+	if err := saveTorrentFile(config, t); err != nil {
+		log.Print(err)
+	}
+}
+
+func writeTrackers(w http.ResponseWriter, r *http.Request, c *torrent.Client, t *torrent.Torrent) {
+	parsed, err := json.Marshal(GetTrackers(c, t))
+	if err != nil {
+		log.Printf("error encoding JSON response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(parsed)
+}
+
+// GetTrackers lists the torrent's trackers by tier.
+func GetTrackers(c *torrent.Client, t *torrent.Torrent) []TrackerInfo {
+	statuses := trackerStatuses(c, t.InfoHash().HexString())
+	trackers := []TrackerInfo{}
+	for tier, urls := range announceList(t) {
+		for _, u := range urls {
+			info := TrackerInfo{URL: u, Tier: tier}
+			for _, variant := range announcerURLs(u) {
+				if s, ok := statuses[variant]; ok {
+					info.addStatus(variant, u, s)
+				}
+			}
+			trackers = append(trackers, info)
+		}
+	}
+	return trackers
+}
+
+func (info *TrackerInfo) addStatus(variant, u string, s trackerStatus) {
+	if info.NextAnnounce == "" {
+		info.NextAnnounce = s.next
+	}
+	switch {
+	case s.last == "", s.last == "never":
+	case strings.HasSuffix(s.last, " peers"):
+		peers, err := strconv.Atoi(strings.TrimSuffix(s.last, " peers"))
+		if err == nil {
+			info.Announced = true
+			info.Peers += peers
+			break
+		}
+		fallthrough
+	default:
+		if variant != u {
+			// Tell the IPv4 and IPv6 announces of a UDP tracker apart.
+			s.last = strings.SplitN(variant, ":", 2)[0] + ": " + s.last
+		}
+		info.Errors = append(info.Errors, s.last)
+	}
+}
+
+// announcerURLs returns the URLs the client announces to for a tracker.
+func announcerURLs(s string) []string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "udp" {
+		return []string{s}
+	}
+	u4, u6 := *u, *u
+	u4.Scheme, u6.Scheme = "udp4", "udp6"
+	return []string{u4.String(), u6.String()}
+}
+
+// trackerStatuses reads the announce status of the torrent's trackers from
+// the client status page, which is the only place the client exposes it.
+func trackerStatuses(c *torrent.Client, infoHash string) map[string]trackerStatus {
+	var buf bytes.Buffer
+	c.WriteStatus(&buf)
+
+	statuses := make(map[string]trackerStatus)
+	var inTorrent, inTrackers bool
+	scanner := bufio.NewScanner(&buf)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "Infohash: "):
+			inTorrent = line == "Infohash: "+infoHash
+		case !inTorrent:
+		case line == "Enabled trackers:":
+			inTrackers = true
+		case inTrackers && strings.HasPrefix(line, `    "`):
+			rest := strings.TrimPrefix(line, "    ")
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				continue
+			}
+			u, _ := strconv.Unquote(quoted)
+			var s trackerStatus
+			extra := strings.TrimSpace(rest[len(quoted):])
+			if next, last, ok := strings.Cut(extra, ", last ann: "); ok {
+				s.next = strings.TrimPrefix(next, "next ann: ")
+				s.last = last
+			}
+			statuses[u] = s
+		case inTrackers && !strings.HasPrefix(line, "    "):
+			return statuses
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+)
+
+//go:embed ui/index.html
+var uiFiles embed.FS
+
+// HandleGetUI serves the web UI. The page itself holds no data; it calls the
+// JSON API with the token from its own ?token= parameter.
+func HandleGetUI() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFileFS(w, r, uiFiles, "ui/index.html")
+	})
+}
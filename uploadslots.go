@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+const uploadSlotInterval = 10 * time.Second
+
+// UploadSlots caps how many peers of each torrent are uploaded to at once,
+// so a slow uplink isn't split between so many peers that streaming stalls.
+// The client can't choke single peers, so once more than MaxUploadSlots
+// peers are taking data the extra ones are disconnected, keeping the peers
+// that give the most back and then the fastest.
+type UploadSlots struct {
+	c     *torrent.Client
+	slots int
+	meter *PeerMeter
+}
+
+// NewUploadSlots returns nil when MaxUploadSlots is 0, leaving the client's
+// own choking alone.
+func NewUploadSlots(c *torrent.Client, config *ClientConfig, meter *PeerMeter) *UploadSlots {
+	if config.MaxUploadSlots <= 0 {
+		return nil
+	}
+	return &UploadSlots{c: c, slots: config.MaxUploadSlots, meter: meter}
+}
+
+func (s *UploadSlots) Run(ctx context.Context) {
+	ticker := time.NewTicker(uploadSlotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, t := range s.c.Torrents() {
+				s.enforce(t)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type uploadingPeer struct {
+	pc       *torrent.PeerConn
+	download float64
+	upload   float64
+}
+
+func (s *UploadSlots) enforce(t *torrent.Torrent) {
+	var uploading []uploadingPeer
+	for _, pc := range t.PeerConns() {
+		download, upload := s.meter.Rates(pc)
+		if upload > 0 {
+			uploading = append(uploading, uploadingPeer{pc, download, upload})
+		}
+	}
+	if len(uploading) <= s.slots {
+		return
+	}
+
+	sort.Slice(uploading, func(i, j int) bool {
+		if uploading[i].download != uploading[j].download {
+			return uploading[i].download > uploading[j].download
+		}
+		return uploading[i].upload > uploading[j].upload
+	})
+	for _, p := range uploading[s.slots:] {
+		log.Printf("Closing %s for %s, all %d upload slots are in use", p.pc.RemoteAddr, t.Name(), s.slots)
+		p.pc.Close()
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+type User struct {
+	Name  string
+	Token string
+	Admin bool
+
+	// Quotas, ignored when zero or negative.
+	MaxCacheBytes int64
+	// Bytes per second served over HTTP to this user's streams, shared by
+	// all of them. It doesn't limit downloading from peers.
+	MaxServeRate int
+}
+
+// UserStore maps API tokens to users and tracks which users own which
+// torrents. A nil *UserStore means multi-user support is disabled and every
+// request can see every torrent.
+type UserStore struct {
+	mu       sync.RWMutex
+	users    map[string]*User
+	owners   map[string]map[string]bool
+	meta     *MetadataStore
+	limiters map[string]*rate.Limiter
+}
+
+type userContextKey struct{}
+
+const (
+	ownersKey    = "owners"
+	apiTokenUser = "api"
+)
+
+// LoadUsers reads the users file. ApiToken adds an admin user of its own, so
+// setting only ApiToken protects the server with a single shared token.
+func LoadUsers(config *ClientConfig, meta *MetadataStore) (*UserStore, error) {
+	if config.UsersFile == "" && config.ApiToken == "" {
+		return nil, nil
+	}
+
+	var users []*User
+	if config.UsersFile != "" {
+		data, err := os.ReadFile(config.UsersFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading users file: %w", err)
+		}
+		if err := json.Unmarshal(data, &users); err != nil {
+			return nil, fmt.Errorf("error parsing users file: %w", err)
+		}
+	}
+	if config.ApiToken != "" {
+		users = append(users, &User{Name: apiTokenUser, Token: config.ApiToken, Admin: true})
+	}
+
+	s := &UserStore{
+		users:    make(map[string]*User, len(users)),
+		owners:   make(map[string]map[string]bool),
+		meta:     meta,
+		limiters: make(map[string]*rate.Limiter),
+	}
+	for _, u := range users {
+		if u.Name == "" || u.Token == "" {
+			return nil, fmt.Errorf("user entries require a Name and a Token")
+		}
+		if _, ok := s.users[u.Token]; ok {
+			return nil, fmt.Errorf("duplicate token for user %s", u.Name)
+		}
+		s.users[u.Token] = u
+	}
+
+	if _, err := meta.Get(ownersKey, &s.owners); err != nil {
+		return nil, err
+	}
+	if err := s.migrateOwners(config); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// migrateOwners moves the owners that earlier versions kept in
+// DownloadDir/owners.json into the metadata database, then renames the file
+// so it's only imported once.
+func (s *UserStore) migrateOwners(config *ClientConfig) error {
+	path := filepath.Join(config.DownloadDir, "owners.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error reading torrent owners: %w", err)
+	}
+	var owners map[string]map[string]bool
+	if err := json.Unmarshal(data, &owners); err != nil {
+		return fmt.Errorf("error parsing torrent owners: %w", err)
+	}
+
+	for infoHash, names := range owners {
+		if s.owners[infoHash] == nil {
+			s.owners[infoHash] = make(map[string]bool, len(names))
+		}
+		for name, owns := range names {
+			if owns {
+				s.owners[infoHash][name] = true
+			}
+		}
+	}
+	if err := s.saveOwners(); err != nil {
+		return err
+	}
+	if err := os.Rename(path, path+".migrated"); err != nil {
+		return fmt.Errorf("error renaming torrent owners: %w", err)
+	}
+	log.Printf("Moved the owners of %d torrents from %s into the metadata database", len(owners), path)
+	return nil
+}
+
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+func UserFromContext(ctx context.Context) *User {
+	u, _ := ctx.Value(userContextKey{}).(*User)
+	return u
+}
+
+// Authenticate returns the user the token belongs to.
+func (s *UserStore) Authenticate(token string) (*User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[token]
+	return u, ok
+}
+
+// RequireUser rejects requests without a known token and stores the
+// authenticated user in the request context.
+func (s *UserStore) RequireUser(next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, ok := s.Authenticate(requestToken(r))
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, u)))
+	})
+}
+
+// RequireAuthenticatedAdmin is like RequireAdmin, but refuses every request
+// when neither UsersFile nor ApiToken is set. It guards routes that read or
+// write the server's files, which a page could otherwise reach through a
+// local server that accepts anyone.
+func (s *UserStore) RequireAuthenticatedAdmin(next http.Handler) http.Handler {
+	if s == nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Forbidden, this endpoint needs UsersFile or ApiToken", http.StatusForbidden)
+		})
+	}
+	return s.RequireAdmin(next)
+}
+
+// RequireAdmin is like RequireUser but only lets admins through.
+func (s *UserStore) RequireAdmin(next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+	return s.RequireUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !UserFromContext(r.Context()).Admin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+func (s *UserStore) CanAccess(u *User, infoHash string) bool {
+	if s == nil || u == nil || u.Admin {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.owners[infoHash][u.Name]
+}
+
+func (s *UserStore) AddOwner(u *User, infoHash string) error {
+	if s == nil || u == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owners[infoHash][u.Name] {
+		return nil
+	}
+	if s.owners[infoHash] == nil {
+		s.owners[infoHash] = make(map[string]bool)
+	}
+	s.owners[infoHash][u.Name] = true
+	return s.saveOwners()
+}
+
+// RemoveOwner releases u's claim on a torrent and reports whether the torrent
+// is no longer owned by anyone and can be dropped. Admins release every claim.
+func (s *UserStore) RemoveOwner(u *User, infoHash string) (bool, error) {
+	if s == nil || u == nil {
+		return true, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u.Admin {
+		delete(s.owners, infoHash)
+	} else {
+		delete(s.owners[infoHash], u.Name)
+	}
+	if len(s.owners[infoHash]) > 0 {
+		return false, s.saveOwners()
+	}
+	delete(s.owners, infoHash)
+	return true, s.saveOwners()
+}
+
+// RemoveOwners releases every user's claim on a torrent that is dropped
+// without any of them asking.
+func (s *UserStore) RemoveOwners(infoHash string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.owners[infoHash]; !ok {
+		return nil
+	}
+	delete(s.owners, infoHash)
+	return s.saveOwners()
+}
+
+func (s *UserStore) saveOwners() error {
+	return s.meta.Put(ownersKey, s.owners)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testInfoHash = "e44902f06dabe219c4bfe67d9dee63c5eba84b37"
+
+func newTestMetadataStore(t *testing.T, config *ClientConfig) *MetadataStore {
+	t.Helper()
+	meta, err := OpenMetadataStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { meta.Close() })
+	return meta
+}
+
+// newTestUsers returns a store with the admin "root" (token "r"), the user
+// "alice" (token "a") and the user "bob" (token "b").
+func newTestUsers(t *testing.T) (*UserStore, *ClientConfig) {
+	t.Helper()
+	dir := t.TempDir()
+	config := &ClientConfig{DownloadDir: dir, UsersFile: filepath.Join(dir, "users.json")}
+	users := `[
+		{"Name": "root", "Token": "r", "Admin": true},
+		{"Name": "alice", "Token": "a"},
+		{"Name": "bob", "Token": "b"}
+	]`
+	if err := os.WriteFile(config.UsersFile, []byte(users), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadUsers(config, newTestMetadataStore(t, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, config
+}
+
+func TestLoadUsers(t *testing.T) {
+	dir := t.TempDir()
+	s, err := LoadUsers(&ClientConfig{DownloadDir: dir}, nil)
+	if s != nil || err != nil {
+		t.Errorf("LoadUsers without UsersFile or ApiToken = %v, %v, want nil, nil", s, err)
+	}
+
+	config := &ClientConfig{DownloadDir: dir, ApiToken: "k"}
+	s, err = LoadUsers(config, newTestMetadataStore(t, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := s.Authenticate("k"); !ok || u.Name != apiTokenUser || !u.Admin {
+		t.Errorf("Authenticate(ApiToken) = %+v, %v, want the admin %q", u, ok, apiTokenUser)
+	}
+	if _, ok := s.Authenticate(""); ok {
+		t.Error("Authenticate accepted an empty token")
+	}
+
+	for name, users := range map[string]string{
+		"duplicate token": `[{"Name": "a", "Token": "t"}, {"Name": "b", "Token": "t"}]`,
+		"missing token":   `[{"Name": "a"}]`,
+		"missing name":    `[{"Token": "t"}]`,
+		"invalid JSON":    `{`,
+	} {
+		config := &ClientConfig{DownloadDir: dir, UsersFile: filepath.Join(dir, "users.json")}
+		if err := os.WriteFile(config.UsersFile, []byte(users), 0o666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadUsers(config, nil); err == nil {
+			t.Errorf("LoadUsers with a %s succeeded", name)
+		}
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	s, _ := newTestUsers(t)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, tc := range []struct {
+		name   string
+		mw     func(http.Handler) http.Handler
+		header string
+		query  string
+		want   int
+	}{
+		{"user, no token", s.RequireUser, "", "", http.StatusUnauthorized},
+		{"user, unknown token", s.RequireUser, "Bearer x", "", http.StatusUnauthorized},
+		{"user, bearer token", s.RequireUser, "Bearer a", "", http.StatusOK},
+		{"user, query token", s.RequireUser, "", "?token=a", http.StatusOK},
+		{"admin, user token", s.RequireAdmin, "Bearer a", "", http.StatusForbidden},
+		{"admin, admin token", s.RequireAdmin, "Bearer r", "", http.StatusOK},
+		{"authenticated admin, admin token", s.RequireAuthenticatedAdmin, "Bearer r", "", http.StatusOK},
+		{"authenticated admin, user token", s.RequireAuthenticatedAdmin, "Bearer b", "", http.StatusForbidden},
+		{"admin, no users", (*UserStore)(nil).RequireAdmin, "", "", http.StatusOK},
+		{"authenticated admin, no users", (*UserStore)(nil).RequireAuthenticatedAdmin, "", "", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", "/"+tc.query, nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		w := httptest.NewRecorder()
+		tc.mw(ok).ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
+
+func TestOwners(t *testing.T) {
+	s, config := newTestUsers(t)
+	root, _ := s.Authenticate("r")
+	alice, _ := s.Authenticate("a")
+	bob, _ := s.Authenticate("b")
+
+	if s.CanAccess(alice, testInfoHash) {
+		t.Error("alice can access an unowned torrent")
+	}
+	if !s.CanAccess(root, testInfoHash) {
+		t.Error("admin can't access every torrent")
+	}
+
+	for _, u := range []*User{alice, bob} {
+		if err := s.AddOwner(u, testInfoHash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !s.CanAccess(alice, testInfoHash) || !s.CanAccess(bob, testInfoHash) {
+		t.Error("owners can't access their torrent")
+	}
+
+	// The owners are kept in the metadata database.
+	reloaded, err := LoadUsers(config, s.meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.CanAccess(alice, testInfoHash) {
+		t.Error("ownership was lost on reload")
+	}
+
+	if unowned, err := s.RemoveOwner(alice, testInfoHash); err != nil || unowned {
+		t.Errorf("RemoveOwner(alice) = %v, %v, want false while bob owns it", unowned, err)
+	}
+	if s.CanAccess(alice, testInfoHash) {
+		t.Error("alice can still access a released torrent")
+	}
+	if unowned, err := s.RemoveOwner(bob, testInfoHash); err != nil || !unowned {
+		t.Errorf("RemoveOwner(bob) = %v, %v, want true for the last owner", unowned, err)
+	}
+
+	if err := s.AddOwner(alice, testInfoHash); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveOwners(testInfoHash); err != nil {
+		t.Fatal(err)
+	}
+	if s.CanAccess(alice, testInfoHash) {
+		t.Error("RemoveOwners left alice's claim")
+	}
+}
+
+func TestMigrateOwners(t *testing.T) {
+	dir := t.TempDir()
+	config := &ClientConfig{DownloadDir: dir, ApiToken: "k"}
+	path := filepath.Join(dir, "owners.json")
+	if err := os.WriteFile(path, []byte(`{"`+testInfoHash+`": {"alice": true}}`), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	meta := newTestMetadataStore(t, config)
+
+	s, err := LoadUsers(config, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.CanAccess(&User{Name: "alice"}, testInfoHash) {
+		t.Error("owners.json wasn't imported")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("owners.json is still there: %v", err)
+	}
+	if _, err := os.Stat(path + ".migrated"); err != nil {
+		t.Errorf("owners.json wasn't renamed: %v", err)
+	}
+
+	// The import only happens once, the database has the owners from now on.
+	if _, err := s.RemoveOwner(&User{Name: "alice"}, testInfoHash); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = LoadUsers(config, meta); err != nil {
+		t.Fatal(err)
+	}
+	if s.CanAccess(&User{Name: "alice"}, testInfoHash) {
+		t.Error("owners.json was imported again")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+// VerifyProgress reports a torrent's data re-verification.
+type VerifyProgress struct {
+	Running  bool
+	Pieces   int
+	Checked  int
+	Complete int // checked pieces whose data is intact
+	Started  time.Time
+	Finished *time.Time `json:",omitempty"`
+}
+
+// Verifier re-hashes torrents' pieces against the storage, for data left
+// behind by an unclean shutdown or a modified cache. Pieces that fail are
+// downloaded again.
+type Verifier struct {
+	workers int
+
+	mu   sync.Mutex
+	jobs map[string]*VerifyProgress
+}
+
+func NewVerifier(config *ClientConfig) *Verifier {
+	return &Verifier{workers: max(config.PieceHashers, 1), jobs: make(map[string]*VerifyProgress)}
+}
+
+// Start verifies the torrent's data in the background unless that is already
+// under way, and returns the progress.
+func (v *Verifier) Start(t *torrent.Torrent) VerifyProgress {
+	ih := t.InfoHash().String()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if job, ok := v.jobs[ih]; ok && job.Running {
+		return *job
+	}
+
+	job := &VerifyProgress{Running: true, Pieces: t.NumPieces(), Started: time.Now()}
+	v.jobs[ih] = job
+	log.Printf("Verifying torrent: %s", t.Name())
+	go v.run(t, job)
+	return *job
+}
+
+func (v *Verifier) run(t *torrent.Torrent, job *VerifyProgress) {
+	pieces := make(chan int)
+	var wg sync.WaitGroup
+	for range v.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range pieces {
+				t.Piece(i).VerifyData()
+				complete := t.PieceState(i).Complete
+				v.mu.Lock()
+				job.Checked++
+				if complete {
+					job.Complete++
+				}
+				v.mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for i := range t.NumPieces() {
+		select {
+		case pieces <- i:
+		case <-t.Closed():
+			break feed
+		}
+	}
+	close(pieces)
+	wg.Wait()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	finished := time.Now()
+	job.Running, job.Finished = false, &finished
+	log.Printf("Verified torrent: %s, %d of %d pieces intact", t.Name(), job.Complete, job.Pieces)
+}
+
+// Progress returns the torrent's last or running verification.
+func (v *Verifier) Progress(infoHash string) (VerifyProgress, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	job, ok := v.jobs[infoHash]
+	if !ok {
+		return VerifyProgress{}, false
+	}
+	return *job, true
+}
+
+func (v *Verifier) Running(infoHash string) bool {
+	progress, ok := v.Progress(infoHash)
+	return ok && progress.Running
+}
+
+// HandlePostVerify starts re-verifying a torrent's data and answers 202 with
+// the progress, which GET polls.
+func HandlePostVerify(c *torrent.Client, config *ClientConfig, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ih, ok := ParseInfoHashParam(w, r)
+		if !ok {
+			return
+		}
+		t, ok := c.Torrent(ih)
+		if !ok || !svc.Users.CanAccess(UserFromContext(r.Context()), ih.String()) {
+			http.Error(w, "Torrent not found", http.StatusNotFound)
+			return
+		}
+		if !awaitInfo(w, r, t, config) {
+			return
+		}
+
+		writeVerifyProgress(w, r, svc.Verifier.Start(t), http.StatusAccepted)
+	})
+}
+
+func HandleGetVerify(c *torrent.Client, svc *Services) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ih, ok := ParseInfoHashParam(w, r)
+		if !ok {
+			return
+		}
+		if _, ok := c.Torrent(ih); !ok || !svc.Users.CanAccess(UserFromContext(r.Context()), ih.String()) {
+			http.Error(w, "Torrent not found", http.StatusNotFound)
+			return
+		}
+		progress, ok := svc.Verifier.Progress(ih.String())
+		if !ok {
+			http.Error(w, "Torrent was not verified", http.StatusNotFound)
+			return
+		}
+
+		writeVerifyProgress(w, r, progress, http.StatusOK)
+	})
+}
+
+func writeVerifyProgress(w http.ResponseWriter, r *http.Request, progress VerifyProgress, code int) {
+	parsed, err := json.Marshal(progress)
+	if err != nil {
+		log.Printf("error encoding JSON response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(parsed)))
+	w.WriteHeader(code)
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(parsed)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Files are added once they haven't changed for this long, so half written
+// files aren't picked up.
+const watchSettleTime = time.Second
+
+// What happens to a watched file after its torrent was added.
+const (
+	watchKeep   = "keep"
+	watchDelete = "delete"
+	watchRename = "rename" // appends .added
+)
+
+func isWatchFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".torrent" || ext == ".magnet"
+}
+
+// RunWatcher adds every .torrent or .magnet file (a text file holding a
+// magnet link) that appears in config.WatchDir, including those already
+// there on startup, until ctx is done.
+func RunWatcher(ctx context.Context, c *torrent.Client, config *ClientConfig, adds *AddGate, infoCache *InfoCache) error {
+	switch config.WatchDirAction {
+	case watchKeep, watchDelete, watchRename:
+	default:
+		return fmt.Errorf("invalid watch directory action %q", config.WatchDirAction)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating watcher: %w", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(config.WatchDir); err != nil {
+		return fmt.Errorf("error watching %s: %w", config.WatchDir, err)
+	}
+
+	entries, err := os.ReadDir(config.WatchDir)
+	if err != nil {
+		return fmt.Errorf("error reading watch directory: %w", err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() && isWatchFile(e.Name()) {
+			addWatchedFile(c, config, adds, infoCache, filepath.Join(config.WatchDir, e.Name()))
+		}
+	}
+
+	var mu sync.Mutex
+	pending := make(map[string]*time.Timer)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, timer := range pending {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) || !isWatchFile(event.Name) {
+				continue
+			}
+			mu.Lock()
+			if timer, ok := pending[event.Name]; ok {
+				timer.Reset(watchSettleTime)
+			} else {
+				pending[event.Name] = time.AfterFunc(watchSettleTime, func() {
+					mu.Lock()
+					delete(pending, event.Name)
+					mu.Unlock()
+					addWatchedFile(c, config, adds, infoCache, event.Name)
+				})
+			}
+			mu.Unlock()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("error watching %s: %v", config.WatchDir, err)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func addWatchedFile(c *torrent.Client, config *ClientConfig, adds *AddGate, infoCache *InfoCache, path string) {
+	if err := addWatchedTorrent(c, config, adds, infoCache, path); err != nil {
+		log.Printf("error adding %s: %v", path, err)
+		return
+	}
+
+	switch config.WatchDirAction {
+	case watchDelete:
+		if err := os.Remove(path); err != nil {
+			log.Print(err)
+		}
+	case watchRename:
+		if err := os.Rename(path, path+".added"); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func addWatchedTorrent(c *torrent.Client, config *ClientConfig, adds *AddGate, infoCache *InfoCache, path string) error {
+	if strings.EqualFold(filepath.Ext(path), ".torrent") {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = ImportTorrent(c, config, adds, f)
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	magnet := strings.TrimSpace(string(data))
+	if !isMatched(magnetPattern, magnet) {
+		return fmt.Errorf("not a magnet link")
+	}
+	spec, err := ParseTorrentSpec(magnet)
+	if err != nil {
+		return err
+	}
+	_, err = addBackgroundTorrent(c, config, adds, infoCache, spec, magnet)
+	return err
+}
+
+// addBackgroundTorrent adds a torrent found without a request, applying the
+// configured defaults POST /torrents would.
+func addBackgroundTorrent(c *torrent.Client, config *ClientConfig, adds *AddGate, infoCache *InfoCache, spec *torrent.TorrentSpec, id string) (*torrent.Torrent, error) {
+	if err := adds.Check(); err != nil {
+		return nil, err
+	}
+	infoCache.Fill(spec)
+	log.Printf("Adding torrent: %s", id)
+	t, _, err := c.AddTorrentSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	ApplyConnLimit(t, config)
+	if config.NoSeed {
+		StopSeeding(t)
+	}
+	if config.ResumeTorrents {
+		// The torrent file can only be written once the metadata arrives.
+		go func() {
+			select {
+			case <-t.GotInfo():
+				if err := saveTorrentFile(config, t); err != nil {
+					log.Print(err)
+				}
+			case <-t.Closed():
+			}
+		}()
+	}
+	return t, nil
+}
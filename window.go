@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io"
+	"sync"
+
+	"github.com/anacrolix/torrent"
+)
+
+const defaultPriorityWindow = 64 << 20
+
+// PriorityManager keeps a sliding window of pieces ahead of every stream's
+// read position at high priority, followed by a window of the same size at
+// normal priority. It complements the reader's readahead, which only covers
+// the bytes needed next, so that seeking forward within the window finds the
+// pieces downloaded or already in flight. Pieces that fall out of every
+// stream's window go back to the priority of their file.
+type PriorityManager struct {
+	window int64
+
+	mu    sync.Mutex
+	heads map[*torrent.Torrent]map[*WindowReader]struct{}
+}
+
+func NewPriorityManager(window int64) *PriorityManager {
+	return &PriorityManager{
+		window: window,
+		heads:  make(map[*torrent.Torrent]map[*WindowReader]struct{}),
+	}
+}
+
+// pieceRange is a half open range of piece indexes.
+type pieceRange struct {
+	first, end int
+}
+
+func (r pieceRange) contains(i int) bool {
+	return r.first <= i && i < r.end
+}
+
+// WindowReader moves its stream's window along with reads and seeks.
+type WindowReader struct {
+	io.ReadSeeker
+	m    *PriorityManager
+	file *torrent.File
+	pos  int64
+
+	// Guarded by m.mu.
+	piece  int
+	high   pieceRange
+	normal pieceRange
+}
+
+// Track wraps a stream of file. The returned reader must be closed to release
+// its window. With a zero window reads and seeks are only passed through.
+func (m *PriorityManager) Track(r io.ReadSeeker, file *torrent.File) *WindowReader {
+	wr := &WindowReader{ReadSeeker: r, m: m, file: file, piece: -1}
+	if m.window <= 0 {
+		return wr
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := file.Torrent()
+	if m.heads[t] == nil {
+		m.heads[t] = make(map[*WindowReader]struct{})
+	}
+	m.heads[t][wr] = struct{}{}
+	m.moveLocked(wr)
+	return wr
+}
+
+func (r *WindowReader) Read(b []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(b)
+	r.pos += int64(n)
+	r.m.move(r)
+	return n, err
+}
+
+func (r *WindowReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.ReadSeeker.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+		r.m.move(r)
+	}
+	return pos, err
+}
+
+// Close drops the stream's window. It doesn't close the wrapped reader.
+func (r *WindowReader) Close() error {
+	m := r.m
+	if m.window <= 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := r.file.Torrent()
+	delete(m.heads[t], r)
+	if len(m.heads[t]) == 0 {
+		delete(m.heads, t)
+	}
+	old := []pieceRange{r.high, r.normal}
+	r.high, r.normal = pieceRange{}, pieceRange{}
+	m.updateLocked(t, old)
+	return nil
+}
+
+func (m *PriorityManager) move(r *WindowReader) {
+	if m.window <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.moveLocked(r)
+}
+
+func (m *PriorityManager) moveLocked(r *WindowReader) {
+	t := r.file.Torrent()
+	if _, ok := m.heads[t][r]; !ok || t.Info() == nil {
+		return
+	}
+
+	pieceLength := t.Info().PieceLength
+	offset := r.file.Offset() + min(r.pos, r.file.Length())
+	piece := int(offset / pieceLength)
+	if piece == r.piece {
+		return
+	}
+	r.piece = piece
+
+	// Stay within the file so other files of the torrent are left alone.
+	fileEnd := r.file.Offset() + r.file.Length()
+	pieceOf := func(off int64) int {
+		return int((min(off, fileEnd) + pieceLength - 1) / pieceLength)
+	}
+	old := []pieceRange{r.high, r.normal}
+	r.high = pieceRange{piece, pieceOf(offset + m.window)}
+	r.normal = pieceRange{r.high.end, pieceOf(offset + 2*m.window)}
+	m.updateLocked(t, append(old, r.high, r.normal))
+}
+
+// updateLocked recomputes the priority of every piece in ranges from the
+// windows of all the torrent's streams.
+func (m *PriorityManager) updateLocked(t *torrent.Torrent, ranges []pieceRange) {
+	done := make(map[int]bool)
+	for _, pr := range ranges {
+		for i := pr.first; i < pr.end && i < t.NumPieces(); i++ {
+			if done[i] {
+				continue
+			}
+			done[i] = true
+
+			prio := torrent.PiecePriorityNone
+			for head := range m.heads[t] {
+				switch {
+				case head.high.contains(i):
+					prio.Raise(torrent.PiecePriorityHigh)
+				case head.normal.contains(i):
+					prio.Raise(torrent.PiecePriorityNormal)
+				}
+			}
+			t.Piece(i).SetPriority(prio)
+		}
+	}
+}
+
+// Windows returns the ranges of pieces inside some stream's window, by
+// torrent.
+func (m *PriorityManager) Windows() map[*torrent.Torrent][]pieceRange {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	windows := make(map[*torrent.Torrent][]pieceRange, len(m.heads))
+	for t, heads := range m.heads {
+		for head := range heads {
+			windows[t] = append(windows[t], head.high, head.normal)
+		}
+	}
+	return windows
+}